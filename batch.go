@@ -56,7 +56,10 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
-	logRecordPos := wb.db.indexer.Get(key)
+	logRecordPos, err := wb.db.indexer.Get(key)
+	if err != nil {
+		return err
+	}
 	if logRecordPos == nil {
 		tmp := string(key)
 		if wb.pendingWrites[tmp] != nil {
@@ -85,16 +88,31 @@ func (wb *WriteBatch) Commit() error {
 	}
 
 	// 加锁保证事务提交串行化
-	wb.db.mu.Lock()
-	defer wb.db.mu.Unlock()
+	wb.db.lock()
+	defer wb.db.unlock()
 
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	if err := wb.db.writeTxnRecords(wb.pendingWrites, wb.syncWrite); err != nil {
+		return err
+	}
+
+	// 清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+
+	return nil
+}
+
+// writeTxnRecords 以事务的方式写入一批数据并更新内存索引，需要持有 db 的锁
+func (db *DB) writeTxnRecords(pendingWrites map[string]*data.LogRecord, syncWrite bool) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 
 	positions := make(map[string]*data.LogRecordPos)
 
 	// 开始写数据到数据文件当中
-	for _, record := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
+	for _, record := range pendingWrites {
+		logRecordPos, err := db.appendLogRecord(&data.LogRecord{
 			Key:   logRecordKeyWithSeqNo(record.Key, seqNo),
 			Value: record.Value,
 			Type:  record.Type,
@@ -112,37 +130,41 @@ func (wb *WriteBatch) Commit() error {
 		Type: data.LogRecordTxnFinished,
 	}
 
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	if _, err := db.appendLogRecord(finishedRecord); err != nil {
 		return err
 	}
 
 	// 根据配置决定是否持久化
-	if wb.syncWrite && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
+	if syncWrite && db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
 			return err
 		}
 	}
 
 	// 更新内存索引
-	for _, record := range wb.pendingWrites {
+	keys := make([][]byte, 0, len(pendingWrites))
+	for _, record := range pendingWrites {
 		pos := positions[string(record.Key)]
 
 		var oldPos *data.LogRecordPos
+		var err error
 		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.indexer.Put(record.Key, pos)
+			oldPos, err = db.indexer.Put(record.Key, pos)
 		}
 
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.indexer.Delete(record.Key)
+			oldPos, _, err = db.indexer.Delete(record.Key)
+		}
+		if err != nil {
+			return indexUpdateErr(err)
 		}
 
 		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+			db.markDead(oldPos)
 		}
+		keys = append(keys, record.Key)
 	}
-
-	// 清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
+	db.oracle.commit(keys)
 
 	return nil
 }
@@ -0,0 +1,46 @@
+package benchmark
+
+import (
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ysoding/bitcask"
+)
+
+// benchmarkSyncPut 64 个并发写入者开启同步写入时的 Put 吞吐量
+func benchmarkSyncPut(b *testing.B, groupCommit bool) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bench-sync")
+	defer os.RemoveAll(dir)
+
+	syncDB, err := bitcask.Open(bitcask.WithDBDirPath(dir), bitcask.WithDBSyncWrite(true),
+		bitcask.WithDBGroupCommit(groupCommit))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer syncDB.Close()
+
+	value := randomValue(128)
+	var n atomic.Int64
+	b.SetParallelism(max(1, 64/runtime.GOMAXPROCS(0)))
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := syncDB.Put(getTestKey(int(n.Add(1))), value); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func Benchmark_PutSync_Parallel(b *testing.B) {
+	b.Run("GroupCommit", func(b *testing.B) {
+		benchmarkSyncPut(b, true)
+	})
+	b.Run("NoGroupCommit", func(b *testing.B) {
+		benchmarkSyncPut(b, false)
+	})
+}
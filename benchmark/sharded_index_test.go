@@ -0,0 +1,43 @@
+package benchmark
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ysoding/bitcask"
+)
+
+// benchmarkParallelPut 并发写入时不同索引的 Put 吞吐量
+func benchmarkParallelPut(b *testing.B, indexerType bitcask.IndexerType) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bench-parallel")
+	defer os.RemoveAll(dir)
+
+	parallelDB, err := bitcask.Open(bitcask.WithDBDirPath(dir), bitcask.WithDBIndexerType(indexerType))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer parallelDB.Close()
+
+	value := randomValue(128)
+	var n atomic.Int64
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := parallelDB.Put(getTestKey(int(n.Add(1))), value); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func Benchmark_Put_Parallel(b *testing.B) {
+	b.Run("BTree", func(b *testing.B) {
+		benchmarkParallelPut(b, bitcask.BTree)
+	})
+	b.Run("ShardedBTree", func(b *testing.B) {
+		benchmarkParallelPut(b, bitcask.ShardedBTree)
+	})
+}
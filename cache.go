@@ -0,0 +1,111 @@
+package bitcask
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ysoding/bitcask/data"
+)
+
+// cacheEntryOverhead 每个缓存项除了 value 之外大约占用的内存
+const cacheEntryOverhead = 64
+
+type cacheKey struct {
+	fileID uint32
+	offset int64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value []byte
+}
+
+// valueCache 按照数据在文件中的位置缓存解码之后的 value，容量按照字节计算，超出时淘汰最久没有访问的数据
+// 数据文件只会追加写入，同一个位置的数据不会改变，只有 merge 重写数据文件之后需要清空
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List
+	items    map[cacheKey]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[cacheKey]*list.Element),
+	}
+}
+
+func entrySize(value []byte) int64 {
+	return int64(len(value)) + cacheEntryOverhead
+}
+
+// get 返回缓存的 value 的拷贝
+func (c *valueCache) get(pos *data.LogRecordPos) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[cacheKey{fileID: pos.FileID, offset: pos.Offset}]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.ll.MoveToFront(elem)
+	value := elem.Value.(*cacheEntry).value
+	return append(make([]byte, 0, len(value)), value...), true
+}
+
+// add 缓存 value 的拷贝，超过容量的 value 不缓存
+func (c *valueCache) add(pos *data.LogRecordPos, value []byte) {
+	size := entrySize(value)
+	if size > c.capacity {
+		return
+	}
+	key := cacheKey{fileID: pos.FileID, offset: pos.Offset}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	entry := &cacheEntry{key: key, value: append(make([]byte, 0, len(value)), value...)}
+	c.items[key] = c.ll.PushFront(entry)
+	c.size += size
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// remove 移除已经无效的位置上的数据
+func (c *valueCache) remove(pos *data.LogRecordPos) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[cacheKey{fileID: pos.FileID, offset: pos.Offset}]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *valueCache) removeElement(elem *list.Element) {
+	entry := c.ll.Remove(elem).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.size -= entrySize(entry.value)
+}
+
+// purge 清空缓存，merge 重写数据文件之后同一个位置上的数据可能已经改变
+func (c *valueCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	clear(c.items)
+	c.size = 0
+}
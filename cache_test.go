@@ -0,0 +1,114 @@
+package bitcask
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
+)
+
+func TestValueCache(t *testing.T) {
+	cache := newValueCache(3 * (cacheEntryOverhead + 10))
+	pos := func(i int) *data.LogRecordPos {
+		return &data.LogRecordPos{FileID: 1, Offset: int64(i * 100)}
+	}
+
+	value := []byte("0123456789")
+	for i := 0; i < 3; i++ {
+		cache.add(pos(i), value)
+	}
+	// 缓存的是拷贝
+	value[0] = 'x'
+	got, ok := cache.get(pos(0))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("0123456789"), got)
+	got[1] = 'x'
+
+	// 超出容量时淘汰最久没有访问的数据
+	cache.add(pos(3), []byte("0123456789"))
+	_, ok = cache.get(pos(1))
+	assert.False(t, ok)
+	got, ok = cache.get(pos(0))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("0123456789"), got)
+
+	// 超过容量的 value 不缓存
+	cache.add(pos(4), make([]byte, 1024))
+	_, ok = cache.get(pos(4))
+	assert.False(t, ok)
+
+	cache.remove(pos(0))
+	_, ok = cache.get(pos(0))
+	assert.False(t, ok)
+	assert.Equal(t, int64(2*(cacheEntryOverhead+10)), cache.size)
+
+	cache.purge()
+	_, ok = cache.get(pos(2))
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), cache.size)
+	assert.Equal(t, uint64(2), cache.hits.Load())
+	assert.Equal(t, uint64(4), cache.misses.Load())
+}
+
+func TestDB_ValueCache(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-value-cache")
+	db, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024), WithDBDataFileMergeRatio(0),
+		WithDBValueCacheSize(1<<20))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = randomValue(128)
+		assert.Nil(t, db.Put(getTestKey(i), values[i]))
+	}
+	for n := 0; n < 2; n++ {
+		val, err := db.Get(getTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, values[1], val)
+	}
+	stat := dbStat(t, db)
+	assert.Equal(t, uint64(1), stat.CacheHits)
+	assert.Equal(t, uint64(1), stat.CacheMisses)
+
+	// 覆盖和删除之后不会读到缓存中的旧数据
+	values[1] = randomValue(128)
+	assert.Nil(t, db.Put(getTestKey(1), values[1]))
+	val, err := db.Get(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, values[1], val)
+	assert.Nil(t, db.Delete(getTestKey(1)))
+	_, err = db.Get(getTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	delete(values, 1)
+
+	// merge 之后同一个位置上的数据已经改变
+	for i := 0; i < 1000; i++ {
+		if _, ok := values[i]; ok {
+			_, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+		}
+	}
+	for i := 0; i < 500; i += 2 {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+		delete(values, i)
+	}
+	assert.Nil(t, db.Merge())
+	for i, value := range values {
+		val, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	for i := 500; i < 700; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+		delete(values, i)
+	}
+	assert.Nil(t, db.Merge(WithMergeTopN(1)))
+	for i, value := range values {
+		val, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ysoding/bitcask"
+	"github.com/ysoding/bitcask/data"
+)
+
+// 退出码：0 没有发现问题，1 发现问题，2 检查失败
+const (
+	exitClean  = 0
+	exitIssues = 1
+	exitError  = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run 解析命令行参数并执行检查，返回退出码
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("bitcask-fsck", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("dir", "", "bitcask data directory to check")
+	repair := flags.Bool("repair", false, "salvage every readable record into a fresh directory")
+	out := flags.String("out", "", "destination directory for --repair (default <dir>-repaired)")
+	keyID := flags.String("key-id", "", "id of the encryption key, for encrypted directories")
+	keyHex := flags.String("key", "", "hex encoded encryption key, for encrypted directories")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+
+	if *dir == "" {
+		fmt.Fprintln(stderr, "usage: bitcask-fsck -dir <data dir> [-repair [-out <dir>]] [-key-id <id> -key <hex>]")
+		return exitError
+	}
+
+	var keys bitcask.KeyProvider
+	if *keyHex != "" {
+		key, err := hex.DecodeString(*keyHex)
+		if err != nil {
+			fmt.Fprintf(stderr, "invalid key: %v\n", err)
+			return exitError
+		}
+		keys = data.NewStaticKeyProvider(*keyID, map[string][]byte{*keyID: key})
+	}
+
+	dest := *out
+	if dest == "" {
+		dest = *dir + "-repaired"
+	}
+
+	var report *bitcask.FsckReport
+	var err error
+	if *repair {
+		report, err = bitcask.FsckRepair(*dir, dest, keys)
+	} else {
+		report, err = bitcask.Fsck(*dir, keys)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "fsck %s failed: %v\n", *dir, err)
+		return exitError
+	}
+
+	for _, issue := range report.Issues {
+		fmt.Fprintln(stdout, issue)
+	}
+	fmt.Fprintf(stdout, "checked %d files, %d readable records, %d issues\n", report.Files, report.Records, len(report.Issues))
+	if *repair {
+		fmt.Fprintf(stdout, "salvaged %d records into %s\n", report.SalvagedRecords, dest)
+	}
+
+	if len(report.Issues) > 0 {
+		return exitIssues
+	}
+	return exitClean
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask"
+	"github.com/ysoding/bitcask/data"
+)
+
+// writeFixture 写入 n 条数据并关闭数据库，返回数据目录
+func writeFixture(t *testing.T, n int) string {
+	dir := filepath.Join(t.TempDir(), "db")
+	db, err := bitcask.Open(bitcask.WithDBDirPath(dir))
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("key-%04d", i)), bytes.Repeat([]byte("v"), 64)))
+	}
+	assert.Nil(t, db.Close())
+	return dir
+}
+
+func TestRun_Clean(t *testing.T) {
+	dir := writeFixture(t, 100)
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, exitClean, run([]string{"-dir", dir}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "0 issues")
+	assert.Empty(t, stderr.String())
+}
+
+func TestRun_Corrupted(t *testing.T) {
+	dir := writeFixture(t, 100)
+
+	// 数据文件中间的记录损坏
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[len(content)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, exitIssues, run([]string{"-dir", dir}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "000000000.data@")
+	assert.Contains(t, stdout.String(), string(bitcask.FsckBadCRC))
+	assert.Contains(t, stdout.String(), string(bitcask.FsckUnreadableSegment))
+	assert.Contains(t, stdout.String(), "2 issues")
+
+	// 修复之后新目录中没有问题
+	out := filepath.Join(t.TempDir(), "repaired")
+	stdout.Reset()
+	assert.Equal(t, exitIssues, run([]string{"-dir", dir, "-repair", "-out", out}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "salvaged 99 records into "+out)
+
+	stdout.Reset()
+	assert.Equal(t, exitClean, run([]string{"-dir", out}, &stdout, &stderr))
+	assert.Empty(t, stderr.String())
+}
+
+func TestRun_Error(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, exitError, run(nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "usage:")
+
+	stderr.Reset()
+	assert.Equal(t, exitError, run([]string{"-dir", filepath.Join(t.TempDir(), "missing")}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "failed")
+
+	stderr.Reset()
+	assert.Equal(t, exitError, run([]string{"-dir", t.TempDir(), "-key", "zz"}, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "invalid key")
+
+	stderr.Reset()
+	assert.Equal(t, exitError, run([]string{"-unknown"}, &stdout, &stderr))
+	assert.Empty(t, stdout.String())
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ysoding/bitcask"
+)
+
+type cmdHandler func(db *bitcask.DB, w *bufio.Writer, args [][]byte)
+
+// command arity 表示包括命令名在内的参数个数，负数表示至少需要的参数个数
+// firstKey 和 lastKey 表示需要加锁的 key 在参数中的位置，lastKey 为 -1 表示一直到最后一个参数，
+// 先读取再写入的命令需要加锁，保证检查和写入之间 key 不会被其他连接修改
+type command struct {
+	arity    int
+	handler  cmdHandler
+	firstKey int
+	lastKey  int
+}
+
+var commands = map[string]command{
+	"ping":    {arity: -1, handler: ping},
+	"echo":    {arity: 2, handler: echo},
+	"select":  {arity: 2, handler: selectDB},
+	"command": {arity: -1, handler: commandCmd},
+	"get":     {arity: 2, handler: get},
+	"set":     {arity: -3, handler: set, firstKey: 1, lastKey: 1},
+	"del":     {arity: -2, handler: del, firstKey: 1, lastKey: -1},
+	"exists":  {arity: -2, handler: exists},
+	"keys":    {arity: 2, handler: keys},
+	"scan":    {arity: -2, handler: scan},
+	"ttl":     {arity: 2, handler: ttl},
+	"pttl":    {arity: 2, handler: pttl},
+	"expire":  {arity: 3, handler: expire, firstKey: 1, lastKey: 1},
+	"info":    {arity: -1, handler: info},
+}
+
+func ping(_ *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	if len(args) > 1 {
+		writeError(w, "ERR wrong number of arguments for 'ping' command")
+		return
+	}
+	if len(args) == 1 {
+		writeBulkString(w, args[0])
+		return
+	}
+	writeSimpleString(w, "PONG")
+}
+
+func echo(_ *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	writeBulkString(w, args[0])
+}
+
+// selectDB 只支持 0 号数据库
+func selectDB(_ *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	if string(args[0]) != "0" {
+		writeError(w, "ERR DB index is out of range")
+		return
+	}
+	writeSimpleString(w, "OK")
+}
+
+// commandCmd redis-cli 启动时会发送 COMMAND DOCS，返回空数组即可
+func commandCmd(_ *bitcask.DB, w *bufio.Writer, _ [][]byte) {
+	writeArrayHeader(w, 0)
+}
+
+func get(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	value, err := db.Get(args[0])
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			writeBulkString(w, nil)
+			return
+		}
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	writeBulkString(w, value)
+}
+
+// set SET key value [EX seconds | PX milliseconds] [NX | XX]
+func set(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	key, value := args[0], args[1]
+
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if i+1 >= len(args) || ttl != 0 {
+				writeError(w, "ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				writeError(w, "ERR value is not an integer or out of range")
+				return
+			}
+			unit := time.Millisecond
+			if strings.ToLower(string(args[i])) == "ex" {
+				unit = time.Second
+			}
+			var ok bool
+			ttl, ok = expireDuration(n, unit)
+			if n <= 0 || !ok {
+				writeError(w, "ERR invalid expire time in 'set' command")
+				return
+			}
+			i++
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+	if nx && xx {
+		writeError(w, "ERR syntax error")
+		return
+	}
+
+	if nx || xx {
+		_, err := db.Get(key)
+		if err != nil && err != bitcask.ErrKeyNotFound {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		exist := err == nil
+		if (nx && exist) || (xx && !exist) {
+			writeBulkString(w, nil)
+			return
+		}
+	}
+
+	var err error
+	if ttl > 0 {
+		err = db.PutWithTTL(key, value, ttl)
+	} else {
+		err = db.Put(key, value)
+	}
+	if err != nil {
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	writeSimpleString(w, "OK")
+}
+
+func del(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	var count int64
+	for _, key := range args {
+		if _, err := db.Get(key); err != nil {
+			continue
+		}
+		if err := db.Delete(key); err != nil {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		count++
+	}
+	writeInteger(w, count)
+}
+
+func exists(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	var count int64
+	for _, key := range args {
+		if _, err := db.Get(key); err == nil {
+			count++
+		}
+	}
+	writeInteger(w, count)
+}
+
+func keys(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	pattern := args[0]
+
+	iter, err := db.NewIterator(bitcask.WithIteratorPrefix(literalPrefix(pattern)))
+	if err != nil {
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	defer iter.Close()
+
+	var result [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if matchPattern(pattern, iter.Key()) {
+			result = append(result, iter.Key())
+		}
+	}
+	writeBulkStrings(w, result)
+}
+
+// scan SCAN cursor [MATCH pattern] [COUNT count]
+// cursor 是上一次返回的最后一个 key 的十六进制编码，从这个 key 之后继续遍历，0 表示开始或者遍历结束
+// 遍历期间一直存在的 key 都会被返回且只返回一次
+func scan(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	var cursor []byte
+	var err error
+	if string(args[0]) != "0" {
+		if cursor, err = hex.DecodeString(string(args[0])); err != nil || len(cursor) == 0 {
+			writeError(w, "ERR invalid cursor")
+			return
+		}
+	}
+
+	pattern := []byte("*")
+	count := 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			writeError(w, "ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				writeError(w, "ERR syntax error")
+				return
+			}
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	iter, err := db.NewIterator(bitcask.WithIteratorPrefix(literalPrefix(pattern)))
+	if err != nil {
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	defer iter.Close()
+
+	if cursor != nil {
+		iter.Seek(cursor)
+		if iter.Valid() && bytes.Equal(iter.Key(), cursor) {
+			iter.Next()
+		}
+	}
+
+	result := make([][]byte, 0)
+	var last []byte
+	for scanned := 0; iter.Valid() && scanned < count; iter.Next() {
+		if matchPattern(pattern, iter.Key()) {
+			result = append(result, iter.Key())
+		}
+		last = iter.Key()
+		scanned++
+	}
+
+	next := "0"
+	if iter.Valid() {
+		next = hex.EncodeToString(last)
+	}
+
+	writeArrayHeader(w, 2)
+	writeBulkString(w, []byte(next))
+	writeBulkStrings(w, result)
+}
+
+func ttl(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	writeTTL(db, w, args[0], time.Second)
+}
+
+func pttl(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	writeTTL(db, w, args[0], time.Millisecond)
+}
+
+// writeTTL key 不存在时返回 -2，没有设置过期时间时返回 -1
+func writeTTL(db *bitcask.DB, w *bufio.Writer, key []byte, unit time.Duration) {
+	remain, err := db.TTL(key)
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			writeInteger(w, -2)
+			return
+		}
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	if remain < 0 {
+		writeInteger(w, -1)
+		return
+	}
+	writeInteger(w, int64((remain+unit/2)/unit))
+}
+
+func expire(db *bitcask.DB, w *bufio.Writer, args [][]byte) {
+	seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		writeError(w, "ERR value is not an integer or out of range")
+		return
+	}
+
+	// 过期时间不是正数时直接删除 key
+	if seconds <= 0 {
+		if _, err := db.Get(args[0]); err != nil {
+			writeInteger(w, 0)
+			return
+		}
+		if err := db.Delete(args[0]); err != nil {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		writeInteger(w, 1)
+		return
+	}
+
+	ttl, ok := expireDuration(seconds, time.Second)
+	if !ok {
+		writeError(w, "ERR invalid expire time in 'expire' command")
+		return
+	}
+
+	if err := db.Expire(args[0], ttl); err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			writeInteger(w, 0)
+			return
+		}
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	writeInteger(w, 1)
+}
+
+// expireDuration 将 n 个 unit 换算成 time.Duration，换算或者加上当前时间之后溢出时返回 false
+func expireDuration(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > (math.MaxInt64-time.Now().UnixNano())/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func info(db *bitcask.DB, w *bufio.Writer, _ [][]byte) {
+	stat, err := db.Stat()
+	if err != nil {
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString("# Server\r\n")
+	sb.WriteString("redis_version:7.0.0\r\n")
+	sb.WriteString("redis_mode:standalone\r\n")
+	sb.WriteString("bitcask_engine:bitcask-go\r\n")
+	sb.WriteString("\r\n# Bitcask\r\n")
+	sb.WriteString(fmt.Sprintf("data_file_num:%d\r\n", stat.DataFileNum))
+	sb.WriteString(fmt.Sprintf("reclaimable_size:%d\r\n", stat.ReclaimableSize))
+	sb.WriteString(fmt.Sprintf("disk_size:%d\r\n", stat.DiskSize))
+	// 引擎没有统计设置了过期时间的 key 的数量，所以不返回 expires 和 avg_ttl
+	sb.WriteString("\r\n# Keyspace\r\n")
+	if stat.KeyNum > 0 {
+		sb.WriteString(fmt.Sprintf("db0:keys=%d\r\n", stat.KeyNum))
+	}
+	writeBulkString(w, []byte(sb.String()))
+}
+
+// literalPrefix 获取 glob 模式中第一个特殊字符之前的部分，用于缩小遍历的范围
+func literalPrefix(pattern []byte) []byte {
+	for i, c := range pattern {
+		switch c {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
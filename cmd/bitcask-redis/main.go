@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/ysoding/bitcask"
+)
+
+func main() {
+	addr := flag.String("addr", ":6379", "address to listen on")
+	dir := flag.String("dir", filepath.Join(os.TempDir(), "bitcask-redis"), "bitcask data directory")
+	flag.Parse()
+
+	db, err := bitcask.Open(bitcask.WithDBDirPath(*dir))
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		_ = db.Close()
+		log.Fatalf("failed to listen on %s: %v", *addr, err)
+	}
+
+	server := NewServer(db)
+
+	// 收到退出信号之后关闭服务和数据库
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		_ = server.Close()
+	}()
+
+	log.Printf("bitcask-redis is listening on %s, data dir %s\n", listener.Addr(), *dir)
+	if err := server.Serve(listener); err != nil && err != errServerClosed {
+		log.Printf("server stopped: %v\n", err)
+	}
+
+	if err := db.Close(); err != nil {
+		log.Fatalf("failed to close db: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/ysoding/bitcask"
+)
+
+var errServerClosed = errors.New("bitcask-redis: server closed")
+
+// keyLockShards key 锁的分片数，哈希到同一个分片的 key 共用一把锁
+const keyLockShards = 64
+
+// Server 基于 RESP 协议的服务端，将 Redis 命令映射到 bitcask.DB 上
+type Server struct {
+	db       *bitcask.DB
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	keyLocks [keyLockShards]sync.Mutex
+}
+
+func NewServer(db *bitcask.DB) *Server {
+	return &Server{
+		db:    db,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve 接收连接并为每个连接启动一个 goroutine 处理，直到 listener 被关闭
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return errServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return errServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handleConn(conn)
+	}
+}
+
+// Close 关闭 listener 以及所有的连接，并等待连接处理结束
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+		s.wg.Done()
+	}()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			if err == errProtocol {
+				writeError(writer, err.Error())
+				_ = writer.Flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("failed to read command from %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		quit := false
+		if len(args) > 0 {
+			quit = s.execute(writer, args)
+		}
+
+		// 客户端使用 pipeline 时，等缓冲区中的命令都处理完之后再统一返回
+		if reader.Buffered() == 0 || quit {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// execute 执行一条命令并写入返回结果，返回 true 表示需要关闭连接
+func (s *Server) execute(w *bufio.Writer, args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	if name == "quit" {
+		writeSimpleString(w, "OK")
+		return true
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		writeError(w, "ERR unknown command '"+string(args[0])+"'")
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		writeError(w, "ERR wrong number of arguments for '"+name+"' command")
+		return false
+	}
+
+	if cmd.firstKey > 0 {
+		lastKey := cmd.lastKey
+		if lastKey < 0 {
+			lastKey = len(args) - 1
+		}
+		unlock := s.lockKeys(args[cmd.firstKey : lastKey+1])
+		defer unlock()
+	}
+
+	cmd.handler(s.db, w, args[1:])
+	return false
+}
+
+// lockKeys 按分片的顺序对 key 加锁，避免多个 key 的命令之间出现死锁，返回解锁的函数
+func (s *Server) lockKeys(keys [][]byte) func() {
+	var shards [keyLockShards]bool
+	for _, key := range keys {
+		h := fnv.New32a()
+		_, _ = h.Write(key)
+		shards[h.Sum32()%keyLockShards] = true
+	}
+
+	for i := range shards {
+		if shards[i] {
+			s.keyLocks[i].Lock()
+		}
+	}
+	return func() {
+		for i := range shards {
+			if shards[i] {
+				s.keyLocks[i].Unlock()
+			}
+		}
+	}
+}
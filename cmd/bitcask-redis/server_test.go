@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask"
+)
+
+// testClient 一个最简单的 RESP 客户端
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testClient) send(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// receive 读取一个返回值，nil 表示空值，错误以 error 的形式返回
+func (c *testClient) receive() (interface{}, error) {
+	line, err := readLine(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("%s", line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, _ := strconv.Atoi(string(line[1:]))
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.receive(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *testClient) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.receive()
+}
+
+func startTestServer(t *testing.T) string {
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-server")
+	db, err := bitcask.Open(bitcask.WithDBDirPath(dir))
+	assert.Nil(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := NewServer(db)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.Serve(listener)
+	}()
+
+	t.Cleanup(func() {
+		_ = server.Close()
+		<-done
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return listener.Addr().String()
+}
+
+func TestServer_Commands(t *testing.T) {
+	client := newTestClient(t, startTestServer(t))
+
+	res, err := client.do("PING")
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", res)
+
+	res, err = client.do("SET", "name", "bitcask")
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", res)
+
+	res, err = client.do("GET", "name")
+	assert.Nil(t, err)
+	assert.Equal(t, "bitcask", res)
+
+	res, err = client.do("GET", "not-exist")
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+
+	res, err = client.do("SET", "name", "other", "NX")
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+
+	res, err = client.do("EXISTS", "name", "not-exist")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res)
+
+	// 过期时间
+	res, err = client.do("TTL", "name")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-1), res)
+	res, err = client.do("EXPIRE", "name", "100")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res)
+	res, err = client.do("TTL", "name")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), res)
+	res, err = client.do("TTL", "not-exist")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-2), res)
+
+	res, err = client.do("SET", "tmp", "value", "PX", "50")
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", res)
+	time.Sleep(time.Millisecond * 100)
+	res, err = client.do("GET", "tmp")
+	assert.Nil(t, err)
+	assert.Nil(t, res)
+
+	// 过期时间换算成 time.Duration 之后溢出
+	_, err = client.do("SET", "tmp", "value", "EX", "9223372037")
+	assert.ErrorContains(t, err, "ERR invalid expire time")
+	_, err = client.do("SET", "tmp", "value", "PX", "9223372036855")
+	assert.ErrorContains(t, err, "ERR invalid expire time")
+	_, err = client.do("SET", "tmp", "value", "EX", "9223372036")
+	assert.ErrorContains(t, err, "ERR invalid expire time")
+	res, err = client.do("SET", "tmp", "value", "PX", "1000000000000")
+	assert.Nil(t, err)
+	assert.Equal(t, "OK", res)
+	_, err = client.do("EXPIRE", "tmp", "9223372037")
+	assert.ErrorContains(t, err, "ERR invalid expire time")
+	res, err = client.do("TTL", "tmp")
+	assert.Nil(t, err)
+	assert.Greater(t, res, int64(0))
+	_, err = client.do("DEL", "tmp")
+	assert.Nil(t, err)
+
+	// KEYS 和 SCAN
+	for i := 0; i < 25; i++ {
+		_, err = client.do("SET", fmt.Sprintf("user:%02d", i), "v")
+		assert.Nil(t, err)
+	}
+	res, err = client.do("KEYS", "user:1?")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(res.([]interface{})))
+
+	// 遍历期间删除已经返回的 key，之后的 key 不会被跳过或者重复返回
+	scanned := make(map[string]int)
+	cursor := "0"
+	for {
+		res, err = client.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "7")
+		assert.Nil(t, err)
+		reply := res.([]interface{})
+		for _, key := range reply[1].([]interface{}) {
+			scanned[key.(string)]++
+		}
+		if cursor == "0" {
+			_, err = client.do("DEL", "user:01")
+			assert.Nil(t, err)
+		}
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, 25, len(scanned))
+	for _, n := range scanned {
+		assert.Equal(t, 1, n)
+	}
+
+	res, err = client.do("DEL", "name", "user:00", "not-exist")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res)
+
+	res, err = client.do("INFO")
+	assert.Nil(t, err)
+	assert.Contains(t, res, "db0:keys=")
+	assert.NotContains(t, res, "expires=")
+
+	// 错误处理
+	_, err = client.do("GET")
+	assert.NotNil(t, err)
+	_, err = client.do("UNKNOWN")
+	assert.NotNil(t, err)
+}
+
+func TestServer_Pipeline(t *testing.T) {
+	client := newTestClient(t, startTestServer(t))
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, client.send("SET", fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, client.send("GET", fmt.Sprintf("key-%d", i)))
+	}
+
+	for i := 0; i < 100; i++ {
+		res, err := client.receive()
+		assert.Nil(t, err)
+		assert.Equal(t, "OK", res)
+	}
+	for i := 0; i < 100; i++ {
+		res, err := client.receive()
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%d", i), res)
+	}
+}
+
+func TestServer_Concurrent(t *testing.T) {
+	addr := startTestServer(t)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := newTestClient(t, addr)
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key-%d-%d", i, j)
+				res, err := client.do("SET", key, key)
+				assert.Nil(t, err)
+				assert.Equal(t, "OK", res)
+
+				res, err = client.do("GET", key)
+				assert.Nil(t, err)
+				assert.Equal(t, key, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	client := newTestClient(t, addr)
+	res, err := client.do("KEYS", "*")
+	assert.Nil(t, err)
+	assert.Equal(t, 3200, len(res.([]interface{})))
+}
+
+func TestServer_ConcurrentNX(t *testing.T) {
+	addr := startTestServer(t)
+
+	clients := make([]*testClient, 16)
+	for i := range clients {
+		clients[i] = newTestClient(t, addr)
+	}
+
+	// 所有连接同时执行同一条命令，返回成功的连接数
+	race := func(args ...string) int64 {
+		var count atomic.Int64
+		start := make(chan struct{})
+		wg := new(sync.WaitGroup)
+		for _, client := range clients {
+			wg.Add(1)
+			go func(client *testClient) {
+				defer wg.Done()
+				<-start
+				res, err := client.do(args...)
+				assert.Nil(t, err)
+				switch res {
+				case "OK", int64(1):
+					count.Add(1)
+				}
+			}(client)
+		}
+		close(start)
+		wg.Wait()
+		return count.Load()
+	}
+
+	// 每个 key 只有一个连接能够 SET NX 成功，也只有一个连接能够 DEL 成功
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("lock-%d", i)
+		assert.Equal(t, int64(1), race("SET", key, "x", "NX"))
+		assert.Equal(t, int64(1), race("DEL", key))
+	}
+}
+
+func TestServer_Inline(t *testing.T) {
+	client := newTestClient(t, startTestServer(t))
+
+	_, err := client.conn.Write([]byte("PING\r\n"))
+	assert.Nil(t, err)
+	res, err := client.receive()
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", res)
+}
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*llo", "hello", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchPattern([]byte(c.pattern), []byte(c.key)), c.pattern+" "+c.key)
+	}
+}
@@ -0,0 +1,251 @@
+package bitcask
+
+import (
+	"errors"
+
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/index"
+)
+
+// commitRequest 一次等待组提交的写入
+type commitRequest struct {
+	records    []*data.LogRecord
+	apply      func(positions []*data.LogRecordPos) error // 写入并持久化之后更新索引，由组长调用
+	concurrent bool                                       // apply 是否可以在释放 db 的锁之后与其他写入并行执行
+	err        error
+	leader     bool          // 被唤醒时成为新的组长，负责提交之后排队的写入
+	done       chan struct{} // 提交完成或者成为组长时关闭
+}
+
+// commit 写入 records，然后调用 apply 更新索引
+// concurrent 为 true 并且索引支持并行更新时，只有追加数据文件需要持有 db 的锁，apply 与其他写入的索引更新并行执行，
+// 否则在持有 db 的锁并且等待并行的索引更新完成之后调用 apply
+// 开启同步写入时使用组提交，并发写入的记录由组长一次写入到活跃文件中并只 Sync 一次
+func (db *DB) commit(records []*data.LogRecord, concurrent bool, apply func(positions []*data.LogRecordPos) error) error {
+	if _, ok := db.indexer.(index.ConcurrentIndexer); !ok {
+		concurrent = false
+	}
+
+	if !db.syncWrite || !db.groupCommit {
+		db.mu.Lock()
+		fileID, offset := db.writePosition()
+		positions := make([]*data.LogRecordPos, len(records))
+		for i, record := range records {
+			pos, err := db.appendLogRecord(record)
+			if err != nil {
+				if rollbackErr := db.rollbackLogRecords(fileID, offset); rollbackErr != nil {
+					err = errors.Join(err, rollbackErr)
+				}
+				db.mu.Unlock()
+				return err
+			}
+			positions[i] = pos
+		}
+		return db.unlockAndApply(concurrent, func() error {
+			return apply(positions)
+		})
+	}
+
+	req := &commitRequest{records: records, apply: apply, concurrent: concurrent, done: make(chan struct{})}
+	db.commitMu.Lock()
+	db.commitQueue = append(db.commitQueue, req)
+	if db.committing {
+		// 已经有组长，等待组长提交或者将组长交给自己
+		db.commitMu.Unlock()
+		<-req.done
+		if !req.leader {
+			return req.err
+		}
+		db.commitMu.Lock()
+	}
+	db.committing = true
+	group := db.commitQueue
+	db.commitQueue = nil
+	db.commitMu.Unlock()
+
+	db.commitGroup(group)
+
+	// 提交期间排队的写入由队列中的第一个组长负责，当前的调用者可以直接返回
+	db.commitMu.Lock()
+	if len(db.commitQueue) > 0 {
+		next := db.commitQueue[0]
+		next.leader = true
+		close(next.done)
+	} else {
+		db.committing = false
+	}
+	db.commitMu.Unlock()
+
+	for _, r := range group {
+		if r != req {
+			close(r.done)
+		}
+	}
+	return req.err
+}
+
+// commitGroup 一次写入一组记录并持久化，然后按照写入的顺序更新索引，任何一步失败时整组返回相同的错误
+// 写入或者持久化失败时丢弃这一组已经写入的记录，否则重启之后会加载这些返回了错误的记录
+func (db *DB) commitGroup(group []*commitRequest) {
+	db.mu.Lock()
+	fileID, offset := db.writePosition()
+
+	var records []*data.LogRecord
+	for _, r := range group {
+		records = append(records, r.records...)
+	}
+
+	positions, err := db.appendLogRecords(records)
+	if err == nil {
+		err = db.activeFile.Sync()
+		db.bytesWrite = 0
+	}
+	if err != nil {
+		if rollbackErr := db.rollbackLogRecords(fileID, offset); rollbackErr != nil {
+			err = errors.Join(err, rollbackErr)
+		}
+		db.mu.Unlock()
+		for _, r := range group {
+			r.err = err
+		}
+		return
+	}
+
+	// 整组都可以并行更新索引时，下一组写入不需要等待这一组更新完索引
+	concurrent := true
+	for _, r := range group {
+		concurrent = concurrent && r.concurrent
+	}
+	_ = db.unlockAndApply(concurrent, func() error {
+		for _, r := range group {
+			r.err = r.apply(positions[:len(r.records)])
+			positions = positions[len(r.records):]
+		}
+		return nil
+	})
+}
+
+// writePosition 下一条记录写入的位置，还没有活跃文件时为第一个数据文件的起点，需要持有 db 的锁
+func (db *DB) writePosition() (uint32, int64) {
+	if db.activeFile == nil {
+		return 0, 0
+	}
+	return db.activeFile.FileID, db.activeFile.WriteOffset
+}
+
+// rollbackLogRecords 丢弃从 fileID 文件的 offset 处开始追加的数据，写入期间切换过活跃文件时，之后的数据文件全部清空
+// 需要持有 db 的锁
+func (db *DB) rollbackLogRecords(fileID uint32, offset int64) error {
+	if db.activeFile == nil {
+		return nil
+	}
+	var err error
+	for fid := fileID; fid <= db.activeFile.FileID; fid++ {
+		dataFile := db.oldFiles[fid]
+		if fid == db.activeFile.FileID {
+			dataFile = db.activeFile
+		}
+		if fid > fileID {
+			offset = 0
+		}
+		if dataFile == nil || dataFile.WriteOffset <= offset {
+			continue
+		}
+		if truncErr := dataFile.Truncate(offset); truncErr != nil && err == nil {
+			err = truncErr
+		}
+	}
+	return err
+}
+
+// unlockAndApply 在持有 db 的锁的情况下调用，执行 apply 并释放 db 的锁
+// concurrent 为 true 时先释放 db 的锁再执行，执行期间持有 applyMu 的读锁，否则等待并行的索引更新完成之后执行
+func (db *DB) unlockAndApply(concurrent bool, apply func() error) error {
+	if concurrent {
+		db.applyMu.RLock()
+		db.mu.Unlock()
+		defer db.applyMu.RUnlock()
+		return apply()
+	}
+
+	db.applyMu.Lock()
+	defer db.unlock()
+	return apply()
+}
+
+// lock 获取 db 的锁，并等待释放 db 的锁之后并行执行的索引更新完成，读写完整的索引以及无效数据统计之前需要调用
+func (db *DB) lock() {
+	db.mu.Lock()
+	db.applyMu.Lock()
+}
+
+func (db *DB) unlock() {
+	db.applyMu.Unlock()
+	db.mu.Unlock()
+}
+
+// appendLogRecords 追加写入多条记录，不加密时同一个数据文件中的记录合并为一次写入，不会 Sync
+// 需要持有 db 的锁
+func (db *DB) appendLogRecords(records []*data.LogRecord) ([]*data.LogRecordPos, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	if db.activeFile == nil {
+		if err := db.updateActiveDataFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf []byte
+	flush := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		if err := db.activeFile.Write(buf); err != nil {
+			return err
+		}
+		db.bytesWrite += uint64(len(buf))
+		buf = buf[:0]
+		return nil
+	}
+
+	positions := make([]*data.LogRecordPos, 0, len(records))
+	for _, record := range records {
+		encodedRecord, size := db.encodeLogRecord(record)
+		if db.activeFile.WriteOffset+int64(len(buf))+db.activeFile.EncodedSize(size) > db.dataFileSize {
+			// 当前file大小不够，写入之前的记录之后创建新的文件
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			if err := db.sealActiveFile(); err != nil {
+				return nil, err
+			}
+			if err := db.updateActiveDataFile(); err != nil {
+				return nil, err
+			}
+		}
+
+		// 加密时每条记录需要单独加密写入
+		offset := db.activeFile.WriteOffset + int64(len(buf))
+		if db.activeFile.Encrypted() {
+			if err := db.activeFile.Write(encodedRecord); err != nil {
+				return nil, err
+			}
+			size = db.activeFile.WriteOffset - offset
+			db.bytesWrite += uint64(size)
+		} else {
+			buf = append(buf, encodedRecord...)
+		}
+		positions = append(positions, &data.LogRecordPos{
+			FileID: db.activeFile.FileID,
+			Offset: offset,
+			Size:   uint32(size),
+			Expire: record.Expire,
+		})
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
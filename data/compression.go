@@ -0,0 +1,75 @@
+package data
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionType value 的压缩算法，记录在每条 LogRecord 的 type 字节中
+type CompressionType byte
+
+const (
+	NoCompression CompressionType = iota
+	SnappyCompression
+	ZstdCompression
+)
+
+var (
+	ErrUnknownCompression = errors.New("unknown compression type")
+)
+
+// zstd 的编码器和解码器创建成本较高，全局共享，EncodeAll/DecodeAll 可以并发调用
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		encoder, _ := zstd.NewWriter(nil)
+		return encoder
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		decoder, _ := zstd.NewReader(nil)
+		return decoder
+	})
+)
+
+// IsValid 是否是支持的压缩算法
+func (c CompressionType) IsValid() bool {
+	return c <= ZstdCompression
+}
+
+// compressValue 压缩 value，value 小于 minSize 或者压缩之后没有变小时返回原始数据
+func compressValue(value []byte, compression CompressionType, minSize int) ([]byte, CompressionType) {
+	if compression == NoCompression || len(value) == 0 || len(value) < minSize {
+		return value, NoCompression
+	}
+
+	var compressed []byte
+	switch compression {
+	case SnappyCompression:
+		compressed = snappy.Encode(nil, value)
+	case ZstdCompression:
+		compressed = zstdEncoder().EncodeAll(value, nil)
+	default:
+		return value, NoCompression
+	}
+
+	if len(compressed) >= len(value) {
+		return value, NoCompression
+	}
+	return compressed, compression
+}
+
+// decompressValue 解压 value
+func decompressValue(value []byte, compression CompressionType) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return value, nil
+	case SnappyCompression:
+		return snappy.Decode(nil, value)
+	case ZstdCompression:
+		return zstdDecoder().DecodeAll(value, nil)
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
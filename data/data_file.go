@@ -1,73 +1,180 @@
 package data
 
 import (
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"path/filepath"
+	"time"
 
 	"github.com/ysoding/bitcask/fio"
 )
 
 const (
 	DataFileNameSuffix    = ".data"
+	DataHintFileSuffix    = ".hint"
 	HintFileName          = "hint-index"
 	MergeFinishedFileName = "merge-finished"
 	SeqNoFileName         = "seq-no"
+	IndexSnapshotFileName = "index-snapshot"
+	IndexSnapshotTempName = "index-snapshot.tmp"
 )
 
 var (
-	ErrInvalidCRC = errors.New("invalid crc value, log record maybe corrupted")
+	ErrInvalidCRC          = errors.New("invalid crc value, log record maybe corrupted")
+	ErrInvalidRecordHeader = errors.New("invalid log record header, bad varint encoding")
 )
 
+// DataFile 数据文件，offset 和 WriteOffset 都不包含文件开头的头部
 type DataFile struct {
 	FileID      uint32
 	WriteOffset int64
 	IoManager   fio.IOManager
-}
 
-func OpenDataFile(dbPath string, fileID uint32, ioType fio.IOType) (*DataFile, error) {
-	return newDataFile(GetDataFileName(dbPath, fileID), fileID, ioType)
+	header        *fileHeader
+	headerSize    int64
+	headerPending bool        // 以只读方式打开的空文件，头部在第一次写入时一起写到文件中
+	aead          cipher.AEAD // 为空表示文件没有加密
 }
 
-// OpenSeqNoFile 存储事务序列号的文件
-func OpenSeqNoFile(dirPath string) (*DataFile, error) {
-	fileName := filepath.Join(dirPath, SeqNoFileName)
-	return newDataFile(fileName, 0, fio.StandardFileIO)
+// OpenDataFile 通过 fileSystem 打开数据文件，keys 为空表示不加密，此时依然可以读取未加密的文件
+func OpenDataFile(fileSystem fio.FileSystem, dbPath string, fileID uint32, ioType fio.IOType, keys KeyProvider) (*DataFile, error) {
+	return newDataFile(fileSystem, GetDataFileName(dbPath, fileID), fileID, ioType, keys)
 }
 
-// OpenHintFile 打开 Hint 索引文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+// OpenHintFile 通过 fileSystem 打开 Hint 索引文件
+func OpenHintFile(fileSystem fio.FileSystem, dirPath string, keys KeyProvider) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
-	return newDataFile(fileName, 0, fio.StandardFileIO)
-}
-
-// OpenMergeFinishedFile 打开标识 merge 完成的文件
-func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
-	fileName := filepath.Join(dirPath, MergeFinishedFileName)
-	return newDataFile(fileName, 0, fio.StandardFileIO)
+	return newDataFile(fileSystem, fileName, 0, fio.StandardFileIO, keys)
 }
 
-func newDataFile(fileName string, fileID uint32, ioType fio.IOType) (*DataFile, error) {
-	ioManager, err := fio.NewIOManager(ioType, fileName)
+func newDataFile(fileSystem fio.FileSystem, fileName string, fileID uint32, ioType fio.IOType, keys KeyProvider) (*DataFile, error) {
+	ioManager, err := fileSystem.OpenFile(fileName, ioType)
 	if err != nil {
 		return nil, err
 	}
+	return NewDataFile(ioManager, fileID, ioType, keys)
+}
 
-	return &DataFile{
+// NewDataFile 使用已经打开的 IOManager 创建数据文件，用于自定义的 FileSystem，ioType 为打开文件时使用的类型
+// 创建失败时会关闭 ioManager
+func NewDataFile(ioManager fio.IOManager, fileID uint32, ioType fio.IOType, keys KeyProvider) (*DataFile, error) {
+	dataFile := &DataFile{
 		FileID:      fileID,
 		WriteOffset: 0,
 		IoManager:   ioManager,
-	}, nil
+	}
+	if err := dataFile.initHeader(ioType, keys); err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+	return dataFile, nil
+}
+
+// initHeader 新文件写入头部，新文件使用当前的密钥加密，已有的文件校验头部并根据其中的 key id 选择密钥
+func (d *DataFile) initHeader(ioType fio.IOType, keys KeyProvider) error {
+	size, err := d.IoManager.Size()
+	if err != nil {
+		return err
+	}
+
+	var key []byte
+	if size == 0 {
+		keyID := ""
+		if keys != nil {
+			if keyID, key, err = keys.CurrentKey(); err != nil {
+				return err
+			}
+			if keyID == "" || len(keyID) > maxKeyIDLen {
+				return ErrInvalidKeyID
+			}
+		}
+		d.header = newFileHeader(keyID)
+		d.headerSize = int64(len(d.header.encode()))
+		d.headerPending = true
+		// 只读的 MMap 不支持写入，头部等到第一次写入时再写
+		// 可写的 MMap 会预先分配文件空间，头部需要立即写入，否则崩溃之后文件开头全是 0 无法识别
+		if ioType == fio.StandardFileIO || ioType == fio.ReadWriteMemoryMap {
+			if err := d.writeHeader(); err != nil {
+				return err
+			}
+		}
+	} else {
+		if d.header, d.headerSize, err = readFileHeader(d.IoManager); err != nil {
+			return err
+		}
+		if d.header.flags&fileFlagEncrypted == 0 {
+			return nil
+		}
+		if keys == nil {
+			return ErrMissingKeyProvider
+		}
+		if key, err = keys.Key(d.header.keyID); err != nil {
+			return err
+		}
+	}
+
+	if key == nil {
+		return nil
+	}
+	d.aead, err = newAEAD(key)
+	return err
+}
+
+func (d *DataFile) writeHeader() error {
+	if n, err := d.IoManager.Write(d.header.encode()); err != nil {
+		if n > 0 {
+			_ = d.IoManager.Truncate(0)
+		}
+		return err
+	}
+	d.headerPending = false
+	return nil
+}
+
+// Encrypted 文件是否加密
+func (d *DataFile) Encrypted() bool {
+	return d.aead != nil
+}
+
+// KeyID 加密文件使用的密钥 id
+func (d *DataFile) KeyID() string {
+	return d.header.keyID
+}
+
+// CreatedAt 文件的创建时间
+func (d *DataFile) CreatedAt() time.Time {
+	return time.Unix(0, d.header.createdAt)
+}
+
+// Size 文件中数据的长度，不包含头部
+func (d *DataFile) Size() (int64, error) {
+	if d.headerPending {
+		return 0, nil
+	}
+	size, err := d.IoManager.Size()
+	if err != nil {
+		return 0, err
+	}
+	return size - d.headerSize, nil
 }
 
 // ReadLogRecord 从数据文件中读取offset的LogRecord
+// 记录不完整时返回 io.ErrUnexpectedEOF，记录损坏时返回 ErrInvalidCRC 或者 ErrInvalidRecordHeader，并尽量返回记录的长度
 func (d *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
-	fileSize, err := d.IoManager.Size()
+	fileSize, err := d.Size()
 	if err != nil {
 		return nil, 0, err
 	}
+	if offset >= fileSize {
+		return nil, 0, io.EOF
+	}
+	if d.aead != nil {
+		return d.readSealedLogRecord(offset, fileSize)
+	}
 
 	// 如果读取的最大 header 长度已经超过了文件的长度，则只需要读取到文件的末尾即可
 	headerBytes := int64(maxLogRecordHeaderSize)
@@ -82,10 +189,14 @@ func (d *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	}
 
 	header, headerSize := decodeLogRecordHeader(headerBuf)
-	// 下面的两个条件表示读取到了文件末尾，直接返回 EOF 错误
+	// 文件末尾不足一个完整的 header，说明最后一条记录没有写完
 	if header == nil {
-		return nil, 0, io.EOF
+		if headerBytes < maxLogRecordHeaderSize {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return nil, 0, ErrInvalidRecordHeader
 	}
+	// 读取到了文件末尾，直接返回 EOF 错误
 	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
 		return nil, 0, io.EOF
 	}
@@ -93,8 +204,11 @@ func (d *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	keySize := int64(header.keySize)
 	valueSize := int64(header.valueSize)
 	recordSize := headerSize + keySize + valueSize
+	if offset+recordSize > fileSize {
+		return nil, recordSize, io.ErrUnexpectedEOF
+	}
 
-	logRecord := &LogRecord{Type: header.recordType}
+	logRecord := &LogRecord{Type: header.recordType, Expire: header.expire}
 	if keySize > 0 || valueSize > 0 {
 		keyBuf, err := d.readNBytes(keySize+valueSize, offset+headerSize)
 		if err != nil {
@@ -105,21 +219,123 @@ func (d *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		logRecord.Value = keyBuf[keySize:]
 	}
 
-	// 校验数据的有效性
-	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
-	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+	if err := verifyLogRecord(logRecord, header, headerBuf[:headerSize]); err != nil {
+		return nil, recordSize, err
 	}
 	return logRecord, recordSize, nil
 
 }
 
+// readSealedLogRecord 读取并解密一条记录，返回的长度为记录在文件中的长度
+func (d *DataFile) readSealedLogRecord(offset int64, fileSize int64) (*LogRecord, int64, error) {
+	if offset+sealedLengthSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	lengthBuf, err := d.readNBytes(sealedLengthSize, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	sealedSize := int64(binary.LittleEndian.Uint32(lengthBuf))
+	if sealedSize == 0 {
+		return nil, 0, io.EOF
+	}
+
+	recordSize := sealedLengthSize + sealedSize
+	if offset+recordSize > fileSize {
+		return nil, recordSize, io.ErrUnexpectedEOF
+	}
+
+	sealed, err := d.readNBytes(sealedSize, offset+sealedLengthSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	encRecord, err := openLogRecord(d.aead, sealed, offset)
+	if err != nil {
+		return nil, recordSize, err
+	}
+
+	header, headerSize := decodeLogRecordHeader(encRecord)
+	if header == nil || headerSize+int64(header.keySize)+int64(header.valueSize) != int64(len(encRecord)) {
+		return nil, recordSize, ErrInvalidRecordHeader
+	}
+	keySize := int64(header.keySize)
+	logRecord := &LogRecord{
+		Key:    encRecord[headerSize : headerSize+keySize],
+		Value:  encRecord[headerSize+keySize:],
+		Type:   header.recordType,
+		Expire: header.expire,
+	}
+	if err := verifyLogRecord(logRecord, header, encRecord[:headerSize]); err != nil {
+		return nil, recordSize, err
+	}
+	return logRecord, recordSize, nil
+}
+
+// verifyLogRecord 校验数据的有效性，crc 针对磁盘上的数据计算，校验之后再解压
+func verifyLogRecord(logRecord *LogRecord, header *logRecordHeader, headerBuf []byte) error {
+	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:])
+	if crc != header.crc {
+		return ErrInvalidCRC
+	}
+
+	if header.compression != NoCompression {
+		value, err := decompressValue(logRecord.Value, header.compression)
+		if err != nil {
+			return err
+		}
+		logRecord.Value = value
+	}
+	return nil
+}
+
 func (d *DataFile) readNBytes(n int64, offset int64) ([]byte, error) {
 	buf := make([]byte, n)
-	_, err := d.IoManager.ReadAt(buf, offset)
+	_, err := d.IoManager.ReadAt(buf, d.headerSize+offset)
 	return buf, err
 }
 
+// Preallocate 预先分配能够写入 size 长度数据的文件空间，IOManager 不支持时忽略
+func (d *DataFile) Preallocate(size int64) error {
+	if p, ok := d.IoManager.(fio.Preallocator); ok {
+		return p.Preallocate(d.headerSize + size)
+	}
+	return nil
+}
+
+// ZeroFrom offset 之后的数据是否全部为 0，可写 MMap 预先分配的空间在崩溃之后会以 0 的形式留在文件末尾
+func (d *DataFile) ZeroFrom(offset int64) (bool, error) {
+	size, err := d.Size()
+	if err != nil {
+		return false, err
+	}
+	end, err := d.SkipZeros(offset)
+	if err != nil {
+		return false, err
+	}
+	return end >= size, nil
+}
+
+// SkipZeros 返回 offset 之后第一个不为 0 的字节的位置，之后全部为 0 时返回文件的长度
+func (d *DataFile) SkipZeros(offset int64) (int64, error) {
+	size, err := d.Size()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 64*1024)
+	for ; offset < size; offset += int64(len(buf)) {
+		n := min(int64(len(buf)), size-offset)
+		if _, err := d.IoManager.ReadAt(buf[:n], d.headerSize+offset); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i, b := range buf[:n] {
+			if b != 0 {
+				return offset + int64(i), nil
+			}
+		}
+	}
+	return size, nil
+}
+
 func (d *DataFile) Sync() error {
 	return d.IoManager.Sync()
 }
@@ -132,15 +348,54 @@ func GetDataFileName(dbPath string, fileID uint32) string {
 	return filepath.Join(dbPath, fmt.Sprintf("%09d%s", fileID, DataFileNameSuffix))
 }
 
+func GetDataHintFileName(dbPath string, fileID uint32) string {
+	return filepath.Join(dbPath, fmt.Sprintf("%09d%s", fileID, DataHintFileSuffix))
+}
+
+// Write 写入一条编码之后的 LogRecord，加密文件中每次写入的数据单独加密
 func (d *DataFile) Write(buf []byte) error {
+	if d.headerPending {
+		if err := d.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if d.aead != nil {
+		sealed, err := sealLogRecord(d.aead, buf, d.WriteOffset)
+		if err != nil {
+			return err
+		}
+		buf = sealed
+	}
+
 	n, err := d.IoManager.Write(buf)
 	if err != nil {
+		// 丢弃写入了一部分的数据，否则之后写入的记录位置和 WriteOffset 不一致
+		if n > 0 {
+			_ = d.IoManager.Truncate(d.headerSize + d.WriteOffset)
+		}
 		return err
 	}
 	d.WriteOffset += int64(n)
 	return nil
 }
 
+// Truncate 将文件截断到 offset 处，之后的数据被丢弃
+func (d *DataFile) Truncate(offset int64) error {
+	if err := d.IoManager.Truncate(d.headerSize + offset); err != nil {
+		return err
+	}
+	d.WriteOffset = offset
+	return nil
+}
+
+// EncodedSize 编码之后长度为 n 的记录写入到文件中之后的长度
+func (d *DataFile) EncodedSize(n int64) int64 {
+	if d.aead == nil {
+		return n
+	}
+	return sealedLengthSize + int64(d.aead.NonceSize()) + n + int64(d.aead.Overhead())
+}
+
 // WriteHintRecord 写入索引信息到 hint 文件中
 func (d *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	record := &LogRecord{Key: key, Value: EncodeLogRecordPos(pos)}
@@ -148,13 +403,10 @@ func (d *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	return d.Write(encRecord)
 }
 
-func (d *DataFile) SetIOManager(dirPath string, ioType fio.IOType) error {
+// SetIOManager 替换文件的 IOManager，ioManager 需要打开的是同一个文件，原来的 IOManager 会被关闭
+func (d *DataFile) SetIOManager(ioManager fio.IOManager) error {
 	if err := d.IoManager.Close(); err != nil {
-		return err
-	}
-
-	ioManager, err := fio.NewIOManager(ioType, GetDataFileName(dirPath, d.FileID))
-	if err != nil {
+		_ = ioManager.Close()
 		return err
 	}
 
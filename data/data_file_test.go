@@ -1,6 +1,8 @@
 package data
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"testing"
 
@@ -9,7 +11,169 @@ import (
 )
 
 func TestOpenDataFile(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 0, fio.StandardFileIO)
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, os.TempDir(), 0, fio.StandardFileIO, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 }
+
+func TestDataFile_ReadLogRecord_Compression(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-file")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = dataFile.Close()
+	}()
+
+	// 同一个文件中混合写入压缩和未压缩的数据
+	value := bytes.Repeat([]byte("bitcask-go"), 100)
+	records := []*LogRecord{
+		{Key: []byte("raw"), Value: value},
+		{Key: []byte("snappy"), Value: value},
+		{Key: []byte("zstd"), Value: value, Expire: 1700000000000000000},
+		{Key: []byte("deleted"), Type: LogRecordDeleted},
+	}
+	compressions := []CompressionType{NoCompression, SnappyCompression, ZstdCompression, ZstdCompression}
+	var offsets []int64
+	for i, record := range records {
+		encRecord, _ := EncodeLogRecordWithCompression(record, compressions[i], 64)
+		offsets = append(offsets, dataFile.WriteOffset)
+		assert.Nil(t, dataFile.Write(encRecord))
+	}
+
+	for i, record := range records {
+		res, size, err := dataFile.ReadLogRecord(offsets[i])
+		assert.Nil(t, err)
+		assert.Equal(t, record.Key, res.Key)
+		assert.Equal(t, len(record.Value), len(res.Value))
+		assert.Equal(t, record.Type, res.Type)
+		assert.Equal(t, record.Expire, res.Expire)
+		if i+1 < len(offsets) {
+			assert.Equal(t, offsets[i+1]-offsets[i], size)
+		}
+	}
+	_, _, err = dataFile.ReadLogRecord(dataFile.WriteOffset)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDataFile_Encryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-file")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	keys := NewStaticKeyProvider("k1", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 16),
+	})
+
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, keys)
+	assert.Nil(t, err)
+	assert.True(t, dataFile.Encrypted())
+	assert.Equal(t, "k1", dataFile.KeyID())
+
+	records := []*LogRecord{
+		{Key: []byte("name"), Value: []byte("bitcask-go")},
+		{Key: []byte("compressed"), Value: bytes.Repeat([]byte("bitcask-go"), 100)},
+		{Key: []byte("deleted"), Type: LogRecordDeleted},
+	}
+	var offsets []int64
+	for _, record := range records {
+		encRecord, n := EncodeLogRecordWithCompression(record, ZstdCompression, 64)
+		offset := dataFile.WriteOffset
+		offsets = append(offsets, offset)
+		assert.Nil(t, dataFile.Write(encRecord))
+		assert.Equal(t, dataFile.EncodedSize(n), dataFile.WriteOffset-offset)
+	}
+	size, err := dataFile.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, dataFile.WriteOffset, size)
+	assert.Nil(t, dataFile.Close())
+
+	// 磁盘上没有明文数据
+	raw, err := os.ReadFile(GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("bitcask-go")))
+
+	// 切换当前密钥之后依然使用文件头部中记录的密钥解密
+	keys = NewStaticKeyProvider("k2", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 16),
+	})
+	dataFile, err = OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, keys)
+	assert.Nil(t, err)
+	assert.Equal(t, "k1", dataFile.KeyID())
+	offset := int64(0)
+	for i, record := range records {
+		assert.Equal(t, offsets[i], offset)
+		res, n, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, record.Key, res.Key)
+		assert.Equal(t, len(record.Value), len(res.Value))
+		assert.Equal(t, record.Type, res.Type)
+		offset += n
+	}
+	_, _, err = dataFile.ReadLogRecord(offset)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, dataFile.Close())
+
+	// 没有密钥或者密钥错误
+	_, err = OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, nil)
+	assert.Equal(t, ErrMissingKeyProvider, err)
+	dataFile, err = OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, NewStaticKeyProvider("k1", map[string][]byte{
+		"k1": bytes.Repeat([]byte{3}, 32),
+	}))
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Equal(t, ErrDecryptFailed, err)
+	assert.Nil(t, dataFile.Close())
+
+	// 未加密的文件在开启加密之后依然可以读取
+	plainFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 1, fio.StandardFileIO, nil)
+	assert.Nil(t, err)
+	encRecord, _ := EncodeLogRecord(records[0])
+	assert.Nil(t, plainFile.Write(encRecord))
+	assert.Nil(t, plainFile.Close())
+	plainFile, err = OpenDataFile(fio.OSFileSystem{}, dir, 1, fio.StandardFileIO, keys)
+	assert.Nil(t, err)
+	assert.False(t, plainFile.Encrypted())
+	res, _, err := plainFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, records[0].Value, res.Value)
+	assert.Nil(t, plainFile.Close())
+}
+
+func TestDataFile_ReadLogRecord_Partial(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-file")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, nil)
+	assert.Nil(t, err)
+	defer func() {
+		_ = dataFile.Close()
+	}()
+
+	encRecord, size := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: bytes.Repeat([]byte("bitcask-go"), 10)})
+	assert.Nil(t, dataFile.Write(encRecord))
+
+	// 只写入了一部分 header
+	assert.Nil(t, dataFile.Write(encRecord[:3]))
+	_, _, err = dataFile.ReadLogRecord(size)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// header 完整但是数据不完整
+	assert.Nil(t, dataFile.Truncate(size))
+	assert.Nil(t, dataFile.Write(encRecord[:len(encRecord)-1]))
+	_, n, err := dataFile.ReadLogRecord(size)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, size, n)
+
+	// 截断之后恢复正常
+	assert.Nil(t, dataFile.Truncate(size))
+	_, _, err = dataFile.ReadLogRecord(size)
+	assert.Equal(t, io.EOF, err)
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+}
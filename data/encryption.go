@@ -0,0 +1,98 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMissingKeyProvider = errors.New("file is encrypted but no key provider is configured")
+	ErrDecryptFailed      = errors.New("failed to decrypt log record, wrong key or data corrupted")
+	ErrInvalidKeyID       = errors.New("invalid encryption key id")
+)
+
+// KeyProvider 提供加密使用的密钥，密钥长度为 16、24 或 32 字节，对应 AES-128、AES-192、AES-256
+type KeyProvider interface {
+	// CurrentKey 返回加密新文件使用的密钥以及它的 id
+	CurrentKey() (keyID string, key []byte, err error)
+	// Key 根据 id 返回密钥，用于解密使用旧密钥加密的文件
+	Key(keyID string) ([]byte, error)
+}
+
+// staticKeyProvider 密钥保存在内存中的 KeyProvider
+type staticKeyProvider struct {
+	currentKeyID string
+	keys         map[string][]byte
+}
+
+// NewStaticKeyProvider 使用固定的密钥集合创建 KeyProvider，currentKeyID 为加密新文件使用的密钥
+// 轮换密钥时把新的密钥加入 keys 并修改 currentKeyID，旧的密钥需要保留到所有旧文件被 merge 重写之后
+func NewStaticKeyProvider(currentKeyID string, keys map[string][]byte) KeyProvider {
+	return &staticKeyProvider{currentKeyID: currentKeyID, keys: keys}
+}
+
+func (p *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.currentKeyID)
+	return p.currentKeyID, key, err
+}
+
+func (p *staticKeyProvider) Key(keyID string) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q not found", keyID)
+	}
+	return key, nil
+}
+
+// 加密之后的每条记录
+//
+//	+-------------+-------------+-----------------------------+
+//	|  密文长度    |    nonce    |  LogRecord 编码之后的密文     |
+//	+-------------+-------------+-----------------------------+
+//	    4字节          12字节               变长
+//
+// 记录在文件中的位置作为附加数据参与认证，防止记录被挪动位置
+const sealedLengthSize = 4
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealLogRecord 加密编码之后的 LogRecord，offset 为记录在文件中的位置
+func sealLogRecord(aead cipher.AEAD, encRecord []byte, offset int64) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	sealedSize := nonceSize + len(encRecord) + aead.Overhead()
+	buf := make([]byte, sealedLengthSize+nonceSize, sealedLengthSize+sealedSize)
+	binary.LittleEndian.PutUint32(buf[:sealedLengthSize], uint32(sealedSize))
+	if _, err := rand.Read(buf[sealedLengthSize:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(buf, buf[sealedLengthSize:], encRecord, offsetAdditionalData(offset)), nil
+}
+
+// openLogRecord 解密记录，sealed 不包含开头的长度字段
+func openLogRecord(aead cipher.AEAD, sealed []byte, offset int64) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize+aead.Overhead() {
+		return nil, ErrDecryptFailed
+	}
+	plain, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], offsetAdditionalData(offset))
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plain, nil
+}
+
+func offsetAdditionalData(offset int64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(offset))
+	return buf
+}
@@ -0,0 +1,171 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ysoding/bitcask/fio"
+)
+
+// FileFormatVersion 当前的文件格式版本，没有头部的旧版本文件视为版本 0
+const FileFormatVersion byte = 1
+
+var (
+	ErrInvalidFileHeader  = errors.New("invalid file header, not a bitcask file or the header is corrupted")
+	ErrUnsupportedVersion = errors.New("unsupported file format version")
+	ErrLegacyFormat       = errors.New("file has no header, it was written by an older version and needs to be migrated")
+)
+
+// 每个文件开头的头部，明文存储
+//
+//	+-------------+-------------+-------------+-------------+-------------+-------------+
+//	|    magic    |   version   |    flags    |   创建时间   | key id 长度  |   key id    |
+//	+-------------+-------------+-------------+-------------+-------------+-------------+
+//	    8字节          1字节         1字节          8字节         1字节          变长
+//
+// magic 的第 5 个字节不是合法的记录类型，不会和旧版本文件开头的 LogRecord 混淆
+var fileHeaderMagic = []byte("BCASKDAT")
+
+const (
+	fileHeaderFixedSize = 19
+	maxKeyIDLen         = 255
+	maxFileHeaderSize   = fileHeaderFixedSize + maxKeyIDLen
+
+	fileFlagEncrypted byte = 1 << 0 // 文件中的记录经过加密，key id 为加密使用的密钥
+)
+
+type fileHeader struct {
+	version   byte
+	flags     byte
+	createdAt int64 // 创建时间，UnixNano 时间戳
+	keyID     string
+}
+
+func newFileHeader(keyID string) *fileHeader {
+	header := &fileHeader{version: FileFormatVersion, createdAt: time.Now().UnixNano(), keyID: keyID}
+	if keyID != "" {
+		header.flags |= fileFlagEncrypted
+	}
+	return header
+}
+
+func (h *fileHeader) encode() []byte {
+	buf := make([]byte, fileHeaderFixedSize, fileHeaderFixedSize+len(h.keyID))
+	copy(buf, fileHeaderMagic)
+	index := len(fileHeaderMagic)
+	buf[index] = h.version
+	buf[index+1] = h.flags
+	binary.LittleEndian.PutUint64(buf[index+2:], uint64(h.createdAt))
+	buf[fileHeaderFixedSize-1] = byte(len(h.keyID))
+	return append(buf, h.keyID...)
+}
+
+// decodeFileHeader 解析文件头部，返回头部以及它的长度
+func decodeFileHeader(buf []byte) (*fileHeader, int64, error) {
+	if len(buf) < len(fileHeaderMagic) || !bytes.Equal(buf[:len(fileHeaderMagic)], fileHeaderMagic) {
+		return nil, 0, ErrInvalidFileHeader
+	}
+	if len(buf) < fileHeaderFixedSize {
+		return nil, 0, ErrInvalidFileHeader
+	}
+
+	index := len(fileHeaderMagic)
+	header := &fileHeader{
+		version:   buf[index],
+		flags:     buf[index+1],
+		createdAt: int64(binary.LittleEndian.Uint64(buf[index+2:])),
+	}
+	if header.version != FileFormatVersion {
+		return nil, 0, fmt.Errorf("%w: got version %d, want %d", ErrUnsupportedVersion, header.version, FileFormatVersion)
+	}
+
+	keyIDLen := int(buf[fileHeaderFixedSize-1])
+	if len(buf) < fileHeaderFixedSize+keyIDLen {
+		return nil, 0, ErrInvalidFileHeader
+	}
+	header.keyID = string(buf[fileHeaderFixedSize : fileHeaderFixedSize+keyIDLen])
+	if (header.flags&fileFlagEncrypted != 0) != (keyIDLen > 0) {
+		return nil, 0, ErrInvalidFileHeader
+	}
+	return header, int64(fileHeaderFixedSize + keyIDLen), nil
+}
+
+func readFileHeader(ioManager fio.IOManager) (*fileHeader, int64, error) {
+	buf := make([]byte, maxFileHeaderSize)
+	n, err := ioManager.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	header, headerSize, err := decodeFileHeader(buf[:n])
+	if err == ErrInvalidFileHeader && isLegacyFile(ioManager) {
+		return nil, 0, ErrLegacyFormat
+	}
+	return header, headerSize, err
+}
+
+// isLegacyFile 没有头部，但是开头是一条完整的 LogRecord，说明是旧版本的文件
+func isLegacyFile(ioManager fio.IOManager) bool {
+	legacyFile := &DataFile{IoManager: ioManager}
+	_, _, err := legacyFile.ReadLogRecord(0)
+	return err == nil
+}
+
+// MigrateFile 为旧版本没有头部的文件加上头部，已经是当前格式或者为空的文件不做处理，返回是否进行了升级
+// 头部不计入记录的位置，因此已有的索引信息在升级之后依然有效
+func MigrateFile(fileSystem fio.FileSystem, fileName string) (bool, error) {
+	ioManager, err := fileSystem.OpenFile(fileName, fio.ReadOnlyFileIO)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = ioManager.Close()
+	}()
+	size, err := ioManager.Size()
+	if err != nil || size == 0 {
+		return false, err
+	}
+	if _, _, err = readFileHeader(ioManager); err != ErrLegacyFormat {
+		return false, err
+	}
+
+	// 先写到临时文件，完成之后再替换，升级的过程中崩溃不会损坏原文件
+	tmpFileName := fileName + ".migrate"
+	if err := writeMigrateFile(fileSystem, tmpFileName, io.NewSectionReader(ioManager, 0, size)); err != nil {
+		_ = fileSystem.Remove(tmpFileName)
+		return false, err
+	}
+	if err := fileSystem.Rename(tmpFileName, fileName); err != nil {
+		return false, err
+	}
+	return true, fileSystem.SyncDir(filepath.Dir(fileName))
+}
+
+// writeMigrateFile 写入新的头部以及旧文件的内容，之前中断的升级留下的临时文件会被覆盖
+func writeMigrateFile(fileSystem fio.FileSystem, tmpFileName string, content io.Reader) error {
+	if err := fileSystem.Remove(tmpFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tmpFile, err := fileSystem.OpenFile(tmpFileName, fio.StandardFileIO)
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(newFileHeader("").encode()); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if _, err := io.Copy(tmpFile, content); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	return tmpFile.Close()
+}
@@ -0,0 +1,125 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/fio"
+)
+
+func TestFileHeader_EncodeDecode(t *testing.T) {
+	header := newFileHeader("")
+	res, size, err := decodeFileHeader(header.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, header, res)
+	assert.Equal(t, int64(fileHeaderFixedSize), size)
+
+	header = newFileHeader("key-1")
+	res, size, err = decodeFileHeader(header.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, header, res)
+	assert.Equal(t, fileHeaderFixedSize+int64(len("key-1")), size)
+	assert.NotZero(t, res.flags&fileFlagEncrypted)
+
+	// 未来的版本
+	header.version = FileFormatVersion + 1
+	_, _, err = decodeFileHeader(header.encode())
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// 不完整的头部
+	_, _, err = decodeFileHeader(newFileHeader("").encode()[:10])
+	assert.Equal(t, ErrInvalidFileHeader, err)
+}
+
+func TestDataFile_Header(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-header")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 创建文件时写入头部
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, nil)
+	assert.Nil(t, err)
+	assert.False(t, dataFile.CreatedAt().IsZero())
+	encRecord, _ := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask-go")})
+	assert.Nil(t, dataFile.Write(encRecord))
+	assert.Equal(t, int64(len(encRecord)), dataFile.WriteOffset)
+	assert.Nil(t, dataFile.Close())
+
+	raw, err := os.ReadFile(GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, fileHeaderMagic, raw[:len(fileHeaderMagic)])
+
+	dataFile, err = OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.MemoryMap, nil)
+	assert.Nil(t, err)
+	record, _, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask-go"), record.Value)
+	assert.Nil(t, dataFile.Close())
+
+	// 其他版本写入的文件
+	header := newFileHeader("")
+	header.version = FileFormatVersion + 1
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 1), header.encode(), fio.DataFilePerm))
+	_, err = OpenDataFile(fio.OSFileSystem{}, dir, 1, fio.StandardFileIO, nil)
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// 不是 bitcask 的文件
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 2), []byte("not a bitcask data file"), fio.DataFilePerm))
+	_, err = OpenDataFile(fio.OSFileSystem{}, dir, 2, fio.StandardFileIO, nil)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+}
+
+func TestMigrateFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-header")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 旧版本的文件没有头部
+	var content []byte
+	for _, key := range []string{"a", "b", "c"} {
+		encRecord, _ := EncodeLogRecord(&LogRecord{Key: []byte(key), Value: []byte("bitcask-go")})
+		content = append(content, encRecord...)
+	}
+	fileName := GetDataFileName(dir, 0)
+	assert.Nil(t, os.WriteFile(fileName, content, fio.DataFilePerm))
+	_, err := OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, nil)
+	assert.Equal(t, ErrLegacyFormat, err)
+
+	// 之前中断的升级留下的临时文件会被覆盖
+	assert.Nil(t, os.WriteFile(fileName+".migrate", []byte("stale"), fio.DataFilePerm))
+
+	migrated, err := MigrateFile(fio.OSFileSystem{}, fileName)
+	assert.Nil(t, err)
+	assert.True(t, migrated)
+	_, err = os.Stat(fileName + ".migrate")
+	assert.True(t, os.IsNotExist(err))
+
+	// 升级之后记录的位置保持不变
+	dataFile, err := OpenDataFile(fio.OSFileSystem{}, dir, 0, fio.StandardFileIO, nil)
+	assert.Nil(t, err)
+	size, err := dataFile.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	offset := int64(0)
+	for _, key := range []string{"a", "b", "c"} {
+		record, n, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(key), record.Key)
+		offset += n
+	}
+	assert.Nil(t, dataFile.Close())
+
+	// 已经升级过的文件以及空文件不做处理
+	migrated, err = MigrateFile(fio.OSFileSystem{}, fileName)
+	assert.Nil(t, err)
+	assert.False(t, migrated)
+	emptyFileName := filepath.Join(dir, "empty")
+	assert.Nil(t, os.WriteFile(emptyFileName, nil, fio.DataFilePerm))
+	migrated, err = MigrateFile(fio.OSFileSystem{}, emptyFileName)
+	assert.Nil(t, err)
+	assert.False(t, migrated)
+}
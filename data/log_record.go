@@ -13,20 +13,41 @@ const (
 	LogRecordTxnFinished
 )
 
-// crc 	type 	keySize valueSize
-// 4   +  1  + 	5     + 5 = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+const (
+	// type 字节的低位存储记录类型，高位作为标志位
+	logRecordTypeMask        byte = 0x0f
+	logRecordCompressionMask byte = 0x70 // value 的压缩算法，旧版本的数据中为 0，即没有压缩
+	logRecordExpireFlag      byte = 0x80 // header 中带有过期时间
+
+	logRecordCompressionShift = 4
+)
+
+// crc 	type 	keySize valueSize expire
+// 4   +  1  + 	5     + 5       + 10 = 25
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 5
 
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key    []byte
+	Value  []byte
+	Type   LogRecordType
+	Expire int64 // 过期时间，UnixNano 时间戳，0 表示永不过期
 }
 
 type LogRecordPos struct {
 	FileID uint32
 	Size   uint32
 	Offset int64
+	Expire int64 // 对应数据的过期时间，0 表示永不过期
+}
+
+// IsExpired 判断位置索引对应的数据在 now 时刻是否已经过期
+func (pos *LogRecordPos) IsExpired(now int64) bool {
+	return pos.Expire > 0 && pos.Expire <= now
+}
+
+// Before 判断位置索引对应的数据是否比 other 更早写入数据文件
+func (pos *LogRecordPos) Before(other *LogRecordPos) bool {
+	return pos.FileID < other.FileID || pos.FileID == other.FileID && pos.Offset < other.Offset
 }
 
 // TransactionRecord 暂存的事务相关的数据
@@ -36,10 +57,12 @@ type TransactionRecord struct {
 }
 
 type logRecordHeader struct {
-	crc        uint32 // crc检验值
-	recordType LogRecordType
-	keySize    uint32
-	valueSize  uint32
+	crc         uint32 // crc检验值
+	recordType  LogRecordType
+	compression CompressionType
+	keySize     uint32
+	valueSize   uint32 // 磁盘上 value 的长度，压缩之后的长度
+	expire      int64
 }
 
 func DecodeLogRecordPos(buf []byte) *LogRecordPos {
@@ -51,36 +74,63 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	offset, n := binary.Varint(buf[index:])
 	index += n
 
-	size, _ := binary.Varint(buf[index:])
-	return &LogRecordPos{FileID: uint32(fileID), Offset: offset, Size: uint32(size)}
+	size, n := binary.Varint(buf[index:])
+	index += n
+
+	// 旧版本的位置信息中没有过期时间，此时解码结果为 0
+	expire, _ := binary.Varint(buf[index:])
+	return &LogRecordPos{FileID: uint32(fileID), Offset: offset, Size: uint32(size), Expire: expire}
 }
 
 // EncodeLogRecordPos 对位置信息进行编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*2)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.FileID))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	if pos.Expire > 0 {
+		index += binary.PutVarint(buf[index:], pos.Expire)
+	}
 	return buf[:index]
 }
 
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
 //
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	    4字节          1字节        变长（最大5）   变长（最大5）     变长           变长
+//	+-------------+-------------+-------------+--------------+--------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   |    key size |   value size |    expire    |      key    |      value   |
+//	+-------------+-------------+-------------+--------------+--------------+-------------+--------------+
+//	    4字节          1字节        变长（最大5）   变长（最大5）  变长（最大10）     变长           变长
+//
+// expire 只有在设置了过期时间时才会写入，并在 type 字节中置上对应的标志位
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+	return encodeLogRecord(logRecord, logRecord.Value, NoCompression)
+}
+
+// EncodeLogRecordWithCompression 对 LogRecord 进行编码，value 按照指定的算法压缩
+// value 小于 minSize 或者压缩之后没有变小时不进行压缩，压缩算法记录在 type 字节中
+func EncodeLogRecordWithCompression(logRecord *LogRecord, compression CompressionType, minSize int) ([]byte, int64) {
+	value, compression := compressValue(logRecord.Value, compression, minSize)
+	return encodeLogRecord(logRecord, value, compression)
+}
+
+func encodeLogRecord(logRecord *LogRecord, value []byte, compression CompressionType) ([]byte, int64) {
 	headerBuf := make([]byte, maxLogRecordHeaderSize)
 
 	headerBuf[4] = byte(logRecord.Type)
+	headerBuf[4] |= (byte(compression) << logRecordCompressionShift) & logRecordCompressionMask
+	if logRecord.Expire > 0 {
+		headerBuf[4] |= logRecordExpireFlag
+	}
 
 	index := 5
 	index += binary.PutVarint(headerBuf[index:], int64(len(logRecord.Key)))
-	index += binary.PutVarint(headerBuf[index:], int64(len(logRecord.Value)))
+	index += binary.PutVarint(headerBuf[index:], int64(len(value)))
+	if logRecord.Expire > 0 {
+		index += binary.PutVarint(headerBuf[index:], logRecord.Expire)
+	}
 
-	size := index + len(logRecord.Key) + len(logRecord.Value)
+	size := index + len(logRecord.Key) + len(value)
 	encBuf := make([]byte, size)
 
 	// copy header
@@ -88,7 +138,7 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	// copy key
 	copy(encBuf[index:], logRecord.Key)
 	// copy value
-	copy(encBuf[index+len(logRecord.Key):], logRecord.Value)
+	copy(encBuf[index+len(logRecord.Key):], value)
 
 	crc := crc32.ChecksumIEEE(encBuf[crc32.Size:])
 	binary.LittleEndian.PutUint32(encBuf[:crc32.Size], crc)
@@ -102,20 +152,37 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 	}
 
 	header := &logRecordHeader{
-		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: LogRecordType(buf[4]),
+		crc:         binary.LittleEndian.Uint32(buf[:4]),
+		recordType:  LogRecordType(buf[4] & logRecordTypeMask),
+		compression: CompressionType((buf[4] & logRecordCompressionMask) >> logRecordCompressionShift),
 	}
 
 	index := 5
 
+	// 长度不足或者无法解析的 header 返回 nil
 	keySize, n := binary.Varint(buf[index:])
+	if n <= 0 || keySize < 0 {
+		return nil, 0
+	}
 	header.keySize = uint32(keySize)
 	index += n
 
 	valueSize, n := binary.Varint(buf[index:])
+	if n <= 0 || valueSize < 0 {
+		return nil, 0
+	}
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	if buf[4]&logRecordExpireFlag != 0 {
+		expire, n := binary.Varint(buf[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.expire = expire
+		index += n
+	}
+
 	return header, int64(index)
 }
 
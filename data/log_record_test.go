@@ -1,6 +1,7 @@
 package data
 
 import (
+	"bytes"
 	"hash/crc32"
 	"testing"
 
@@ -91,3 +92,71 @@ func TestGetLogRecordCRC(t *testing.T) {
 	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(290887979), crc3)
 }
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	lg := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask-go"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	res, n := EncodeLogRecord(lg)
+	assert.NotNil(t, res)
+
+	header, headerSize := decodeLogRecordHeader(res)
+	assert.NotNil(t, header)
+	assert.Equal(t, LogRecordNormal, header.recordType)
+	assert.Equal(t, uint32(4), header.keySize)
+	assert.Equal(t, uint32(10), header.valueSize)
+	assert.Equal(t, lg.Expire, header.expire)
+	assert.Equal(t, n, headerSize+int64(header.keySize+header.valueSize))
+
+	crc := getLogRecordCRC(lg, res[crc32.Size:headerSize])
+	assert.Equal(t, header.crc, crc)
+}
+
+func TestLogRecordPos_Expire(t *testing.T) {
+	pos := &LogRecordPos{FileID: 1, Offset: 100, Size: 30, Expire: 1700000000000000000}
+	res := DecodeLogRecordPos(EncodeLogRecordPos(pos))
+	assert.Equal(t, pos, res)
+	assert.True(t, res.IsExpired(pos.Expire))
+	assert.False(t, res.IsExpired(pos.Expire-1))
+
+	// 没有过期时间的位置信息
+	pos2 := &LogRecordPos{FileID: 1, Offset: 100, Size: 30}
+	res2 := DecodeLogRecordPos(EncodeLogRecordPos(pos2))
+	assert.Equal(t, pos2, res2)
+	assert.False(t, res2.IsExpired(pos.Expire))
+}
+
+func TestEncodeLogRecordWithCompression(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"bitcask-go","type":"kv"}`), 20)
+	for _, compression := range []CompressionType{SnappyCompression, ZstdCompression} {
+		lg := &LogRecord{Key: []byte("name"), Value: value, Type: LogRecordNormal, Expire: 1700000000000000000}
+		res, n := EncodeLogRecordWithCompression(lg, compression, 64)
+		assert.Equal(t, int64(len(res)), n)
+
+		header, headerSize := decodeLogRecordHeader(res)
+		assert.Equal(t, LogRecordNormal, header.recordType)
+		assert.Equal(t, compression, header.compression)
+		assert.Equal(t, lg.Expire, header.expire)
+		assert.Less(t, int(header.valueSize), len(value))
+
+		stored := res[headerSize+int64(header.keySize):]
+		decompressed, err := decompressValue(stored, header.compression)
+		assert.Nil(t, err)
+		assert.Equal(t, value, decompressed)
+
+		// 小于最小长度时不压缩
+		res, _ = EncodeLogRecordWithCompression(lg, compression, len(value)+1)
+		header, _ = decodeLogRecordHeader(res)
+		assert.Equal(t, NoCompression, header.compression)
+		assert.Equal(t, uint32(len(value)), header.valueSize)
+
+		// 压缩之后没有变小时不压缩
+		lg.Value = []byte("bitcask-go")
+		res, _ = EncodeLogRecordWithCompression(lg, compression, 0)
+		header, _ = decodeLogRecordHeader(res)
+		assert.Equal(t, NoCompression, header.compression)
+	}
+}
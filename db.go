@@ -1,21 +1,22 @@
 package bitcask
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/gofrs/flock"
 	"github.com/ysoding/bitcask/data"
 	"github.com/ysoding/bitcask/fio"
 	"github.com/ysoding/bitcask/index"
-	"github.com/ysoding/bitcask/utils"
 )
 
 const (
@@ -27,16 +28,37 @@ type DB struct {
 	option
 	indexer         index.Indexer
 	mu              *sync.RWMutex
+	applyMu         *sync.RWMutex             // 释放 db 的锁之后并行更新索引时持有读锁，需要完整索引的操作通过 lock 持有写锁
+	deadMu          *sync.Mutex               // 保护 reclaimSize 以及 deadSizes，并行更新索引时不持有 db 的锁
 	activeFile      *data.DataFile            // 当前活跃文件，可以写入
 	oldFiles        map[uint32]*data.DataFile // 旧的文件，只用于读 fileid->datafile
 	reclaimSize     int64                     // 表示有多少数据是无效的
+	deadSizes       map[uint32]int64          // 每个数据文件中无效的数据量 fileid->size
 	bytesWrite      uint64                    //总计写的节字数
 	isInitial       bool                      // 是否是第一次初始化此数据目录
-	fileLock        *flock.Flock
+	fileLock        fio.FileLock
 	fileIDs         []int
 	seqNo           uint64 // 事务序列号，全局递增
 	isMerging       bool
-	seqNoFileExists bool // 存储事务序列号的文件是否存在
+	seqNoFileExists bool               // 存储事务序列号的文件是否存在
+	oracle          *oracle            // 乐观事务的冲突检测
+	autoMergeCancel context.CancelFunc // 停止后台自动 merge，正在进行的 merge 也会被取消
+	autoMergeWg     sync.WaitGroup
+	fileMu          *sync.Mutex
+	filePins        int                                  // 正在引用数据文件的快照以及迭代器的数量
+	retiredFiles    []*data.DataFile                     // merge 之后被替换，等待引用释放之后关闭的数据文件
+	txnRecords      map[uint64][]*data.TransactionRecord // 只读模式下还没有读到事务完成标识的事务数据，Refresh 时继续处理
+	commitMu        *sync.Mutex
+	commitQueue     []*commitRequest // 等待组提交的写入
+	committing      bool             // 是否有组长正在提交
+	valueCache      *valueCache      // value 缓存，为空表示不缓存
+
+	indexSnapshot        *indexSnapshotMeta // 数据目录中的索引快照覆盖的范围，为空表示没有快照
+	indexSnapshotVersion uint64             // merge 删除索引快照时递增，写入期间发生过 merge 的快照直接丢弃
+	checkpointMu         *sync.Mutex
+	checkpointCancel     context.CancelFunc // 停止定期写入索引快照的协程
+	checkpointWg         sync.WaitGroup
+	rawLog               bool // 直接追加记录而不更新索引，用于 merge 和 fsck 写入新的目录，不能写入索引快照
 }
 
 // Stat 存储引擎统计信息
@@ -45,13 +67,32 @@ type Stat struct {
 	DataFileNum     uint  // 数据文件的数量
 	ReclaimableSize int64 // 可以进行 merge 回收的数据量，字节为单位
 	DiskSize        int64 // 数据目录所占磁盘空间大小
+	DataFiles       []DataFileStat
+	CacheHits       uint64 // value 缓存命中的次数
+	CacheMisses     uint64 // value 缓存没有命中的次数
+}
+
+// DataFileStat 单个数据文件的统计信息
+type DataFileStat struct {
+	FileID   uint32
+	Size     int64 // 文件大小
+	LiveSize int64 // 有效的数据量
+	DeadSize int64 // 无效的数据量，可以通过 merge 回收
 }
 
 func Open(opts ...DBOption) (*DB, error) {
 	db := &DB{
-		option:   DefaultOption,
-		oldFiles: make(map[uint32]*data.DataFile),
-		mu:       new(sync.RWMutex),
+		option:    DefaultOption,
+		oldFiles:  make(map[uint32]*data.DataFile),
+		deadSizes: make(map[uint32]int64),
+		mu:        new(sync.RWMutex),
+		applyMu:   new(sync.RWMutex),
+		deadMu:    new(sync.Mutex),
+		oracle:    newOracle(),
+		fileMu:    new(sync.Mutex),
+		commitMu:  new(sync.Mutex),
+
+		checkpointMu: new(sync.Mutex),
 	}
 
 	for _, opt := range opts {
@@ -61,8 +102,19 @@ func Open(opts ...DBOption) (*DB, error) {
 	if err := db.checkConfiguration(); err != nil {
 		return nil, err
 	}
+	if db.valueCacheSize > 0 {
+		db.valueCache = newValueCache(db.valueCacheSize)
+	}
 
-	db.indexer = index.NewIndexer(index.IndexerType(db.indexerType), db.dirPath, db.syncWrite)
+	// B+ 树索引文件被写进程独占，只读模式下使用内存索引
+	if db.readOnly && db.indexerType == BPlusTree {
+		db.indexerType = BTree
+	}
+	indexer, err := db.newIndexer()
+	if err != nil {
+		return nil, err
+	}
+	db.indexer = indexer
 
 	isInitial, err := db.initDirectory()
 	if err != nil {
@@ -73,6 +125,14 @@ func Open(opts ...DBOption) (*DB, error) {
 		return nil, err
 	}
 
+	// 打开失败时释放文件锁，关闭已经打开的文件
+	opened := false
+	defer func() {
+		if !opened {
+			db.closeOnOpenFailure()
+		}
+	}()
+
 	hasData, err := db.checkDatabaseHasData()
 	if err != nil {
 		return nil, err
@@ -94,21 +154,22 @@ func Open(opts ...DBOption) (*DB, error) {
 	}
 
 	if db.indexerType != BPlusTree {
-		// 从 hint 索引文件中加载索引
-		if err := db.loadIndexFromHintFile(); err != nil {
-			return nil, err
-		}
-
-		if err := db.loadIndexFromDataFiles(); err != nil {
+		// 优先从索引快照中加载索引，只需要重放快照之后写入的数据
+		snapshot, err := db.loadIndexFromSnapshot()
+		if err != nil {
 			return nil, err
 		}
 
-		// 重置 IO 类型为标准文件 IO
-		if db.mmapAtStartUp {
-			if err := db.resetIoType(); err != nil {
+		// 从 hint 索引文件中加载索引
+		if snapshot == nil {
+			if err := db.loadIndexFromHintFile(); err != nil {
 				return nil, err
 			}
 		}
+
+		if err := db.loadIndexFromDataFiles(snapshot); err != nil {
+			return nil, err
+		}
 	} else { // BPlusTree
 		// B+树索引不需要从数据文件中加载索引
 		// 取出当前事务序列号
@@ -116,8 +177,16 @@ func Open(opts ...DBOption) (*DB, error) {
 			return nil, err
 		}
 
+		if err := db.repointIndexFromDataHints(); err != nil {
+			return nil, err
+		}
+
+		if err := db.recoverActiveFile(); err != nil {
+			return nil, err
+		}
+
 		if db.activeFile != nil {
-			size, err := db.activeFile.IoManager.Size()
+			size, err := db.activeFile.Size()
 			if err != nil {
 				return nil, err
 			}
@@ -125,10 +194,38 @@ func Open(opts ...DBOption) (*DB, error) {
 		}
 	}
 
+	// 重置 IO 类型为标准文件 IO，活跃文件切换为可写的 MMap
+	if (db.mmapAtStartUp || db.mmapActiveFile) && !db.readOnly {
+		if err := db.resetIoType(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.rotateActiveFileKey(); err != nil {
+		return nil, err
+	}
+
+	db.startAutoMerge()
+	db.startCheckpoint()
+
+	opened = true
 	return db, nil
 }
 
-func (db *DB) Stat() *Stat {
+func (db *DB) closeOnOpenFailure() {
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, file := range db.oldFiles {
+		_ = file.Close()
+	}
+	_ = db.indexer.Close()
+	if db.fileLock != nil {
+		_ = db.fileLock.Unlock()
+	}
+}
+
+func (db *DB) Stat() (*Stat, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
@@ -137,44 +234,215 @@ func (db *DB) Stat() *Stat {
 		dataFiles += 1
 	}
 
-	dirSize, err := utils.DirSize(db.dirPath)
+	dirSize, err := fio.DirSize(db.fileSystem, db.dirPath)
 	if err != nil {
-		panic(fmt.Sprintf("failed to get dir size : %v", err))
+		return nil, fmt.Errorf("failed to get dir size: %w", err)
 	}
 
-	return &Stat{
-		KeyNum:          uint(db.indexer.Size()),
+	fileStats, err := db.getDataFileStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data file size: %w", err)
+	}
+
+	keyNum, err := db.indexer.Size()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key num: %w", err)
+	}
+
+	db.deadMu.Lock()
+	reclaimSize := db.reclaimSize
+	db.deadMu.Unlock()
+
+	stat := &Stat{
+		KeyNum:          uint(keyNum),
 		DataFileNum:     dataFiles,
-		ReclaimableSize: db.reclaimSize,
+		ReclaimableSize: reclaimSize,
 		DiskSize:        dirSize,
+		DataFiles:       fileStats,
 	}
+	if db.valueCache != nil {
+		stat.CacheHits = db.valueCache.hits.Load()
+		stat.CacheMisses = db.valueCache.misses.Load()
+	}
+	return stat, nil
 }
 
-// 将数据文件的 IO 类型设置为标准文件 IO
+// getDataFileStats 获取每个数据文件的统计信息，按照文件 id 从小到大排序，需要持有 db 的锁
+func (db *DB) getDataFileStats() ([]DataFileStat, error) {
+	files := make([]*data.DataFile, 0, len(db.oldFiles)+1)
+	for _, dataFile := range db.oldFiles {
+		files = append(files, dataFile)
+	}
+	if db.activeFile != nil {
+		files = append(files, db.activeFile)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileID < files[j].FileID
+	})
+
+	stats := make([]DataFileStat, 0, len(files))
+	for _, dataFile := range files {
+		size, err := dataFile.Size()
+		if err != nil {
+			return nil, err
+		}
+		db.deadMu.Lock()
+		deadSize := db.deadSizes[dataFile.FileID]
+		db.deadMu.Unlock()
+		if deadSize > size {
+			deadSize = size
+		}
+		stats = append(stats, DataFileStat{
+			FileID:   dataFile.FileID,
+			Size:     size,
+			LiveSize: size - deadSize,
+			DeadSize: deadSize,
+		})
+	}
+	return stats, nil
+}
+
+// markDead 记录已经无效的数据，并行更新索引时不持有 db 的锁也可以调用
+func (db *DB) markDead(pos *data.LogRecordPos) {
+	db.deadMu.Lock()
+	db.reclaimSize += int64(pos.Size)
+	db.deadSizes[pos.FileID] += int64(pos.Size)
+	db.deadMu.Unlock()
+	if db.valueCache != nil {
+		db.valueCache.remove(pos)
+	}
+}
+
+// resetDeadSize 数据文件被 merge 重写之后清除其无效数据的统计，需要通过 lock 持有 db 的锁
+func (db *DB) resetDeadSize(fileID uint32) {
+	db.deadMu.Lock()
+	defer db.deadMu.Unlock()
+	db.reclaimSize -= db.deadSizes[fileID]
+	delete(db.deadSizes, fileID)
+}
+
+// 将数据文件的 IO 类型设置为标准文件 IO，活跃文件设置为 activeIOType
 func (db *DB) resetIoType() error {
 	if db.activeFile == nil {
 		return nil
 	}
 
-	if err := db.activeFile.SetIOManager(db.dirPath, fio.StandardFileIO); err != nil {
+	if err := db.setIOType(db.activeFile, db.activeIOType()); err != nil {
+		return err
+	}
+	if err := db.activeFile.Preallocate(db.dataFileSize); err != nil {
 		return err
 	}
 
+	if !db.mmapAtStartUp {
+		return nil
+	}
 	for _, dataFile := range db.oldFiles {
-		if err := dataFile.SetIOManager(db.dirPath, fio.StandardFileIO); err != nil {
+		if err := db.setIOType(dataFile, fio.StandardFileIO); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// activeIOType 活跃文件使用的 IO 类型
+func (db *DB) activeIOType() fio.IOType {
+	if db.mmapActiveFile {
+		return fio.ReadWriteMemoryMap
+	}
+	return fio.StandardFileIO
+}
+
+// sealActiveFile 持久化活跃文件并将它转换为旧的数据文件，需要持有db的锁
+// 可写 MMap 的活跃文件使用标准文件 IO 重新打开，原来的映射在没有迭代器引用之后关闭，关闭时截断预先分配的空间
+func (db *DB) sealActiveFile() error {
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+
+	dataFile := db.activeFile
+	if _, ok := dataFile.IoManager.(*fio.MMapRW); ok {
+		reopened, err := db.openDataFile(db.dirPath, dataFile.FileID, fio.StandardFileIO)
+		if err != nil {
+			return err
+		}
+		reopened.WriteOffset = dataFile.WriteOffset
+		db.retireFiles([]*data.DataFile{dataFile})
+		dataFile = reopened
+	}
+	db.oldFiles[dataFile.FileID] = dataFile
+	return nil
+}
+
+// trimActiveFile 截断活跃文件 offset 之后全零的数据，可写 MMap 预先分配的空间在崩溃之后会留在文件末尾
+// 调用方需要先通过 checkDataEnd 确认 offset 之后没有数据
+func (db *DB) trimActiveFile(offset int64) error {
+	if db.readOnly {
+		return nil
+	}
+	size, err := db.activeFile.Size()
+	if err != nil || size <= offset {
+		return err
+	}
+
+	// MMap 不支持截断
+	if db.mmapAtStartUp {
+		if err := db.setIOType(db.activeFile, fio.StandardFileIO); err != nil {
+			return err
+		}
+	}
+	return db.activeFile.Truncate(offset)
+}
+
+// setIOType 使用新的 IO 类型重新打开数据文件
+func (db *DB) setIOType(dataFile *data.DataFile, ioType fio.IOType) error {
+	ioManager, err := db.fileSystem.OpenFile(data.GetDataFileName(db.dirPath, dataFile.FileID), ioType)
+	if err != nil {
+		return err
+	}
+	return dataFile.SetIOManager(ioManager)
+}
+
+// openFile 通过数据目录所在的文件系统打开文件
+func (db *DB) openFile(fileName string, fileID uint32, ioType fio.IOType) (*data.DataFile, error) {
+	ioManager, err := db.fileSystem.OpenFile(fileName, ioType)
+	if err != nil {
+		return nil, err
+	}
+	return data.NewDataFile(ioManager, fileID, ioType, db.keyProvider)
+}
+
+// openDataFile 打开目录 dirPath 中的数据文件
+func (db *DB) openDataFile(dirPath string, fileID uint32, ioType fio.IOType) (*data.DataFile, error) {
+	return db.openFile(data.GetDataFileName(dirPath, fileID), fileID, ioType)
+}
+
+// rotateActiveFileKey 活跃文件没有使用当前的密钥加密时切换到新的活跃文件，之后写入的数据都使用当前的密钥加密
+func (db *DB) rotateActiveFileKey() error {
+	if db.keyProvider == nil || db.activeFile == nil || db.readOnly {
+		return nil
+	}
+	keyID, _, err := db.keyProvider.CurrentKey()
+	if err != nil {
+		return err
+	}
+	if db.activeFile.Encrypted() && db.activeFile.KeyID() == keyID {
+		return nil
+	}
+
+	if err := db.sealActiveFile(); err != nil {
+		return err
+	}
+	return db.updateActiveDataFile()
+}
+
 func (db *DB) loadSeqNo() error {
 	fileName := filepath.Join(db.dirPath, data.SeqNoFileName)
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+	if _, err := db.fileSystem.Stat(fileName); os.IsNotExist(err) {
 		return nil
 	}
 
-	seqNoFile, err := data.OpenSeqNoFile(db.dirPath)
+	seqNoFile, err := db.openFile(fileName, 0, fio.StandardFileIO)
 	if err != nil {
 		return err
 	}
@@ -192,22 +460,33 @@ func (db *DB) loadSeqNo() error {
 	db.seqNo = seqNo
 	db.seqNoFileExists = true
 
-	return os.Remove(fileName)
+	_ = seqNoFile.Close()
+	return db.fileSystem.Remove(fileName)
 }
 
 func (db *DB) loadIndexFromHintFile() error {
 	// 查看 hint 索引文件是否存在
 	hintFileName := filepath.Join(db.dirPath, data.HintFileName)
-	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+	if _, err := db.fileSystem.Stat(hintFileName); os.IsNotExist(err) {
 		return nil
 	}
 
 	//	打开 hint 索引文件
-	hintFile, err := data.OpenHintFile(db.dirPath)
+	hintFile, err := db.openFile(hintFileName, 0, fio.ReadOnlyFileIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	// 被增量 merge 重写过的数据文件从它自己的 hint 文件中加载
+	dataHints, err := db.getValidDataHints()
 	if err != nil {
 		return err
 	}
 
+	now := time.Now().UnixNano()
 	offset := int64(0)
 	for {
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
@@ -217,74 +496,54 @@ func (db *DB) loadIndexFromHintFile() error {
 			}
 			return err
 		}
+		offset += size
 
-		// 解码拿到实际的位置索引
+		// 解码拿到实际的位置索引，已经过期的数据不再加载到索引中
 		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if _, ok := dataHints[pos.FileID]; ok {
+			continue
+		}
+		if pos.IsExpired(now) {
+			db.markDead(pos)
+			continue
+		}
 		db.indexer.Put(logRecord.Key, pos)
-		offset += size
 	}
 
 	return nil
 }
 
 func (db *DB) loadMergeFiles() error {
-	mergePath := db.getMergePath()
-	// merge 目录不存在的话直接返回
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	// 只读模式下不安装 merge 的结果，安装之前原来的数据文件依然是完整的
+	if db.readOnly {
 		return nil
 	}
 
-	defer func() {
-		_ = os.RemoveAll(mergePath)
-	}()
-
-	dirEntries, err := os.ReadDir(mergePath)
-	if err != nil {
-		return err
+	mergePath := db.getMergePath()
+	// merge 目录不存在的话直接返回
+	if _, err := db.fileSystem.Stat(mergePath); os.IsNotExist(err) {
+		return nil
 	}
 
 	// 查找标识 merge 完成的文件，判断 merge 是否处理完了
-	var mergeFinished bool
-	var mergeFileNames []string
-
-	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
-			mergeFinished = true
-		}
-
-		if entry.Name() == data.SeqNoFileName || entry.Name() == fileLockName {
-			continue
-		}
-
-		mergeFileNames = append(mergeFileNames, entry.Name())
-	}
-
-	// 没有 merge 完成则直接返回
-	if !mergeFinished {
-		return nil
+	mergeFinFileName := filepath.Join(mergePath, data.MergeFinishedFileName)
+	if _, err := db.fileSystem.Stat(mergeFinFileName); os.IsNotExist(err) {
+		// 没有 merge 完成则直接删除
+		return db.fileSystem.RemoveAll(mergePath)
 	}
 
 	nonMergeFileId, err := db.getNonMergeFileID(mergePath)
 	if err != nil {
-		return nil
+		return db.fileSystem.RemoveAll(mergePath)
 	}
 
-	// 删除旧的数据文件
-	fileID := uint32(0)
-	for ; fileID < nonMergeFileId; fileID++ {
-		filename := data.GetDataFileName(db.dirPath, fileID)
-		if _, err := os.Stat(filename); err == nil {
-			if err := os.Remove(filename); err != nil {
-				return err
-			}
-		}
+	if err := db.installMergeFiles(mergePath, nonMergeFileId); err != nil {
+		return err
 	}
 
-	// 将新的数据文件移动到数据目录中
-	for _, filename := range mergeFileNames {
-		srcPath := filepath.Join(mergePath, filename)
-		destPath := filepath.Join(db.dirPath, filename)
-		if err := os.Rename(srcPath, destPath); err != nil {
+	// B+ 树索引持久化在磁盘上，需要指向 merge 之后的位置
+	if db.indexerType == BPlusTree {
+		if err := db.repointIndexFromHintFile(nonMergeFileId); err != nil {
 			return err
 		}
 	}
@@ -293,8 +552,14 @@ func (db *DB) loadMergeFiles() error {
 }
 
 func (db *DB) initDirectory() (bool, error) {
-	if _, err := os.Stat(db.dirPath); os.IsNotExist(err) {
-		if err := os.Mkdir(db.dirPath, os.ModePerm); err != nil {
+	// 只读模式下不创建目录
+	if db.readOnly {
+		_, err := db.fileSystem.Stat(db.dirPath)
+		return false, err
+	}
+
+	if _, err := db.fileSystem.Stat(db.dirPath); os.IsNotExist(err) {
+		if err := db.fileSystem.MkdirAll(db.dirPath); err != nil {
 			return false, err
 		}
 		return true, nil
@@ -304,9 +569,13 @@ func (db *DB) initDirectory() (bool, error) {
 }
 
 // 判断基于dirPath目录是否被使用
+// 只读模式下不加锁，写进程持有的是排他锁，共享锁也无法获取
 func (db *DB) checkDatabaseIsUsing() error {
-	fileLock := flock.New(filepath.Join(db.dirPath, fileLockName))
-	locked, err := fileLock.TryLock()
+	if db.readOnly {
+		return nil
+	}
+
+	fileLock, locked, err := db.fileSystem.TryLock(filepath.Join(db.dirPath, fileLockName))
 	if err != nil {
 		return err
 	}
@@ -322,7 +591,7 @@ func (db *DB) checkDatabaseIsUsing() error {
 
 // 检测dirPath目录是否有.data文件
 func (db *DB) checkDatabaseHasData() (bool, error) {
-	entries, err := os.ReadDir(db.dirPath)
+	entries, err := db.fileSystem.ReadDir(db.dirPath)
 	if err != nil {
 		return false, err
 	}
@@ -339,10 +608,11 @@ func (db *DB) checkDatabaseHasData() (bool, error) {
 	return hasData, nil
 }
 
-func (db *DB) loadDataFiles() error {
-	entries, err := os.ReadDir(db.dirPath)
+// getDataFileIDs 获取目录 dirPath 中所有数据文件的 id，从小到大排序
+func getDataFileIDs(fileSystem fio.FileSystem, dirPath string) ([]int, error) {
+	entries, err := fileSystem.ReadDir(dirPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var fileIDs []int
@@ -351,22 +621,32 @@ func (db *DB) loadDataFiles() error {
 			tmps := strings.Split(entry.Name(), ".")
 			fileID, err := strconv.Atoi(tmps[0])
 			if err != nil {
-				return ErrDataDirectoryCorrupted
+				return nil, ErrDataDirectoryCorrupted
 			}
 			fileIDs = append(fileIDs, fileID)
 		}
 	}
 
 	sort.Ints(fileIDs)
+	return fileIDs, nil
+}
+
+func (db *DB) loadDataFiles() error {
+	fileIDs, err := getDataFileIDs(db.fileSystem, db.dirPath)
+	if err != nil {
+		return err
+	}
 	db.fileIDs = fileIDs
 
 	for i, fileID := range fileIDs {
 		ioType := fio.StandardFileIO
-		if db.mmapAtStartUp {
+		if db.readOnly {
+			ioType = fio.ReadOnlyFileIO
+		} else if db.mmapAtStartUp {
 			ioType = fio.MemoryMap
 		}
 
-		dataFile, err := data.OpenDataFile(db.dirPath, uint32(fileID), ioType)
+		dataFile, err := db.openDataFile(db.dirPath, uint32(fileID), ioType)
 		if err != nil {
 			return err
 		}
@@ -381,7 +661,84 @@ func (db *DB) loadDataFiles() error {
 	return nil
 }
 
-func (db *DB) loadIndexFromDataFiles() error {
+// recoverActiveFile 检查活跃文件末尾是否有没有写完的记录，只在不需要从数据文件中加载索引时使用
+func (db *DB) recoverActiveFile() error {
+	if db.activeFile == nil {
+		return nil
+	}
+
+	offset := int64(0)
+	for {
+		_, size, err := db.activeFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				if err = db.checkDataEnd(db.activeFile, offset); err == nil {
+					return db.trimActiveFile(offset)
+				}
+			}
+			return db.recoverDataFile(db.activeFile, offset, size, err, true)
+		}
+		offset += size
+	}
+}
+
+// checkDataEnd 读取到全零的 header 时检查 offset 之后是否全部为零，即文件末尾或者可写 MMap 预先分配的空间
+// 之后还有数据时说明文件中间的数据被清零，作为损坏的记录处理
+func (db *DB) checkDataEnd(dataFile *data.DataFile, offset int64) error {
+	zero, err := dataFile.ZeroFrom(offset)
+	if err != nil {
+		return err
+	}
+	if !zero {
+		return data.ErrInvalidRecordHeader
+	}
+	return nil
+}
+
+// recoverDataFile 处理启动时从 offset 处读取到的不完整或者损坏的记录，可以恢复时将文件截断到 offset 处
+// 写入过程中崩溃会在活跃文件末尾留下不完整的记录，这种情况直接截断，其他情况需要开启 WithDBTruncateCorruptedFiles
+func (db *DB) recoverDataFile(dataFile *data.DataFile, offset, size int64, cause error, active bool) error {
+	if cause != io.ErrUnexpectedEOF && cause != data.ErrInvalidCRC && cause != data.ErrInvalidRecordHeader &&
+		cause != data.ErrDecryptFailed {
+		return cause
+	}
+
+	fileSize, err := dataFile.Size()
+	if err != nil {
+		return err
+	}
+	// 不完整的记录或者损坏的记录是文件中的最后一条
+	tail := cause == io.ErrUnexpectedEOF || offset+size >= fileSize
+	if active && !tail {
+		// 损坏的记录之后只有预先分配的空间
+		if tail, err = dataFile.ZeroFrom(offset + size); err != nil {
+			return err
+		}
+	}
+	// 只读模式下不修改文件，活跃文件末尾的记录可能正在被写进程写入，Refresh 时从这里重新读取
+	if db.readOnly && active && tail {
+		return nil
+	}
+	if !(active && tail) && !db.truncateCorruptedFiles || db.readOnly {
+		return fmt.Errorf("data file %d is corrupted at offset %d: %w", dataFile.FileID, offset, cause)
+	}
+
+	// MMap 不支持截断
+	if db.mmapAtStartUp {
+		if err := db.setIOType(dataFile, fio.StandardFileIO); err != nil {
+			return err
+		}
+	}
+	if err := dataFile.Truncate(offset); err != nil {
+		return err
+	}
+	log.Printf("bitcask: truncated data file %d at offset %d, dropped %d bytes: %v\n",
+		dataFile.FileID, offset, fileSize-offset, cause)
+	return nil
+}
+
+// loadIndexFromDataFiles 从数据文件中加载索引，snapshot 不为空时只加载索引快照之后写入的数据
+func (db *DB) loadIndexFromDataFiles(snapshot *indexSnapshotMeta) error {
 	if len(db.fileIDs) == 0 {
 		return nil
 	}
@@ -389,7 +746,7 @@ func (db *DB) loadIndexFromDataFiles() error {
 	// 查看是否发生过 merge
 	hasMerge, nonMergeFileId := false, uint32(0)
 	mergeFinFileName := filepath.Join(db.dirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergeFinFileName); err == nil {
+	if _, err := db.fileSystem.Stat(mergeFinFileName); err == nil {
 		fid, err := db.getNonMergeFileID(db.dirPath)
 		if err != nil {
 			return err
@@ -398,26 +755,44 @@ func (db *DB) loadIndexFromDataFiles() error {
 		nonMergeFileId = fid
 	}
 
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.indexer.Delete(key)
-			db.reclaimSize += int64(pos.Size)
-		} else {
-			oldPos = db.indexer.Put(key, pos)
-		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
-		}
+	// 被增量 merge 重写过的数据文件可以直接从它自己的 hint 文件中加载
+	dataHints, err := db.getValidDataHints()
+	if err != nil {
+		return err
 	}
 
 	// 暂存事务数据
 	transactionRecords := make(map[uint64][]*data.TransactionRecord)
-	currentSeqNo := nonTransactionSeqNo
+	db.seqNo = nonTransactionSeqNo
+	if snapshot != nil {
+		db.seqNo = snapshot.seqNo
+	}
 
+	now := time.Now().UnixNano()
 	for i, fileID := range db.fileIDs {
 		fileID := uint32(fileID)
 
+		// 索引快照已经覆盖了之前的数据
+		offset := int64(0)
+		if snapshot != nil {
+			if fileID < snapshot.fileID {
+				continue
+			}
+			if fileID == snapshot.fileID {
+				offset = snapshot.offset
+			}
+		}
+
+		if _, ok := dataHints[fileID]; ok {
+			err := db.loadIndexFromDataHintFile(fileID, func(key []byte, pos *data.LogRecordPos) error {
+				return db.updateIndex(key, data.LogRecordNormal, pos, now)
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		// 如果比最近未参与 merge 的文件 id 更小，则说明已经从 Hint 文件中加载索引了
 		if hasMerge && fileID < nonMergeFileId {
 			continue
@@ -430,63 +805,197 @@ func (db *DB) loadIndexFromDataFiles() error {
 			dataFile = db.oldFiles[fileID]
 		}
 
-		offset := int64(0)
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
+		isActive := i == len(db.fileIDs)-1
+		offset, err := db.loadIndexFromDataFile(dataFile, offset, isActive, transactionRecords, now)
+		if err != nil {
+			return err
+		}
+		if isActive {
+			if err := db.trimActiveFile(offset); err != nil {
 				return err
 			}
+			db.activeFile.WriteOffset = offset
+		}
+	}
 
-			logRecordPos := &data.LogRecordPos{FileID: fileID, Offset: offset, Size: uint32(size)}
+	// 只读模式下写进程可能正在写入事务，保留没有完成的事务数据，Refresh 时继续处理
+	if db.readOnly {
+		db.txnRecords = transactionRecords
+	}
+	return nil
+}
 
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-			if seqNo == nonTransactionSeqNo {
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				if logRecord.Type == data.LogRecordTxnFinished {
-					// 事务完成，对应的 seq no 的数据可以更新到内存索引中
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+// loadIndexFromDataFile 从 offset 处开始读取数据文件中的记录并更新索引，返回读取结束的位置
+func (db *DB) loadIndexFromDataFile(dataFile *data.DataFile, offset int64, active bool,
+	transactionRecords map[uint64][]*data.TransactionRecord, now int64) (int64, error) {
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			if err = db.checkDataEnd(dataFile, offset); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			if err := db.recoverDataFile(dataFile, offset, size, err, active); err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		logRecordPos := &data.LogRecordPos{FileID: dataFile.FileID, Offset: offset, Size: uint32(size), Expire: logRecord.Expire}
+
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		if seqNo == nonTransactionSeqNo {
+			if err := db.updateIndex(realKey, logRecord.Type, logRecordPos, now); err != nil {
+				return 0, err
+			}
+		} else {
+			if logRecord.Type == data.LogRecordTxnFinished {
+				// 事务完成，对应的 seq no 的数据可以更新到内存索引中
+				for _, txnRecord := range transactionRecords[seqNo] {
+					if err := db.updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos, now); err != nil {
+						return 0, err
 					}
-					delete(transactionRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
 				}
+				delete(transactionRecords, seqNo)
+			} else {
+				logRecord.Key = realKey
+				transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
+					Record: logRecord,
+					Pos:    logRecordPos,
+				})
 			}
-			// 更新事务序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
-			}
+		}
+		// 更新事务序列号
+		if seqNo > db.seqNo {
+			db.seqNo = seqNo
+		}
+
+		offset += size
+	}
+	return offset, nil
+}
+
+// updateIndex 加载索引时根据记录的类型更新索引，已经过期的数据等同于被删除
+func (db *DB) updateIndex(key []byte, typ data.LogRecordType, pos *data.LogRecordPos, now int64) error {
+	var oldPos *data.LogRecordPos
+	var err error
+	if typ == data.LogRecordDeleted || pos.IsExpired(now) {
+		oldPos, _, err = db.indexer.Delete(key)
+		db.markDead(pos)
+	} else {
+		oldPos, err = db.indexer.Put(key, pos)
+	}
+	if err != nil {
+		return indexUpdateErr(err)
+	}
+	if oldPos != nil {
+		db.markDead(oldPos)
+	}
+	return nil
+}
+
+// newIndexer 根据配置创建索引
+func (db *DB) newIndexer() (index.Indexer, error) {
+	if db.indexerType == ShardedBTree {
+		return index.NewShardedBTree(db.indexShardNum), nil
+	}
+	return index.NewIndexer(index.IndexerType(db.indexerType), db.dirPath, db.syncWrite)
+}
+
+// putIndex 写入 key 的位置索引，返回已经无效的位置
+// 支持并行更新的索引上同一个 key 的写入可能乱序到达，只保留数据文件中更靠后的位置
+func (db *DB) putIndex(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	if indexer, ok := db.indexer.(index.ConcurrentIndexer); ok {
+		return indexer.PutIfNewer(key, pos)
+	}
+	return db.indexer.Put(key, pos)
+}
+
+// indexUpdateErr 包装更新索引失败的错误，可以通过 errors.Is 判断 ErrIndexUpdateFailed 以及原始的错误
+func indexUpdateErr(err error) error {
+	return fmt.Errorf("%w: %w", ErrIndexUpdateFailed, err)
+}
 
-			offset += size
+// Refresh 只读模式下加载写进程在打开之后追加的数据，从活跃文件上次读到的位置继续读取，并打开新创建的数据文件
+// 写进程 merge 之后旧的数据文件会被替换，需要重新打开数据库才能读到 merge 之后的数据，非只读模式下不做任何处理
+func (db *DB) Refresh() error {
+	if !db.readOnly {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	fileIDs, err := getDataFileIDs(db.fileSystem, db.dirPath)
+	if err != nil {
+		return err
+	}
+	if db.txnRecords == nil {
+		db.txnRecords = make(map[uint64][]*data.TransactionRecord)
+	}
+
+	now := time.Now().UnixNano()
+	for i, fid := range fileIDs {
+		fileID := uint32(fid)
+		if db.activeFile != nil && fileID < db.activeFile.FileID {
+			continue
 		}
 
-		if i == len(db.fileIDs)-1 {
-			db.activeFile.WriteOffset = offset
+		switch {
+		case db.activeFile == nil || fileID > db.activeFile.FileID:
+			// 写进程切换到了新的活跃文件
+			dataFile, err := db.openDataFile(db.dirPath, fileID, fio.ReadOnlyFileIO)
+			if err != nil {
+				return err
+			}
+			if db.activeFile != nil {
+				db.oldFiles[db.activeFile.FileID] = db.activeFile
+			}
+			db.activeFile = dataFile
+			db.fileIDs = append(db.fileIDs, fid)
+		case db.activeFile.WriteOffset == 0:
+			// 打开时文件可能还没有写入头部，重新打开读取头部
+			dataFile, err := db.openDataFile(db.dirPath, fileID, fio.ReadOnlyFileIO)
+			if err != nil {
+				return err
+			}
+			db.retireFiles([]*data.DataFile{db.activeFile})
+			db.activeFile = dataFile
 		}
-	}
 
-	db.seqNo = currentSeqNo
+		offset, err := db.loadIndexFromDataFile(db.activeFile, db.activeFile.WriteOffset, i == len(fileIDs)-1, db.txnRecords, now)
+		if err != nil {
+			return err
+		}
+		db.activeFile.WriteOffset = offset
+	}
 	return nil
 }
 
-func (db *DB) Close() error {
+func (db *DB) Close() (err error) {
+	// 先停止后台 merge，等待正在进行的 merge 完成
+	db.stopAutoMerge()
+	db.stopCheckpoint()
+
+	// 出错时只记录第一个错误，继续关闭剩下的文件，避免文件句柄泄露
+	setErr := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
 	defer func() {
-		// 释放文件锁
-		if err := db.fileLock.Unlock(); err != nil {
-			panic(fmt.Sprintf("failed to unlock the directory, %v", err))
+		// 释放文件锁，只读模式下没有加锁
+		if db.fileLock != nil {
+			if unlockErr := db.fileLock.Unlock(); unlockErr != nil {
+				setErr(fmt.Errorf("failed to unlock the directory: %w", unlockErr))
+			}
 		}
 
 		// 关闭索引
-		if err := db.indexer.Close(); err != nil {
-			panic("failed to close index")
+		if closeErr := db.indexer.Close(); closeErr != nil {
+			setErr(fmt.Errorf("failed to close index: %w", closeErr))
 		}
 	}()
 
@@ -494,34 +1003,89 @@ func (db *DB) Close() error {
 		return nil
 	}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	// 写入索引快照，下次启动时不需要重放所有的数据文件
+	setErr(db.Checkpoint())
 
-	// 保存当前事务序列号
-	if err := db.saveCurrentSeqNo(); err != nil {
-		return err
-	}
+	db.lock()
+	defer db.unlock()
 
-	//	关闭当前活跃文件g
-	if err := db.activeFile.Close(); err != nil {
-		return err
+	// 保存当前事务序列号，只读模式下不写入
+	if !db.readOnly {
+		setErr(db.saveCurrentSeqNo())
 	}
 
+	// 关闭当前活跃文件
+	setErr(db.activeFile.Close())
+
 	// 关闭旧的数据文件
 	for _, file := range db.oldFiles {
-		if err := file.Close(); err != nil {
-			return err
-		}
+		setErr(file.Close())
 	}
 
-	return nil
+	// 关闭 merge 之后被替换的数据文件
+	db.fileMu.Lock()
+	defer db.fileMu.Unlock()
+	for _, file := range db.retiredFiles {
+		_ = file.Close()
+	}
+	db.retiredFiles = nil
+
+	return err
+}
+
+// pinFiles 引用当前所有的数据文件，引用期间 merge 替换掉的文件不会被关闭，需要持有 db 的锁
+func (db *DB) pinFiles() map[uint32]*data.DataFile {
+	db.fileMu.Lock()
+	db.filePins++
+	db.fileMu.Unlock()
+
+	files := make(map[uint32]*data.DataFile, len(db.oldFiles)+1)
+	for fileID, dataFile := range db.oldFiles {
+		files[fileID] = dataFile
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileID] = db.activeFile
+	}
+	return files
+}
+
+// unpinFiles 释放对数据文件的引用，没有引用之后关闭被替换掉的数据文件
+func (db *DB) unpinFiles() {
+	db.fileMu.Lock()
+	defer db.fileMu.Unlock()
+
+	db.filePins--
+	if db.filePins > 0 {
+		return
+	}
+	for _, file := range db.retiredFiles {
+		_ = file.Close()
+	}
+	db.retiredFiles = nil
+}
+
+// retireFiles 关闭被 merge 替换掉的数据文件，如果仍有引用则延迟关闭
+func (db *DB) retireFiles(files []*data.DataFile) {
+	db.fileMu.Lock()
+	defer db.fileMu.Unlock()
+
+	if db.filePins > 0 {
+		db.retiredFiles = append(db.retiredFiles, files...)
+		return
+	}
+	for _, file := range files {
+		_ = file.Close()
+	}
 }
 
 func (db *DB) saveCurrentSeqNo() error {
-	seqNoFile, err := data.OpenSeqNoFile(db.dirPath)
+	seqNoFile, err := db.openFile(filepath.Join(db.dirPath, data.SeqNoFileName), 0, fio.StandardFileIO)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		_ = seqNoFile.Close()
+	}()
 	record := &data.LogRecord{
 		Key:   []byte(seqNoKey),
 		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
@@ -537,7 +1101,7 @@ func (db *DB) saveCurrentSeqNo() error {
 }
 
 func (db *DB) Sync() error {
-	if db.activeFile == nil {
+	if db.activeFile == nil || db.readOnly {
 		return nil
 	}
 	db.mu.Lock()
@@ -549,7 +1113,7 @@ func (db *DB) Sync() error {
 func (db *DB) Backup(dir string) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	return utils.CopyDir(db.dirPath, dir, []string{fileLockName})
+	return fio.CopyDir(db.fileSystem, db.dirPath, dir, []string{fileLockName, data.IndexSnapshotTempName})
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
@@ -560,8 +1124,11 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	info := db.indexer.Get(key)
-	if info == nil {
+	info, err := db.indexer.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.IsExpired(time.Now().UnixNano()) {
 		return nil, ErrKeyNotFound
 	}
 
@@ -569,25 +1136,110 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 }
 
 func (db *DB) Put(key []byte, val []byte) error {
+	return db.put(key, val, 0)
+}
+
+// PutWithTTL 写入数据并设置存活时间，超过 ttl 之后数据视为不存在
+func (db *DB) PutWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.put(key, val, time.Now().Add(ttl).UnixNano())
+}
+
+func (db *DB) put(key []byte, val []byte, expire int64) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
 
 	logRecord := &data.LogRecord{
-		Key:   logRecordKeyWithSeqNo(key, nonTransactionSeqNo),
-		Value: val,
-		Type:  data.LogRecordNormal,
+		Key:    logRecordKeyWithSeqNo(key, nonTransactionSeqNo),
+		Value:  val,
+		Type:   data.LogRecordNormal,
+		Expire: expire,
+	}
+
+	// 登记提交记录在更新索引之后完成，事务提交时会等待并行的索引更新完成，保证冲突检测的正确性
+	return db.commit([]*data.LogRecord{logRecord}, true, func(positions []*data.LogRecordPos) error {
+		staleInfo, err := db.putIndex(key, positions[0])
+		if err != nil {
+			return indexUpdateErr(err)
+		}
+		if staleInfo != nil {
+			db.markDead(staleInfo)
+		}
+		db.oracle.commit([][]byte{key})
+		return nil
+	})
+}
+
+// TTL 获取 key 剩余的存活时间，key 没有设置过期时间时返回 -1
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrKeyIsEmpty
 	}
 
-	info, err := db.appendLogRecordWithLock(logRecord)
+	now := time.Now().UnixNano()
+	info, err := db.indexer.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if info == nil || info.IsExpired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if info.Expire == 0 {
+		return -1, nil
+	}
+	return time.Duration(info.Expire - now), nil
+}
+
+// Expire 重新设置已经存在的 key 的存活时间，ttl 小于等于 0 时移除过期时间
+func (db *DB) Expire(key []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	db.lock()
+	defer db.unlock()
+
+	now := time.Now()
+	info, err := db.indexer.Get(key)
 	if err != nil {
 		return err
 	}
+	if info == nil || info.IsExpired(now.UnixNano()) {
+		return ErrKeyNotFound
+	}
 
-	if oldInfo := db.indexer.Put(key, info); oldInfo != nil {
-		db.reclaimSize += int64(oldInfo.Size)
+	value, err := db.getValueByIndexInfo(info)
+	if err != nil {
+		return err
 	}
 
+	logRecord := &data.LogRecord{
+		Key:   logRecordKeyWithSeqNo(key, nonTransactionSeqNo),
+		Value: value,
+		Type:  data.LogRecordNormal,
+	}
+	if ttl > 0 {
+		logRecord.Expire = now.Add(ttl).UnixNano()
+	}
+
+	pos, err := db.appendLogRecord(logRecord)
+	if err != nil {
+		return err
+	}
+	oldInfo, err := db.indexer.Put(key, pos)
+	if err != nil {
+		return indexUpdateErr(err)
+	}
+	if oldInfo != nil {
+		db.markDead(oldInfo)
+	}
+	db.oracle.commit([][]byte{key})
 	return nil
 }
 
@@ -595,38 +1247,56 @@ func (db *DB) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
-
-	if info := db.indexer.Get(key); info == nil {
-		return nil
+	if db.readOnly {
+		return ErrReadOnly
 	}
 
-	logRecord := &data.LogRecord{Key: logRecordKeyWithSeqNo(key, nonTransactionSeqNo), Type: data.LogRecordDeleted}
-	info, err := db.appendLogRecordWithLock(logRecord)
+	db.mu.RLock()
+	info, err := db.indexer.Get(key)
+	db.mu.RUnlock()
 	if err != nil {
 		return err
 	}
-	db.reclaimSize += int64(info.Size)
-
-	oldInfo, ok := db.indexer.Delete(key)
-	if !ok {
-		return ErrIndexUpdateFailed
-	}
-	if oldInfo != nil {
-		db.reclaimSize += int64(oldInfo.Size)
+	if info == nil {
+		return nil
 	}
 
-	return nil
+	logRecord := &data.LogRecord{Key: logRecordKeyWithSeqNo(key, nonTransactionSeqNo), Type: data.LogRecordDeleted}
+	// 删除需要等待并行的索引更新完成，避免更早的写入在删除之后才更新索引
+	return db.commit([]*data.LogRecord{logRecord}, false, func(positions []*data.LogRecordPos) error {
+		db.markDead(positions[0])
+
+		// 并发的删除可能已经删掉了 key
+		oldInfo, ok, err := db.indexer.Delete(key)
+		if err != nil {
+			return indexUpdateErr(err)
+		}
+		if ok && oldInfo != nil {
+			db.markDead(oldInfo)
+		}
+		db.oracle.commit([][]byte{key})
+		return nil
+	})
 }
 
 func (db *DB) ListKeys() ([][]byte, error) {
-	iterator := db.indexer.Iterator(false)
+	iterator, err := db.indexer.Iterator(false)
+	if err != nil {
+		return nil, err
+	}
 	defer iterator.Close()
-	keys := make([][]byte, db.indexer.Size())
+	size, err := db.indexer.Size()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, 0, size)
 
-	idx := 0
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 
 	return keys, nil
@@ -637,11 +1307,19 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	iterator := db.indexer.Iterator(false)
+	iterator, err := db.indexer.Iterator(false)
+	if err != nil {
+		return err
+	}
 	defer iterator.Close()
 
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		value, err := db.getValueByIndexInfo(iterator.Value())
+		pos := iterator.Value()
+		if pos.IsExpired(now) {
+			continue
+		}
+		value, err := db.getValueByIndexInfo(pos)
 		if err != nil {
 			return err
 		}
@@ -659,10 +1337,48 @@ func (db *DB) checkConfiguration() error {
 	if db.dataFileSize <= 0 {
 		return errors.New("error: database data file size must be greater than 0")
 	}
+	if db.dataFileMergeRatio < 0 || db.dataFileMergeRatio > 1 {
+		return errors.New("error: invalid merge ratio, must between 0 and 1")
+	}
+	if db.autoMergeInterval < 0 {
+		return errors.New("error: auto merge interval must not be negative")
+	}
+	if db.autoMergeWindowStart < 0 || db.autoMergeWindowStart >= 24*time.Hour ||
+		db.autoMergeWindowEnd < 0 || db.autoMergeWindowEnd >= 24*time.Hour {
+		return errors.New("error: auto merge window must be within a day")
+	}
+	if db.indexShardNum <= 0 {
+		return errors.New("error: index shard num must be greater than 0")
+	}
+	if db.checkpointInterval < 0 {
+		return errors.New("error: checkpoint interval must not be negative")
+	}
+	if !db.compression.IsValid() {
+		return errors.New("error: unknown compression type")
+	}
+	if db.compressionMinSize < 0 {
+		return errors.New("error: compression min size must not be negative")
+	}
+	if db.valueCacheSize < 0 {
+		return errors.New("error: value cache size must not be negative")
+	}
+	if db.fileSystem == nil {
+		return errors.New("error: file system must not be nil")
+	}
+	if _, ok := db.fileSystem.(*fio.MemFileSystem); ok && db.indexerType == BPlusTree {
+		return errors.New("error: B+ tree index can not be used with the in-memory file system")
+	}
 	return nil
 }
 
+// getValueByIndexInfo 根据索引信息读取 value，需要持有 db 的锁，保证读取和缓存期间不会被 merge 替换数据文件
 func (db *DB) getValueByIndexInfo(info *data.LogRecordPos) ([]byte, error) {
+	if db.valueCache != nil {
+		if value, ok := db.valueCache.get(info); ok {
+			return value, nil
+		}
+	}
+
 	var dataFile *data.DataFile
 
 	if db.activeFile.FileID == info.FileID {
@@ -671,6 +1387,18 @@ func (db *DB) getValueByIndexInfo(info *data.LogRecordPos) ([]byte, error) {
 		dataFile = db.oldFiles[info.FileID]
 	}
 
+	value, err := readValue(dataFile, info)
+	if err != nil {
+		return nil, err
+	}
+	if db.valueCache != nil {
+		db.valueCache.add(info, value)
+	}
+	return value, nil
+}
+
+// readValue 根据索引信息从数据文件中读取 value
+func readValue(dataFile *data.DataFile, info *data.LogRecordPos) ([]byte, error) {
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
@@ -687,29 +1415,29 @@ func (db *DB) getValueByIndexInfo(info *data.LogRecordPos) ([]byte, error) {
 	return logRecord.Value, nil
 }
 
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(logRecord)
+// encodeLogRecord 按照配置的压缩算法对数据进行编码
+func (db *DB) encodeLogRecord(logRecord *data.LogRecord) ([]byte, int64) {
+	return data.EncodeLogRecordWithCompression(logRecord, db.compression, db.compressionMinSize)
 }
 
 // 向activeFile追加写入数据
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
 	if db.activeFile == nil {
 		if err := db.updateActiveDataFile(); err != nil {
 			return nil, err
 		}
 	}
 
-	encodedRecord, size := data.EncodeLogRecord(logRecord)
-	if db.activeFile.WriteOffset+size > db.dataFileSize {
+	encodedRecord, size := db.encodeLogRecord(logRecord)
+	if db.activeFile.WriteOffset+db.activeFile.EncodedSize(size) > db.dataFileSize {
 		// 当前file大小不够，刷新到disk，创建新的文件
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.sealActiveFile(); err != nil {
 			return nil, err
 		}
 
-		db.oldFiles[db.activeFile.FileID] = db.activeFile
-
 		if err := db.updateActiveDataFile(); err != nil {
 			return nil, err
 		}
@@ -719,6 +1447,8 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 	if err := db.activeFile.Write(encodedRecord); err != nil {
 		return nil, err
 	}
+	// 加密之后写入的数据会变长
+	size = db.activeFile.WriteOffset - offset
 	db.bytesWrite += uint64(size)
 
 	if db.needSync() {
@@ -728,7 +1458,7 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		db.bytesWrite = 0
 	}
 
-	return &data.LogRecordPos{FileID: db.activeFile.FileID, Offset: offset, Size: uint32(size)}, nil
+	return &data.LogRecordPos{FileID: db.activeFile.FileID, Offset: offset, Size: uint32(size), Expire: logRecord.Expire}, nil
 }
 
 func (db *DB) needSync() bool {
@@ -746,10 +1476,14 @@ func (db *DB) updateActiveDataFile() error {
 		fileID = db.activeFile.FileID + 1
 	}
 
-	dataFile, err := data.OpenDataFile(db.dirPath, fileID, fio.StandardFileIO)
+	dataFile, err := db.openDataFile(db.dirPath, fileID, db.activeIOType())
 	if err != nil {
 		return err
 	}
+	if err := dataFile.Preallocate(db.dataFileSize); err != nil {
+		_ = dataFile.Close()
+		return err
+	}
 
 	db.activeFile = dataFile
 	return nil
@@ -1,16 +1,31 @@
 package bitcask
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"math/rand"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+	"github.com/ysoding/bitcask/utils"
 )
 
+// dbStat 获取数据库的统计信息
+func dbStat(t *testing.T, db *DB) *Stat {
+	stat, err := db.Stat()
+	assert.Nil(t, err)
+	return stat
+}
+
 func removeDB(db *DB) {
 	if db == nil {
 		return
@@ -120,6 +135,122 @@ func TestDB_Put(t *testing.T) {
 
 }
 
+func TestDB_PutWithTTL(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-ttl")
+	opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(64 * 1024 * 1024)}
+
+	db, err := Open(opts...)
+	defer removeDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.ttl 不合法
+	err = db.PutWithTTL(getTestKey(1), randomValue(24), 0)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	// 2.未过期的数据可以正常读取
+	val := randomValue(24)
+	err = db.PutWithTTL(getTestKey(1), val, time.Hour)
+	assert.Nil(t, err)
+	res, err := db.Get(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val, res)
+
+	// 3.过期之后的数据读取不到
+	err = db.PutWithTTL(getTestKey(2), randomValue(24), time.Millisecond*50)
+	assert.Nil(t, err)
+	err = db.Put(getTestKey(3), randomValue(24))
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 100)
+
+	_, err = db.Get(getTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	keys, err := db.ListKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+
+	var count int
+	err = db.Fold(func(key []byte, value []byte) bool {
+		assert.NotEqual(t, getTestKey(2), key)
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	// 4.重新 Put 之后不再过期
+	err = db.Put(getTestKey(2), val)
+	assert.Nil(t, err)
+	res, err = db.Get(getTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, val, res)
+
+	// 5.重启之后过期时间仍然有效
+	err = db.PutWithTTL(getTestKey(4), randomValue(24), time.Millisecond*50)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 100)
+
+	db2, err := Open(opts...)
+	assert.Nil(t, err)
+	_, err = db2.Get(getTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	res, err = db2.Get(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val, res)
+	assert.Equal(t, uint(3), dbStat(t, db2).KeyNum)
+}
+
+func TestDB_Expire(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-expire")
+	db, err := Open(WithDBDirPath(dir))
+	defer removeDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.key 不存在
+	_, err = db.TTL(getTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db.Expire(getTestKey(1), time.Second)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 2.没有设置过期时间
+	val := randomValue(24)
+	err = db.Put(getTestKey(1), val)
+	assert.Nil(t, err)
+	ttl, err := db.TTL(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	// 3.设置过期时间
+	err = db.Expire(getTestKey(1), time.Hour)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(getTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > time.Minute*59 && ttl <= time.Hour)
+	res, err := db.Get(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val, res)
+
+	// 4.移除过期时间
+	err = db.Expire(getTestKey(1), 0)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	// 5.过期之后
+	err = db.Expire(getTestKey(1), time.Millisecond*50)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 100)
+	_, err = db.TTL(getTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(getTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
 func TestDB_Get(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "bitcask-go-get")
 	opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(64 * 1024 * 1024)}
@@ -404,6 +535,729 @@ func TestDB_Stat(t *testing.T) {
 		assert.Nil(t, err)
 	}
 
-	stat := db.Stat()
+	stat := dbStat(t, db)
 	assert.NotNil(t, stat)
 }
+
+func TestDB_Compression(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	jsonValue := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"bitcask-go","tags":[%s]}`, i, strings.Repeat(`"kv","log",`, 20)))
+	}
+
+	// 先写入一部分未压缩的数据
+	sizeBefore, _ := utils.DirSize(dir)
+	db, err := Open(WithDBDirPath(dir))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), jsonValue(i)))
+	}
+	assert.Nil(t, db.Close())
+	sizeAfter, _ := utils.DirSize(dir)
+	uncompressedSize := sizeAfter - sizeBefore
+	sizeBefore = sizeAfter
+
+	for _, compression := range []CompressionType{SnappyCompression, ZstdCompression} {
+		db, err = Open(WithDBDirPath(dir), WithDBCompression(compression))
+		assert.Nil(t, err)
+		for i := 100; i < 200; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), jsonValue(i)))
+		}
+		// 小于最小长度的数据不压缩
+		assert.Nil(t, db.Put([]byte("small"), []byte("v")))
+		assert.Nil(t, db.Close())
+
+		// 同样数量的数据压缩之后占用的空间更少
+		sizeAfter, _ := utils.DirSize(dir)
+		assert.Less(t, sizeAfter-sizeBefore, uncompressedSize/2)
+		sizeBefore = sizeAfter
+	}
+
+	// 不开启压缩时依然可以读取压缩过的数据
+	db, err = Open(WithDBDirPath(dir))
+	defer removeDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), val)
+	}
+	val, err := db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v"), val)
+
+	_, err = Open(WithDBDirPath(dir), WithDBCompression(CompressionType(7)))
+	assert.NotNil(t, err)
+}
+
+func TestDB_Encryption(t *testing.T) {
+	for _, typ := range []IndexerType{BTree, BPlusTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+		secret := []byte("bitcask-go-secret")
+		key1 := []byte("0123456789abcdef0123456789abcdef")
+		key2 := []byte("fedcba9876543210")
+		opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024), WithDBIndexerType(typ),
+			WithDBDataFileMergeRatio(0)}
+
+		// 开启加密之前写入的数据
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put([]byte("plain"), secret))
+		assert.Nil(t, db.Close())
+
+		keys := data.NewStaticKeyProvider("k1", map[string][]byte{"k1": key1})
+		db, err = Open(append(opts, WithDBKeyProvider(keys))...)
+		assert.Nil(t, err)
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), append(secret, randomValue(64)...)))
+		}
+		wb := db.NewWriteBatch()
+		assert.Nil(t, wb.Put([]byte("txn"), secret))
+		assert.Nil(t, wb.Commit())
+		assert.Nil(t, db.Close())
+
+		// 没有密钥时无法打开
+		_, err = Open(opts...)
+		assert.Equal(t, data.ErrMissingKeyProvider, err)
+
+		// 轮换密钥，旧文件依然可读，merge 之后所有文件都使用新的密钥
+		keys = data.NewStaticKeyProvider("k2", map[string][]byte{"k1": key1, "k2": key2})
+		db, err = Open(append(opts, WithDBKeyProvider(keys))...)
+		assert.Nil(t, err)
+		for i := 0; i < 250; i++ {
+			assert.Nil(t, db.Delete(getTestKey(i)))
+		}
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+
+		// 只保留新的密钥
+		keys = data.NewStaticKeyProvider("k2", map[string][]byte{"k2": key2})
+		db, err = Open(append(opts, WithDBKeyProvider(keys))...)
+		assert.Nil(t, err)
+		val, err := db.Get([]byte("plain"))
+		assert.Nil(t, err)
+		assert.Equal(t, secret, val)
+		val, err = db.Get([]byte("txn"))
+		assert.Nil(t, err)
+		assert.Equal(t, secret, val)
+		for i := 0; i < 500; i++ {
+			_, err := db.Get(getTestKey(i))
+			if i < 250 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+		assert.Nil(t, db.Close())
+
+		// 数据文件、hint 文件以及事务序列号文件中都没有明文
+		entries, err := os.ReadDir(dir)
+		assert.Nil(t, err)
+		for _, entry := range entries {
+			if entry.Name() == "bptree-index" || entry.Name() == fileLockName {
+				continue
+			}
+			raw, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+			assert.Nil(t, err)
+			assert.False(t, bytes.Contains(raw, secret), entry.Name())
+			assert.False(t, bytes.Contains(raw, getTestKey(499)), entry.Name())
+		}
+
+		assert.Nil(t, os.RemoveAll(dir))
+	}
+}
+
+func TestDB_Open_TornWrite(t *testing.T) {
+	keys := data.NewStaticKeyProvider("k1", map[string][]byte{"k1": []byte("0123456789abcdef")})
+	for _, extra := range [][]DBOption{
+		{WithDBIndexerType(BTree)},
+		{WithDBIndexerType(BPlusTree)},
+		{WithDBIndexerType(BTree), WithDBKeyProvider(keys)},
+	} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-torn-write")
+		opts := append([]DBOption{WithDBDirPath(dir)}, extra...)
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		assert.Nil(t, db.Close())
+
+		// 模拟写入过程中崩溃，活跃文件末尾留下半条记录
+		fileName := data.GetDataFileName(dir, 0)
+		stat, err := os.Stat(fileName)
+		assert.Nil(t, err)
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn"), Value: randomValue(128)})
+		file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = file.Write(encRecord[:len(encRecord)/2])
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		statAfter, err := os.Stat(fileName)
+		assert.Nil(t, err)
+		assert.Equal(t, stat.Size(), statAfter.Size())
+		assert.Nil(t, db.Put([]byte("after"), []byte("recovery")))
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			_, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+		}
+		val, err := db.Get([]byte("after"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("recovery"), val)
+		removeDB(db)
+	}
+}
+
+func TestDB_Open_Corruption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-corruption")
+	opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 活跃文件中最后一条记录损坏
+	activeFileName := data.GetDataFileName(dir, uint32(db.activeFile.FileID))
+	content, err := os.ReadFile(activeFileName)
+	assert.Nil(t, err)
+	content[len(content)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(activeFileName, content, 0644))
+	// 索引快照覆盖的数据不会再读取，删除快照之后从头加载数据文件
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.IndexSnapshotFileName)))
+
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	_, err = db.Get(getTestKey(999))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(getTestKey(998))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// 旧数据文件中间的数据损坏
+	fileName := data.GetDataFileName(dir, 0)
+	content, err = os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[len(content)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.IndexSnapshotFileName)))
+
+	_, err = Open(opts...)
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+
+	db, err = Open(append(opts, WithDBTruncateCorruptedFiles(true))...)
+	defer removeDB(db)
+	assert.Nil(t, err)
+	_, err = db.Get(getTestKey(0))
+	assert.Nil(t, err)
+	_, err = db.Get(getTestKey(998))
+	assert.Nil(t, err)
+	stat := dbStat(t, db)
+	assert.Less(t, stat.DataFiles[0].Size, int64(len(content)))
+}
+
+func TestDB_Open_ZeroedRecords(t *testing.T) {
+	// B+ 树索引不从数据文件中加载，启动时只检查活跃文件
+	for _, indexerType := range []IndexerType{BTree, BPlusTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-zeroed")
+		opts := []DBOption{WithDBDirPath(dir), WithDBIndexerType(indexerType)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(16)))
+		}
+		start, err := db.indexer.Get(getTestKey(50))
+		assert.Nil(t, err)
+		end, err := db.indexer.Get(getTestKey(53))
+		assert.Nil(t, err)
+		writeOffset := db.activeFile.WriteOffset
+		assert.Nil(t, db.Close())
+
+		// 活跃文件中间的三条记录被清零
+		fileName := data.GetDataFileName(dir, 0)
+		content, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		headerSize := int64(len(content)) - writeOffset
+		clear(content[headerSize+start.Offset : headerSize+end.Offset])
+		assert.Nil(t, os.WriteFile(fileName, content, 0644))
+		if indexerType == BTree {
+			assert.Nil(t, os.Remove(filepath.Join(dir, data.IndexSnapshotFileName)))
+		}
+
+		// 之后的数据不会被当作预先分配的空间截断
+		_, err = Open(opts...)
+		assert.ErrorIs(t, err, data.ErrInvalidRecordHeader)
+		after, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		assert.Equal(t, content, after)
+
+		db, err = Open(append(opts, WithDBTruncateCorruptedFiles(true))...)
+		assert.Nil(t, err)
+		if indexerType == BTree {
+			_, err = db.Get(getTestKey(49))
+			assert.Nil(t, err)
+			_, err = db.Get(getTestKey(60))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		assert.Equal(t, start.Offset, db.activeFile.WriteOffset)
+		removeDB(db)
+	}
+}
+
+// dirFiles 目录中所有文件的大小以及修改时间
+func dirFiles(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	files := make(map[string]string)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		assert.Nil(t, err)
+		files[entry.Name()] = fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+	}
+	return files
+}
+
+func TestDB_ReadOnly(t *testing.T) {
+	for _, indexerType := range []IndexerType{BTree, BPlusTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-readonly")
+		writer, err := Open(WithDBDirPath(dir), WithDBIndexerType(indexerType), WithDBDataFileSize(32*1024))
+		assert.Nil(t, err)
+
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, writer.Put(getTestKey(i), randomValue(128)))
+		}
+
+		// 可以和写进程同时打开
+		reader, err := Open(WithDBDirPath(dir), WithDBIndexerType(indexerType), WithDBReadOnly(true))
+		assert.Nil(t, err)
+		keys, err := reader.ListKeys()
+		assert.Nil(t, err)
+		assert.Equal(t, 500, len(keys))
+
+		assert.Equal(t, ErrReadOnly, reader.Put(getTestKey(1), randomValue(10)))
+		assert.Equal(t, ErrReadOnly, reader.Delete(getTestKey(1)))
+		assert.Equal(t, ErrReadOnly, reader.Expire(getTestKey(1), time.Hour))
+		assert.Equal(t, ErrReadOnly, reader.Merge())
+		wb := reader.NewWriteBatch()
+		assert.Nil(t, wb.Put(getTestKey(1), randomValue(10)))
+		assert.Equal(t, ErrReadOnly, wb.Commit())
+
+		// 写进程追加的数据在 Refresh 之后可以读到，包括新创建的数据文件
+		for i := 500; i < 1000; i++ {
+			assert.Nil(t, writer.Put(getTestKey(i), randomValue(128)))
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, writer.Delete(getTestKey(i)))
+		}
+		wb = writer.NewWriteBatch()
+		for i := 1000; i < 1010; i++ {
+			assert.Nil(t, wb.Put(getTestKey(i), randomValue(128)))
+		}
+		assert.Nil(t, wb.Commit())
+
+		_, err = reader.Get(getTestKey(999))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, reader.Refresh())
+		keys, err = reader.ListKeys()
+		assert.Nil(t, err)
+		assert.Equal(t, 910, len(keys))
+		for _, i := range []int{100, 999, 1005} {
+			val, err := writer.Get(getTestKey(i))
+			assert.Nil(t, err)
+			readerVal, err := reader.Get(getTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, val, readerVal)
+		}
+		_, err = reader.Get(getTestKey(0))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Greater(t, dbStat(t, reader).DataFileNum, uint(1))
+
+		// 写进程写到一半的记录等到写完之后再读取
+		record, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   logRecordKeyWithSeqNo([]byte("partial-key"), nonTransactionSeqNo),
+			Value: []byte("partial-value"),
+		})
+		assert.Nil(t, writer.activeFile.Write(record[:len(record)/2]))
+		assert.Nil(t, reader.Refresh())
+		_, err = reader.Get([]byte("partial-key"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, writer.activeFile.Write(record[len(record)/2:]))
+		assert.Nil(t, reader.Refresh())
+		val, err := reader.Get([]byte("partial-key"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("partial-value"), val)
+
+		assert.Nil(t, reader.Close())
+		assert.Nil(t, writer.Close())
+
+		// 只读模式下不会修改目录中的任何文件
+		before := dirFiles(t, dir)
+		reader, err = Open(WithDBDirPath(dir), WithDBIndexerType(indexerType), WithDBReadOnly(true))
+		assert.Nil(t, err)
+		_, err = reader.Get(getTestKey(999))
+		assert.Nil(t, err)
+		assert.Nil(t, reader.Close())
+		assert.Equal(t, before, dirFiles(t, dir))
+
+		assert.Nil(t, os.RemoveAll(dir))
+	}
+}
+
+func TestDB_ReadOnly_EmptyDir(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly")
+	defer os.RemoveAll(dir)
+
+	// 目录不存在时不会创建
+	_, err := Open(WithDBDirPath(filepath.Join(dir, "missing")), WithDBReadOnly(true))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+
+	reader, err := Open(WithDBDirPath(dir), WithDBReadOnly(true))
+	assert.Nil(t, err)
+	writer, err := Open(WithDBDirPath(dir))
+	assert.Nil(t, err)
+
+	assert.Nil(t, writer.Put(getTestKey(1), []byte("value")))
+	assert.Nil(t, reader.Refresh())
+	val, err := reader.Get(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	assert.Nil(t, reader.Close())
+	assert.Nil(t, writer.Close())
+}
+
+func TestDB_MemFileSystem(t *testing.T) {
+	memFS := fio.NewMemFileSystem()
+	dir := filepath.Join(os.TempDir(), "bitcask-go-mem")
+	opts := []DBOption{WithDBDirPath(dir), WithDBFileSystem(memFS), WithDBDataFileSize(32 * 1024), WithDBDataFileMergeRatio(0)}
+
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+	_, err = Open(opts...)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+	wb := db.NewWriteBatch()
+	for i := 1000; i < 1010; i++ {
+		assert.Nil(t, wb.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Merge())
+	for i := 300; i < 400; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+	assert.Nil(t, db.Merge(WithMergeTopN(1)))
+	assert.Greater(t, dbStat(t, db).DiskSize, int64(0))
+
+	backupDir := dir + "-backup"
+	assert.Nil(t, db.Backup(backupDir))
+	assert.Nil(t, db.Close())
+
+	// 磁盘上没有创建任何文件
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	for _, path := range []string{dir, backupDir} {
+		db, err = Open(append(opts, WithDBDirPath(path))...)
+		assert.Nil(t, err)
+		keys, err := db.ListKeys()
+		assert.Nil(t, err)
+		assert.Equal(t, 610, len(keys))
+		_, err = db.Get(getTestKey(1005))
+		assert.Nil(t, err)
+		_, err = db.Get(getTestKey(0))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, db.Close())
+	}
+
+	_, err = Open(WithDBDirPath(dir), WithDBFileSystem(memFS), WithDBIndexerType(BPlusTree))
+	assert.NotNil(t, err)
+}
+
+// countingIO 统计写入的数据量
+type countingIO struct {
+	fio.IOManager
+	written *atomic.Int64
+}
+
+func (c countingIO) Write(buf []byte) (int, error) {
+	n, err := c.IOManager.Write(buf)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestDB_FileSystemFactories(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-factories")
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	// 替换内置的 StandardFileIO，数据文件的写入都经过自定义的 IOManager
+	var written atomic.Int64
+	fileSystem := fio.OSFileSystem{Factories: map[fio.IOType]fio.Factory{
+		fio.StandardFileIO: func(filename string) (fio.IOManager, error) {
+			ioManager, err := fio.NewFileIOManager(filename)
+			if err != nil {
+				return nil, err
+			}
+			return countingIO{IOManager: ioManager, written: &written}, nil
+		},
+	}}
+
+	db, err := Open(WithDBDirPath(dir), WithDBFileSystem(fileSystem))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Greater(t, written.Load(), int64(100*128))
+	_, err = db.Get(getTestKey(99))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(WithDBDirPath(dir), WithDBFileSystem(fileSystem))
+	assert.Nil(t, err)
+	_, err = db.Get(getTestKey(99))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_MmapActiveFile(t *testing.T) {
+	for _, indexerType := range []IndexerType{BTree, BPlusTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-mmap-active")
+		dataFileSize := int64(32 * 1024)
+		opts := []DBOption{WithDBDirPath(dir), WithDBIndexerType(indexerType), WithDBDataFileSize(dataFileSize),
+			WithDBMmapActiveFile(true)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		// 迭代器在活跃文件切换之后依然可以读取，B+ 树的迭代器持有读事务，不能同时写入
+		var iter *Iterator
+		if indexerType != BPlusTree {
+			iter, err = db.NewIterator()
+			assert.Nil(t, err)
+		}
+		for i := 500; i < 1000; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		if iter != nil {
+			count := 0
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				_, err := iter.Value()
+				assert.Nil(t, err)
+				count++
+			}
+			assert.Equal(t, 500, count)
+			iter.Close()
+		}
+		assert.Greater(t, len(db.oldFiles), 1)
+
+		// 活跃文件预先分配了空间
+		activeFileName := data.GetDataFileName(dir, db.activeFile.FileID)
+		stat, err := os.Stat(activeFileName)
+		assert.Nil(t, err)
+		assert.GreaterOrEqual(t, stat.Size(), dataFileSize)
+
+		// 模拟崩溃，复制的活跃文件末尾是预先分配的空间，并且留下了半条记录
+		assert.Nil(t, db.Sync())
+		crashDir := dir + "-crash"
+		assert.Nil(t, fio.CopyDir(fio.OSFileSystem{}, dir, crashDir, []string{fileLockName}))
+		written, err := db.activeFile.IoManager.Size()
+		assert.Nil(t, err)
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn"), Value: randomValue(128)})
+		crashFile, err := os.OpenFile(filepath.Join(crashDir, filepath.Base(activeFileName)), os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = crashFile.WriteAt(encRecord[:len(encRecord)/2], written)
+		assert.Nil(t, err)
+		assert.Nil(t, crashFile.Close())
+
+		// 关闭时截断到写入的数据长度
+		assert.Nil(t, db.Close())
+		stat, err = os.Stat(activeFileName)
+		assert.Nil(t, err)
+		assert.Equal(t, written, stat.Size())
+		for _, file := range db.oldFiles {
+			stat, err := os.Stat(data.GetDataFileName(dir, file.FileID))
+			assert.Nil(t, err)
+			assert.Less(t, stat.Size(), dataFileSize+1024)
+		}
+
+		for _, path := range []string{dir, crashDir} {
+			db, err = Open(append(opts, WithDBDirPath(path))...)
+			assert.Nil(t, err)
+			for i := 0; i < 1000; i++ {
+				_, err := db.Get(getTestKey(i))
+				assert.Nil(t, err)
+			}
+			_, err = db.Get([]byte("torn"))
+			assert.Equal(t, ErrKeyNotFound, err)
+			assert.Nil(t, db.Put([]byte("after"), []byte("reopen")))
+			assert.Nil(t, db.Close())
+
+			db, err = Open(append(opts, WithDBDirPath(path), WithDBMmapActiveFile(false))...)
+			assert.Nil(t, err)
+			val, err := db.Get([]byte("after"))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("reopen"), val)
+			removeDB(db)
+		}
+	}
+}
+
+func TestDB_GroupCommit(t *testing.T) {
+	keys := data.NewStaticKeyProvider("k1", map[string][]byte{"k1": []byte("0123456789abcdef")})
+	for _, extra := range [][]DBOption{
+		{},
+		{WithDBKeyProvider(keys)},
+		{WithDBGroupCommit(false)},
+	} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+		opts := append([]DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024), WithDBSyncWrite(true)}, extra...)
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+
+		// randomValue 不能并发调用
+		value := randomValue(128)
+		var wg sync.WaitGroup
+		for w := 0; w < 64; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := w * 20; i < (w+1)*20; i++ {
+					assert.Nil(t, db.Put(getTestKey(i), value))
+					// 同一个 key 的多次写入，索引指向最后一次
+					assert.Nil(t, db.Put(getTestKey(i), []byte(fmt.Sprintf("value-%d", i))))
+					if i%5 == 0 {
+						assert.Nil(t, db.Delete(getTestKey(i)))
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		assert.Greater(t, len(db.oldFiles), 1)
+
+		check := func(db *DB) {
+			for i := 0; i < 64*20; i++ {
+				val, err := db.Get(getTestKey(i))
+				if i%5 == 0 {
+					assert.Equal(t, ErrKeyNotFound, err)
+					continue
+				}
+				assert.Nil(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("value-%d", i)), val)
+			}
+		}
+		check(db)
+		stat := dbStat(t, db)
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		check(db)
+		assert.Equal(t, stat.ReclaimableSize, dbStat(t, db).ReclaimableSize)
+		removeDB(db)
+	}
+}
+
+func TestDB_IndexError(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-error")
+	defer os.RemoveAll(dir)
+
+	_, err := Open(WithDBDirPath(dir), WithDBIndexerType(IndexerType(100)))
+	assert.NotNil(t, err)
+
+	db, err := Open(WithDBDirPath(dir), WithDBIndexerType(BPlusTree))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(getTestKey(1), randomValue(10)))
+
+	// 索引出错时返回错误，不会导致进程退出
+	assert.Nil(t, db.indexer.Close())
+	err = db.Put(getTestKey(2), randomValue(10))
+	assert.ErrorIs(t, err, ErrIndexUpdateFailed)
+	_, err = db.Get(getTestKey(1))
+	assert.NotNil(t, err)
+	assert.NotNil(t, db.Delete(getTestKey(1)))
+	_, err = db.NewIterator()
+	assert.NotNil(t, err)
+	_, err = db.ListKeys()
+	assert.NotNil(t, err)
+	_, err = db.Stat()
+	assert.NotNil(t, err)
+	_ = db.Close()
+}
+
+func TestDB_ShardedIndex(t *testing.T) {
+	for _, syncWrite := range []bool{false, true} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-sharded-index")
+		opts := []DBOption{WithDBDirPath(dir), WithDBIndexerType(ShardedBTree), WithDBIndexShardNum(8),
+			WithDBDataFileSize(32 * 1024), WithDBSyncWrite(syncWrite)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+
+		// 多个写入者并发写入相同的 key，索引指向最后一次写入
+		var wg sync.WaitGroup
+		for w := 0; w < 16; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 200; i++ {
+					assert.Nil(t, db.Put(getTestKey(i), []byte(fmt.Sprintf("value-%d-%d", w, i))))
+				}
+			}(w)
+		}
+		wg.Wait()
+		values := make(map[string][]byte)
+		for i := 0; i < 200; i++ {
+			val, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+			values[string(getTestKey(i))] = val
+		}
+		for i := 0; i < 200; i += 10 {
+			assert.Nil(t, db.Delete(getTestKey(i)))
+			delete(values, string(getTestKey(i)))
+		}
+		// 每个 key 只有最后一次写入有效
+		assert.Equal(t, uint(180), dbStat(t, db).KeyNum)
+
+		check := func(db *DB) {
+			iter, err := db.NewIterator()
+			assert.Nil(t, err)
+			defer iter.Close()
+			var prev []byte
+			count := 0
+			for ; iter.Valid(); iter.Next() {
+				assert.True(t, bytes.Compare(prev, iter.Key()) < 0)
+				prev = iter.Key()
+				val, err := iter.Value()
+				assert.Nil(t, err)
+				assert.Equal(t, values[string(iter.Key())], val)
+				count++
+			}
+			assert.Equal(t, len(values), count)
+		}
+		check(db)
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		check(db)
+		removeDB(db)
+	}
+}
@@ -13,4 +13,11 @@ var (
 	ErrMergeIsProgress        = errors.New("merge is in progress, try again later")
 	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
 	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrInvalidTTL             = errors.New("ttl must be greater than 0")
+	ErrTxnConflict            = errors.New("transaction conflict, please retry")
+	ErrTxnDiscarded           = errors.New("transaction has been discarded")
+	ErrTxnReadOnly            = errors.New("transaction is read only")
+	ErrSnapshotReleased       = errors.New("snapshot has been released")
+	ErrReadOnly               = errors.New("database is opened in read only mode")
+	ErrIteratorKeyOnly        = errors.New("iterator is key only, value is not available")
 )
@@ -0,0 +1,271 @@
+package bitcask
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+)
+
+// openFaultDB 在内存文件系统上打开数据库，所有文件都经过故障注入
+func openFaultDB(t *testing.T, opts ...DBOption) (*DB, *fio.FaultFileSystem, []DBOption) {
+	memFS := fio.NewMemFileSystem()
+	faultFS := fio.NewFaultFileSystem(memFS)
+	dir := filepath.Join("/", "bitcask-go-fault")
+	opts = append([]DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024), WithDBDataFileMergeRatio(0)}, opts...)
+
+	db, err := Open(append(opts, WithDBFileSystem(faultFS))...)
+	assert.Nil(t, err)
+	// 重启时直接使用被包装的文件系统
+	return db, faultFS, append(opts, WithDBFileSystem(memFS))
+}
+
+func TestDB_Fault_Put(t *testing.T) {
+	db, faultFS, reopenOpts := openFaultDB(t)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+
+	// 磁盘空间不足，只写入了一部分数据
+	faultFS.Inject(fio.Fault{Op: fio.FaultWrite, Err: syscall.ENOSPC, Times: 1, ShortWrite: 10})
+	assert.Equal(t, syscall.ENOSPC, db.Put([]byte("enospc"), randomValue(128)))
+	_, err := db.Get([]byte("enospc"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 读取失败
+	faultFS.Inject(fio.Fault{Op: fio.FaultReadAt, Times: 1})
+	_, err = db.Get(getTestKey(0))
+	assert.Equal(t, fio.ErrInjectedFault, err)
+
+	// 读取到的 key 和 value 被破坏
+	faultFS.Inject(fio.Fault{Op: fio.FaultReadAt, FlipBit: true, Skip: 1, Times: 1})
+	_, err = db.Get(getTestKey(0))
+	assert.Equal(t, data.ErrInvalidCRC, err)
+
+	// 持久化失败
+	faultFS.Inject(fio.Fault{Op: fio.FaultSync, Err: syscall.EIO, Times: 1})
+	assert.Equal(t, syscall.EIO, db.Sync())
+
+	// 故障之后的写入不受影响
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = Open(reopenOpts...)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get([]byte("enospc"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Fault_WriteBatch(t *testing.T) {
+	db, faultFS, reopenOpts := openFaultDB(t)
+
+	// 事务写入到一半失败
+	wb := db.NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, wb.Put(getTestKey(i), randomValue(128)))
+	}
+	faultFS.Inject(fio.Fault{Op: fio.FaultWrite, Err: syscall.ENOSPC, Skip: 5, Times: 1, ShortWrite: 10})
+	assert.Equal(t, syscall.ENOSPC, wb.Commit())
+	for i := 0; i < 10; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	assert.Nil(t, db.Put([]byte("after"), []byte("batch")))
+	assert.Nil(t, db.Close())
+
+	// 重启之后没有完成的事务数据被丢弃
+	db, err := Open(reopenOpts...)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	val, err := db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch"), val)
+
+	// 重新提交
+	wb = db.NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, wb.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+
+	db, err = Open(reopenOpts...)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_Fault_Merge(t *testing.T) {
+	db, faultFS, reopenOpts := openFaultDB(t)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+
+	// 写入 merge 目录失败，没有完成的 merge 目录被删除，数据不受影响
+	mergePath := db.getMergePath()
+	faultFS.Inject(fio.Fault{
+		Op:    fio.FaultWrite,
+		Match: func(name string) bool { return strings.HasPrefix(name, mergePath) },
+		Err:   syscall.ENOSPC,
+		Skip:  100,
+		Times: 1,
+	})
+	assert.Equal(t, syscall.ENOSPC, db.Merge())
+	_, err := faultFS.Stat(mergePath)
+	assert.NotNil(t, err)
+	for i := 500; i < 1000; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	faultFS.Reset()
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	db, err = Open(reopenOpts...)
+	assert.Nil(t, err)
+	defer db.Close()
+	keys, err := db.ListKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(keys))
+}
+
+func TestDB_Fault_PowerCut(t *testing.T) {
+	for _, indexerType := range []IndexerType{BTree, ART} {
+		db, faultFS, reopenOpts := openFaultDB(t, WithDBIndexerType(indexerType))
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		wb := db.NewWriteBatch(WithWriteSyncWrites(true))
+		for i := 500; i < 510; i++ {
+			assert.Nil(t, wb.Put(getTestKey(i), randomValue(128)))
+		}
+		assert.Nil(t, wb.Commit())
+
+		// 没有持久化的数据在断电之后丢失
+		for i := 510; i < 600; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		assert.Nil(t, faultFS.PowerCut())
+		assert.Equal(t, fio.ErrPowerCut, db.Put(getTestKey(600), randomValue(128)))
+		_ = db.Close()
+
+		db, err := Open(reopenOpts...)
+		assert.Nil(t, err)
+		for i := 0; i < 510; i++ {
+			_, err := db.Get(getTestKey(i))
+			assert.Nil(t, err)
+		}
+		_, err = db.Get(getTestKey(599))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 重启之后可以继续写入
+		assert.Nil(t, db.Put(getTestKey(600), randomValue(128)))
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestDB_Fault_Close(t *testing.T) {
+	db, faultFS, reopenOpts := openFaultDB(t)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Greater(t, len(db.oldFiles), 0)
+
+	// 写入索引快照失败时依然关闭所有的数据文件，返回第一个错误
+	faultFS.Inject(fio.Fault{Op: fio.FaultWrite, Err: syscall.ENOSPC, Match: func(name string) bool {
+		return strings.HasSuffix(name, data.IndexSnapshotTempName)
+	}})
+	assert.Equal(t, syscall.ENOSPC, db.Close())
+	assert.Equal(t, fio.ErrFileClosed, db.activeFile.Sync())
+	for _, file := range db.oldFiles {
+		assert.Equal(t, fio.ErrFileClosed, file.Sync())
+	}
+
+	db, err := Open(reopenOpts...)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_Fault_GroupCommit(t *testing.T) {
+	db, faultFS, reopenOpts := openFaultDB(t, WithDBSyncWrite(true))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+
+	// 写入之后持久化失败，返回了错误的记录重启之后不能被加载
+	offset := db.activeFile.WriteOffset
+	faultFS.Inject(fio.Fault{Op: fio.FaultSync, Err: syscall.EIO, Times: 1})
+	assert.Equal(t, syscall.EIO, db.Put([]byte("sync-failed"), randomValue(128)))
+	assert.Equal(t, offset, db.activeFile.WriteOffset)
+
+	// 一组记录跨越两个数据文件，写入第二个文件时失败，第一个文件中已经写入的部分同样被丢弃
+	fileID, offset := db.activeFile.FileID, db.activeFile.WriteOffset
+	nextFileName := data.GetDataFileName(db.dirPath, fileID+1)
+	group := make([]*commitRequest, 300)
+	for i := range group {
+		group[i] = &commitRequest{
+			records: []*data.LogRecord{{
+				Key:   logRecordKeyWithSeqNo([]byte(fmt.Sprintf("group-%d", i)), nonTransactionSeqNo),
+				Value: randomValue(128),
+			}},
+			apply: func([]*data.LogRecordPos) error {
+				t.Error("apply called after a failed commit")
+				return nil
+			},
+		}
+	}
+	faultFS.Inject(fio.Fault{Op: fio.FaultWrite, Match: func(name string) bool { return name == nextFileName }, Err: syscall.ENOSPC, Skip: 1, Times: 1})
+	db.commitGroup(group)
+	for _, r := range group {
+		assert.Equal(t, syscall.ENOSPC, r.err)
+	}
+	assert.Equal(t, offset, db.oldFiles[fileID].WriteOffset)
+	assert.Equal(t, fileID+1, db.activeFile.FileID)
+	assert.Equal(t, int64(0), db.activeFile.WriteOffset)
+
+	// 故障之后的写入不受影响
+	for i := 100; i < 200; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err := Open(reopenOpts...)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 200; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get([]byte("sync-failed"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 0; i < len(group); i++ {
+		_, err = db.Get([]byte(fmt.Sprintf("group-%d", i)))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+}
@@ -0,0 +1,281 @@
+package fio
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+var (
+	ErrInjectedFault = errors.New("injected fault")
+	ErrPowerCut      = errors.New("power cut, file is not accessible")
+)
+
+// FaultOp 可以注入故障的 IOManager 操作，可以组合多个
+type FaultOp uint8
+
+const (
+	FaultWrite FaultOp = 1 << iota
+	FaultReadAt
+	FaultSync
+	FaultSize
+)
+
+// Fault 一条故障规则，匹配的操作按照规则返回错误或者破坏数据
+type Fault struct {
+	Op    FaultOp                // 触发故障的操作
+	Match func(name string) bool // 匹配文件名，为空时匹配所有文件
+	Err   error                  // 返回的错误，为空时返回 ErrInjectedFault
+	Skip  int                    // 跳过前 Skip 次匹配的操作之后开始触发
+	Times int                    // 最多触发的次数，0 表示不限制
+
+	// ShortWrite Write 只写入前 ShortWrite 个字节，然后返回错误
+	ShortWrite int
+	// FlipBit ReadAt 读取成功之后翻转读取到的数据中间的一个 bit，不返回错误
+	FlipBit bool
+}
+
+type faultState struct {
+	Fault
+	matched int
+	fired   int
+}
+
+// FaultFileSystem 包装其他的 FileSystem，向打开的文件注入故障，用于测试写入失败、磁盘损坏以及断电之后的恢复
+// 没有 Sync 的数据在 PowerCut 时丢弃
+type FaultFileSystem struct {
+	FileSystem
+
+	mu       sync.Mutex
+	faults   []*faultState
+	synced   map[string]int64 // 文件中已经持久化的数据长度
+	powerCut bool
+}
+
+// NewFaultFileSystem 包装 fileSystem，没有注入故障时所有操作直接转发
+func NewFaultFileSystem(fileSystem FileSystem) *FaultFileSystem {
+	return &FaultFileSystem{FileSystem: fileSystem, synced: make(map[string]int64)}
+}
+
+// Inject 添加一条故障规则，多条规则同时匹配时使用最先添加的规则
+func (f *FaultFileSystem) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &faultState{Fault: fault})
+}
+
+// Reset 清除所有的故障规则
+func (f *FaultFileSystem) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = nil
+}
+
+// PowerCut 模拟断电，所有文件截断到最近一次 Sync 时的长度，之后已经打开的文件的操作都返回 ErrPowerCut
+// 断电之后通过被包装的 FileSystem 重新打开数据库，模拟重启
+func (f *FaultFileSystem) PowerCut() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.powerCut = true
+	for name, size := range f.synced {
+		if _, err := f.FileSystem.Stat(name); os.IsNotExist(err) {
+			continue
+		}
+		ioManager, err := f.FileSystem.OpenFile(name, StandardFileIO)
+		if err != nil {
+			return err
+		}
+		current, err := ioManager.Size()
+		if err == nil && current > size {
+			err = ioManager.Truncate(size)
+		}
+		if closeErr := ioManager.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FaultFileSystem) OpenFile(name string, typ IOType) (IOManager, error) {
+	ioManager, err := f.FileSystem.OpenFile(name, typ)
+	if err != nil {
+		return nil, err
+	}
+	return f.Wrap(name, ioManager)
+}
+
+// Wrap 包装已经打开的 IOManager，可以在 Register 注册的 Factory 中使用
+func (f *FaultFileSystem) Wrap(name string, ioManager IOManager) (IOManager, error) {
+	size, err := ioManager.Size()
+	if err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// 打开之前已经存在的数据视为已经持久化
+	if synced, ok := f.synced[name]; !ok || synced > size {
+		f.synced[name] = size
+	}
+	return &FaultIO{fs: f, name: name, IOManager: ioManager}, nil
+}
+
+func (f *FaultFileSystem) Remove(name string) error {
+	if err := f.FileSystem.Remove(name); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	delete(f.synced, name)
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *FaultFileSystem) Rename(oldPath, newPath string) error {
+	if err := f.FileSystem.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if size, ok := f.synced[oldPath]; ok {
+		f.synced[newPath] = size
+		delete(f.synced, oldPath)
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *FaultFileSystem) Link(oldPath, newPath string) error {
+	if err := f.FileSystem.Link(oldPath, newPath); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if size, ok := f.synced[oldPath]; ok {
+		f.synced[newPath] = size
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// fault 查找 op 匹配的故障规则，返回为空表示不触发故障
+func (f *FaultFileSystem) fault(name string, op FaultOp) (*Fault, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.powerCut {
+		return nil, ErrPowerCut
+	}
+	for _, state := range f.faults {
+		if state.Op&op == 0 || state.Match != nil && !state.Match(name) {
+			continue
+		}
+		state.matched++
+		if state.matched <= state.Skip || state.Times > 0 && state.fired >= state.Times {
+			continue
+		}
+		state.fired++
+		return &state.Fault, nil
+	}
+	return nil, nil
+}
+
+// FaultIO 注入故障的 IOManager
+type FaultIO struct {
+	IOManager
+	fs   *FaultFileSystem
+	name string
+}
+
+func faultErr(fault *Fault) error {
+	if fault.Err != nil {
+		return fault.Err
+	}
+	return ErrInjectedFault
+}
+
+func (f *FaultIO) ReadAt(b []byte, offset int64) (int, error) {
+	fault, err := f.fs.fault(f.name, FaultReadAt)
+	if err != nil {
+		return 0, err
+	}
+	if fault != nil && !fault.FlipBit {
+		return 0, faultErr(fault)
+	}
+
+	n, err := f.IOManager.ReadAt(b, offset)
+	if fault != nil && n > 0 {
+		b[n/2] ^= 1
+	}
+	return n, err
+}
+
+func (f *FaultIO) Write(b []byte) (int, error) {
+	fault, err := f.fs.fault(f.name, FaultWrite)
+	if err != nil {
+		return 0, err
+	}
+	if fault == nil {
+		return f.IOManager.Write(b)
+	}
+
+	n := 0
+	if fault.ShortWrite > 0 {
+		if n, err = f.IOManager.Write(b[:min(fault.ShortWrite, len(b))]); err != nil {
+			return n, err
+		}
+	}
+	return n, faultErr(fault)
+}
+
+func (f *FaultIO) Size() (int64, error) {
+	fault, err := f.fs.fault(f.name, FaultSize)
+	if err != nil {
+		return 0, err
+	}
+	if fault != nil {
+		return 0, faultErr(fault)
+	}
+	return f.IOManager.Size()
+}
+
+func (f *FaultIO) Truncate(size int64) error {
+	if _, err := f.fs.fault(f.name, 0); err != nil {
+		return err
+	}
+	if err := f.IOManager.Truncate(size); err != nil {
+		return err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.synced[f.name] > size {
+		f.fs.synced[f.name] = size
+	}
+	return nil
+}
+
+func (f *FaultIO) Sync() error {
+	fault, err := f.fs.fault(f.name, FaultSync)
+	if err != nil {
+		return err
+	}
+	if fault != nil {
+		return faultErr(fault)
+	}
+
+	if err := f.IOManager.Sync(); err != nil {
+		return err
+	}
+	size, err := f.IOManager.Size()
+	if err != nil {
+		return err
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.fs.synced[f.name] = size
+	return nil
+}
@@ -0,0 +1,67 @@
+package fio
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultFileSystem(t *testing.T) {
+	memFS := NewMemFileSystem()
+	assert.Nil(t, memFS.MkdirAll("/bitcask"))
+	faultFS := NewFaultFileSystem(memFS)
+
+	ioManager, err := faultFS.OpenFile("/bitcask/a.data", StandardFileIO)
+	assert.Nil(t, err)
+	_, err = ioManager.Write([]byte("key-a"))
+	assert.Nil(t, err)
+
+	// 跳过第一次写入，之后写入一部分数据并返回 ENOSPC
+	faultFS.Inject(Fault{Op: FaultWrite, Err: syscall.ENOSPC, Skip: 1, Times: 1, ShortWrite: 2})
+	_, err = ioManager.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	n, err := ioManager.Write([]byte("key-c"))
+	assert.Equal(t, syscall.ENOSPC, err)
+	assert.Equal(t, 2, n)
+	_, err = ioManager.Write([]byte("key-d"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 17)
+	_, err = ioManager.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key-akey-bkekey-d", string(buf))
+
+	// 只匹配指定的文件
+	faultFS.Inject(Fault{Op: FaultSync | FaultSize, Match: func(name string) bool { return strings.HasSuffix(name, ".hint") }})
+	hint, err := faultFS.OpenFile("/bitcask/a.hint", StandardFileIO)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInjectedFault, hint.Sync())
+	_, err = hint.Size()
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Nil(t, ioManager.Sync())
+
+	faultFS.Inject(Fault{Op: FaultReadAt, FlipBit: true, Times: 1})
+	_, err = ioManager.ReadAt(buf[:5], 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "key-a", string(buf[:5]))
+	_, err = ioManager.ReadAt(buf[:5], 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "key-a", string(buf[:5]))
+
+	// 断电之后没有 Sync 的数据丢失
+	faultFS.Reset()
+	_, err = ioManager.Write([]byte("key-e"))
+	assert.Nil(t, err)
+	assert.Nil(t, faultFS.PowerCut())
+	_, err = ioManager.Write([]byte("key-f"))
+	assert.Equal(t, ErrPowerCut, err)
+	assert.Nil(t, ioManager.Close())
+
+	reopened, err := memFS.OpenFile("/bitcask/a.data", StandardFileIO)
+	assert.Nil(t, err)
+	size, err := reopened.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(17), size)
+}
@@ -15,6 +15,17 @@ func NewFileIOManager(filename string) (*FileIO, error) {
 	return &FileIO{fd: fd}, nil
 }
 
+// NewReadOnlyFileIOManager 以只读方式打开文件，文件不存在时返回错误
+// 文件大小每次都从文件系统获取，可以读到其他进程追加的数据
+func NewReadOnlyFileIOManager(filename string) (*FileIO, error) {
+	fd, err := os.OpenFile(filename, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileIO{fd: fd}, nil
+}
+
 func (f *FileIO) Read(buf []byte) (int, error) {
 	return f.fd.Read(buf)
 }
@@ -35,6 +46,10 @@ func (f *FileIO) Size() (int64, error) {
 	return stat.Size(), nil
 }
 
+func (f *FileIO) Truncate(size int64) error {
+	return f.fd.Truncate(size)
+}
+
 func (f *FileIO) Sync() error {
 	return f.fd.Sync()
 }
@@ -72,6 +72,28 @@ func TestFileIO_Read(t *testing.T) {
 	assert.Equal(t, []byte("key-b"), b2)
 }
 
+func TestFileIO_Truncate(t *testing.T) {
+	path := filepath.Join("/tmp", "a.data")
+	fio, err := NewFileIOManager(path)
+	defer destroyFile(path)
+	assert.Nil(t, err)
+
+	_, err = fio.Write([]byte("bitcask kv"))
+	assert.Nil(t, err)
+	assert.Nil(t, fio.Truncate(7))
+	size, err := fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), size)
+
+	// 截断之后继续追加写入
+	_, err = fio.Write([]byte("go"))
+	assert.Nil(t, err)
+	b := make([]byte, 9)
+	_, err = fio.ReadAt(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcaskgo"), b)
+}
+
 func TestFileIO_Sync(t *testing.T) {
 	path := filepath.Join("/tmp", "a.data")
 	fio, err := NewFileIOManager(path)
@@ -95,3 +117,39 @@ func TestFileIO_Close(t *testing.T) {
 	err = fio.Close()
 	assert.Nil(t, err)
 }
+
+func TestReadOnlyFileIO(t *testing.T) {
+	path := filepath.Join("/tmp", "a-readonly.data")
+
+	// 文件不存在时不会创建
+	_, err := NewReadOnlyFileIOManager(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	writer, err := NewFileIOManager(path)
+	defer destroyFile(path)
+	assert.Nil(t, err)
+	_, err = writer.Write([]byte("key-a"))
+	assert.Nil(t, err)
+
+	reader, err := NewIOManager(ReadOnlyFileIO, path)
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	_, err = reader.Write([]byte("key-b"))
+	assert.NotNil(t, err)
+
+	// 可以读到其他 fd 追加的数据
+	_, err = writer.Write([]byte("key-b"))
+	assert.Nil(t, err)
+	size, err := reader.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	buf := make([]byte, 5)
+	_, err = reader.ReadAt(buf, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), buf)
+	assert.Nil(t, writer.Close())
+}
@@ -0,0 +1,198 @@
+package fio
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/gofrs/flock"
+	"github.com/ysoding/bitcask/utils"
+)
+
+// FileSystem 数据目录所在的文件系统，数据库的文件以及目录操作都通过它完成
+// 自定义 IOManager 可以通过 OSFileSystem.Factories 注册或者替换 IOType，或者嵌入 OSFileSystem 并替换 OpenFile
+type FileSystem interface {
+	// OpenFile 打开文件，除了 ReadOnlyFileIO 之外，文件不存在时会创建文件
+	OpenFile(name string, typ IOType) (IOManager, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(path string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldPath, newPath string) error
+	Link(oldPath, newPath string) error
+	// SyncDir 持久化目录，保证目录中文件的创建、删除以及重命名在崩溃之后依然有效
+	SyncDir(path string) error
+	// TryLock 尝试获取文件的排他锁，已经被其他人持有时返回 false
+	TryLock(name string) (FileLock, bool, error)
+	// AvailableSize 剩余可用的空间大小
+	AvailableSize(dir string) (uint64, error)
+}
+
+// FileLock 通过 FileSystem.TryLock 获取的锁
+type FileLock interface {
+	Unlock() error
+}
+
+// OSFileSystem 操作系统的文件系统
+type OSFileSystem struct {
+	// Factories 自定义 IOType 的 IOManager 创建方法，只对每个实例生效
+	// 注册内置的类型时会替换内置的实现，例如替换 StandardFileIO 之后数据库的数据文件都通过它读写
+	// 自定义的类型建议从较大的值开始，避免和之后新增的内置类型冲突
+	Factories map[IOType]Factory
+}
+
+func (fs OSFileSystem) OpenFile(name string, typ IOType) (IOManager, error) {
+	if factory, ok := fs.Factories[typ]; ok {
+		return factory(name)
+	}
+	return NewIOManager(typ, name)
+}
+
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFileSystem) MkdirAll(path string) error {
+	return os.MkdirAll(path, os.ModePerm)
+}
+
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFileSystem) Rename(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func (OSFileSystem) Link(oldPath, newPath string) error {
+	return os.Link(oldPath, newPath)
+}
+
+func (OSFileSystem) SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+func (OSFileSystem) TryLock(name string) (FileLock, bool, error) {
+	fileLock := flock.New(name)
+	locked, err := fileLock.TryLock()
+	if err != nil || !locked {
+		return nil, false, err
+	}
+	return fileLock, true, nil
+}
+
+func (OSFileSystem) AvailableSize(string) (uint64, error) {
+	return utils.AvailableDiskSize()
+}
+
+// DirSize 获取目录中所有文件的大小，包括子目录
+func DirSize(fileSystem FileSystem, dirPath string) (int64, error) {
+	entries, err := fileSystem.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, entry := range entries {
+		name := filepath.Join(dirPath, entry.Name())
+		if entry.IsDir() {
+			dirSize, err := DirSize(fileSystem, name)
+			if err != nil {
+				return 0, err
+			}
+			size += dirSize
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// CopyDir 拷贝目录中的文件到 dest 中，名字匹配 exclude 的文件不拷贝
+func CopyDir(fileSystem FileSystem, src, dest string, exclude []string) error {
+	if err := fileSystem.MkdirAll(dest); err != nil {
+		return err
+	}
+	entries, err := fileSystem.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		excluded := false
+		for _, e := range exclude {
+			matched, err := filepath.Match(e, entry.Name())
+			if err != nil {
+				return err
+			}
+			excluded = excluded || matched
+		}
+		if excluded {
+			continue
+		}
+
+		srcName, destName := filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())
+		if entry.IsDir() {
+			if err := CopyDir(fileSystem, srcName, destName, exclude); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := copyFile(fileSystem, srcName, destName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(fileSystem FileSystem, src, dest string) error {
+	srcFile, err := fileSystem.OpenFile(src, ReadOnlyFileIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+	size, err := srcFile.Size()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := srcFile.ReadAt(buf, 0); err != nil {
+		return err
+	}
+
+	// 目标文件已经存在时覆盖
+	if err := fileSystem.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	destFile, err := fileSystem.OpenFile(dest, StandardFileIO)
+	if err != nil {
+		return err
+	}
+	if _, err := destFile.Write(buf); err != nil {
+		_ = destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
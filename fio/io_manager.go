@@ -1,30 +1,48 @@
 package fio
 
+import "errors"
+
 type IOType byte
 
 const (
 	StandardFileIO IOType = iota
 	MemoryMap
+	// ReadOnlyFileIO 以只读方式打开已经存在的文件，不会创建文件，写入返回错误
+	ReadOnlyFileIO
+	// ReadWriteMemoryMap 可读写的内存文件映射，用于活跃文件
+	ReadWriteMemoryMap
 )
 
 const DataFilePerm = 0644
 
+var (
+	ErrUnsupportedIOType = errors.New("unsupported io type")
+	ErrReadOnlyIOManager = errors.New("io manager is read only")
+)
+
 type IOManager interface {
 	ReadAt(buf []byte, offset int64) (int, error)
 	Write(buf []byte) (int, error)
 	Size() (int64, error)
+	Truncate(size int64) error // 将文件截断到指定的长度
 	Sync() error
 	Close() error
 }
 
+// Factory 根据文件名创建 IOManager，用于 OSFileSystem 中自定义的 IOType
+type Factory func(filename string) (IOManager, error)
+
 func NewIOManager(typ IOType, filename string) (IOManager, error) {
 	switch typ {
 	case StandardFileIO:
 		return NewFileIOManager(filename)
 	case MemoryMap:
 		return NewMMapIOManager(filename)
+	case ReadOnlyFileIO:
+		return NewReadOnlyFileIOManager(filename)
+	case ReadWriteMemoryMap:
+		return NewMMapRWIOManager(filename)
 	default:
-		panic("unsupported io type")
+		return nil, ErrUnsupportedIOType
 	}
-
 }
@@ -0,0 +1,377 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrReadOnlyFile = errors.New("file is opened read only")
+	ErrFileClosed   = errors.New("file already closed")
+)
+
+// MemFileSystem 内存文件系统，数据只保存在内存中，用于测试
+// 文件被删除或者重命名之后，已经打开的 IOManager 依然可以读写原来的数据，与操作系统的行为一致
+type MemFileSystem struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]time.Time
+	locks map[string]struct{}
+}
+
+type memFile struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemFileSystem 创建一个空的内存文件系统，根目录已经存在
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		files: make(map[string]*memFile),
+		dirs:  map[string]time.Time{string(filepath.Separator): time.Now()},
+		locks: make(map[string]struct{}),
+	}
+}
+
+func memPathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// parentExists 父目录是否存在，需要持有锁
+func (m *MemFileSystem) parentExists(name string) bool {
+	_, ok := m.dirs[filepath.Dir(name)]
+	return ok
+}
+
+func (m *MemFileSystem) OpenFile(name string, typ IOType) (IOManager, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		if typ == ReadOnlyFileIO {
+			return nil, memPathError("open", name, fs.ErrNotExist)
+		}
+		if _, isDir := m.dirs[name]; isDir {
+			return nil, memPathError("open", name, syscall.EISDIR)
+		}
+		if !m.parentExists(name) {
+			return nil, memPathError("open", name, fs.ErrNotExist)
+		}
+		file = &memFile{modTime: time.Now()}
+		m.files[name] = file
+	}
+	return &MemIO{file: file, readOnly: typ == ReadOnlyFileIO}, nil
+}
+
+func (m *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if file, ok := m.files[name]; ok {
+		file.mu.RLock()
+		defer file.mu.RUnlock()
+		return &memFileInfo{name: filepath.Base(name), size: int64(len(file.data)), modTime: file.modTime}, nil
+	}
+	if modTime, ok := m.dirs[name]; ok {
+		return &memFileInfo{name: filepath.Base(name), dir: true, modTime: modTime}, nil
+	}
+	return nil, memPathError("stat", name, fs.ErrNotExist)
+}
+
+func (m *MemFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[name]; !ok {
+		return nil, memPathError("open", name, fs.ErrNotExist)
+	}
+
+	var entries []os.DirEntry
+	for fileName, file := range m.files {
+		if filepath.Dir(fileName) == name {
+			file.mu.RLock()
+			info := &memFileInfo{name: filepath.Base(fileName), size: int64(len(file.data)), modTime: file.modTime}
+			file.mu.RUnlock()
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+	}
+	for dirName, modTime := range m.dirs {
+		if dirName != name && filepath.Dir(dirName) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(&memFileInfo{name: filepath.Base(dirName), dir: true, modTime: modTime}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *MemFileSystem) MkdirAll(path string) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return memPathError("mkdir", dir, syscall.ENOTDIR)
+		}
+		if _, ok := m.dirs[dir]; ok {
+			break
+		}
+		m.dirs[dir] = time.Now()
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; ok {
+		if m.hasChildren(name) {
+			return memPathError("remove", name, syscall.ENOTEMPTY)
+		}
+		delete(m.dirs, name)
+		return nil
+	}
+	return memPathError("remove", name, fs.ErrNotExist)
+}
+
+// hasChildren 目录中是否有文件或者子目录，需要持有锁
+func (m *MemFileSystem) hasChildren(dir string) bool {
+	for fileName := range m.files {
+		if filepath.Dir(fileName) == dir {
+			return true
+		}
+	}
+	for dirName := range m.dirs {
+		if dirName != dir && filepath.Dir(dirName) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemFileSystem) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	for fileName := range m.files {
+		if fileName == path || strings.HasPrefix(fileName, prefix) {
+			delete(m.files, fileName)
+		}
+	}
+	for dirName := range m.dirs {
+		if dirName == path || strings.HasPrefix(dirName, prefix) {
+			delete(m.dirs, dirName)
+		}
+	}
+	return nil
+}
+
+// Rename 只支持文件
+func (m *MemFileSystem) Rename(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[oldPath]
+	if !ok {
+		return memPathError("rename", oldPath, fs.ErrNotExist)
+	}
+	if !m.parentExists(newPath) {
+		return memPathError("rename", newPath, fs.ErrNotExist)
+	}
+	delete(m.files, oldPath)
+	m.files[newPath] = file
+	return nil
+}
+
+func (m *MemFileSystem) Link(oldPath, newPath string) error {
+	oldPath, newPath = filepath.Clean(oldPath), filepath.Clean(newPath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[oldPath]
+	if !ok {
+		return memPathError("link", oldPath, fs.ErrNotExist)
+	}
+	if _, ok := m.files[newPath]; ok {
+		return memPathError("link", newPath, fs.ErrExist)
+	}
+	if !m.parentExists(newPath) {
+		return memPathError("link", newPath, fs.ErrNotExist)
+	}
+	m.files[newPath] = file
+	return nil
+}
+
+// TryLock 锁只在同一个 MemFileSystem 内有效，不会创建文件
+// SyncDir 内存中的数据不需要持久化，只检查目录是否存在
+func (m *MemFileSystem) SyncDir(path string) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[path]; !ok {
+		return memPathError("sync", path, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (m *MemFileSystem) TryLock(name string) (FileLock, bool, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.parentExists(name) {
+		return nil, false, memPathError("open", name, fs.ErrNotExist)
+	}
+	if _, ok := m.locks[name]; ok {
+		return nil, false, nil
+	}
+	m.locks[name] = struct{}{}
+	return &memLock{fs: m, name: name}, true, nil
+}
+
+func (m *MemFileSystem) AvailableSize(string) (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+type memLock struct {
+	fs   *MemFileSystem
+	name string
+}
+
+func (l *memLock) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	delete(l.fs.locks, l.name)
+	return nil
+}
+
+// MemIO 内存文件的 IOManager
+type MemIO struct {
+	file     *memFile
+	readOnly bool
+	closed   bool
+}
+
+func (m *MemIO) ReadAt(buf []byte, offset int64) (int, error) {
+	if m.closed {
+		return 0, ErrFileClosed
+	}
+	m.file.mu.RLock()
+	defer m.file.mu.RUnlock()
+
+	if offset >= int64(len(m.file.data)) {
+		if len(buf) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(buf, m.file.data[offset:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MemIO) Write(buf []byte) (int, error) {
+	if m.closed {
+		return 0, ErrFileClosed
+	}
+	if m.readOnly {
+		return 0, ErrReadOnlyFile
+	}
+	m.file.mu.Lock()
+	defer m.file.mu.Unlock()
+
+	m.file.data = append(m.file.data, buf...)
+	m.file.modTime = time.Now()
+	return len(buf), nil
+}
+
+func (m *MemIO) Size() (int64, error) {
+	if m.closed {
+		return 0, ErrFileClosed
+	}
+	m.file.mu.RLock()
+	defer m.file.mu.RUnlock()
+	return int64(len(m.file.data)), nil
+}
+
+func (m *MemIO) Truncate(size int64) error {
+	if m.closed {
+		return ErrFileClosed
+	}
+	if m.readOnly {
+		return ErrReadOnlyFile
+	}
+	m.file.mu.Lock()
+	defer m.file.mu.Unlock()
+
+	if size < int64(len(m.file.data)) {
+		m.file.data = m.file.data[:size:size]
+	} else {
+		m.file.data = append(m.file.data, make([]byte, size-int64(len(m.file.data)))...)
+	}
+	m.file.modTime = time.Now()
+	return nil
+}
+
+func (m *MemIO) Sync() error {
+	if m.closed {
+		return ErrFileClosed
+	}
+	return nil
+}
+
+func (m *MemIO) Close() error {
+	if m.closed {
+		return ErrFileClosed
+	}
+	m.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.dir }
+func (i *memFileInfo) Sys() any           { return nil }
+
+func (i *memFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | os.ModePerm
+	}
+	return DataFilePerm
+}
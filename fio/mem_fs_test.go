@@ -0,0 +1,165 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFileSystem_File(t *testing.T) {
+	memFS := NewMemFileSystem()
+
+	// 父目录不存在
+	_, err := memFS.OpenFile("/bitcask/a.data", StandardFileIO)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, memFS.MkdirAll("/bitcask"))
+
+	// 只读方式不会创建文件
+	_, err = memFS.OpenFile("/bitcask/a.data", ReadOnlyFileIO)
+	assert.True(t, os.IsNotExist(err))
+
+	writer, err := memFS.OpenFile("/bitcask/a.data", StandardFileIO)
+	assert.Nil(t, err)
+	_, err = writer.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	_, err = writer.Write([]byte("key-b"))
+	assert.Nil(t, err)
+
+	reader, err := memFS.OpenFile("/bitcask/a.data", ReadOnlyFileIO)
+	assert.Nil(t, err)
+	_, err = reader.Write([]byte("key-c"))
+	assert.Equal(t, ErrReadOnlyFile, err)
+	size, err := reader.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	buf := make([]byte, 5)
+	n, err := reader.ReadAt(buf, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-b"), buf)
+	n, err = reader.ReadAt(buf, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2, n)
+
+	assert.Nil(t, writer.Truncate(5))
+	size, err = reader.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+
+	assert.Nil(t, writer.Close())
+	assert.Equal(t, ErrFileClosed, writer.Close())
+	_, err = writer.Write([]byte("key-c"))
+	assert.Equal(t, ErrFileClosed, err)
+
+	// 删除之后已经打开的文件依然可以读取
+	assert.Nil(t, memFS.Remove("/bitcask/a.data"))
+	_, err = memFS.Stat("/bitcask/a.data")
+	assert.True(t, os.IsNotExist(err))
+	_, err = reader.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), buf)
+}
+
+func TestMemFileSystem_Dir(t *testing.T) {
+	memFS := NewMemFileSystem()
+	assert.Nil(t, memFS.MkdirAll("/bitcask/sub"))
+
+	for _, name := range []string{"/bitcask/b.data", "/bitcask/a.data"} {
+		file, err := memFS.OpenFile(name, StandardFileIO)
+		assert.Nil(t, err)
+		_, err = file.Write([]byte("value"))
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+	}
+
+	entries, err := memFS.ReadDir("/bitcask")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Equal(t, "a.data", entries[0].Name())
+	assert.Equal(t, "b.data", entries[1].Name())
+	assert.True(t, entries[2].IsDir())
+
+	size, err := DirSize(memFS, "/bitcask")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	assert.Nil(t, memFS.Rename("/bitcask/a.data", "/bitcask/sub/a.data"))
+	assert.Nil(t, memFS.Link("/bitcask/b.data", "/bitcask/sub/b.data"))
+	assert.NotNil(t, memFS.Link("/bitcask/b.data", "/bitcask/sub/b.data"))
+	info, err := memFS.Stat("/bitcask/sub/b.data")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	assert.NotNil(t, memFS.Remove("/bitcask/sub"))
+	assert.Nil(t, CopyDir(memFS, "/bitcask", "/backup", []string{"b.data"}))
+	// exclude 按照文件名匹配，子目录中的文件同样不拷贝
+	entries, err = memFS.ReadDir("/backup/sub")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	_, err = memFS.Stat("/backup/b.data")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, memFS.SyncDir("/bitcask/sub"))
+	assert.Nil(t, memFS.RemoveAll("/bitcask"))
+	_, err = memFS.Stat("/bitcask/sub/a.data")
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, os.IsNotExist(memFS.SyncDir("/bitcask/sub")))
+	_, err = memFS.Stat("/backup/sub/a.data")
+	assert.Nil(t, err)
+}
+
+func TestMemFileSystem_TryLock(t *testing.T) {
+	memFS := NewMemFileSystem()
+	assert.Nil(t, memFS.MkdirAll("/bitcask"))
+
+	lock, locked, err := memFS.TryLock("/bitcask/flock")
+	assert.Nil(t, err)
+	assert.True(t, locked)
+	_, locked, err = memFS.TryLock("/bitcask/flock")
+	assert.Nil(t, err)
+	assert.False(t, locked)
+
+	// 锁不会创建文件
+	_, err = memFS.Stat("/bitcask/flock")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, lock.Unlock())
+	_, locked, err = memFS.TryLock("/bitcask/flock")
+	assert.Nil(t, err)
+	assert.True(t, locked)
+}
+
+func TestOSFileSystem_Factories(t *testing.T) {
+	const customIO IOType = 100
+
+	_, err := OSFileSystem{}.OpenFile("/tmp/custom.data", customIO)
+	assert.Equal(t, ErrUnsupportedIOType, err)
+
+	memFS := NewMemFileSystem()
+	assert.Nil(t, memFS.MkdirAll("/tmp"))
+	factory := func(filename string) (IOManager, error) {
+		return memFS.OpenFile(filename, StandardFileIO)
+	}
+	fs := OSFileSystem{Factories: map[IOType]Factory{customIO: factory, StandardFileIO: factory}}
+	ioManager, err := fs.OpenFile("/tmp/custom.data", customIO)
+	assert.Nil(t, err)
+	assert.IsType(t, &MemIO{}, ioManager)
+
+	// 注册的内置类型替换内置的实现，没有注册的内置类型不受影响
+	ioManager, err = fs.OpenFile("/tmp/builtin.data", StandardFileIO)
+	assert.Nil(t, err)
+	assert.IsType(t, &MemIO{}, ioManager)
+	path := filepath.Join(t.TempDir(), "builtin.data")
+	ioManager, err = fs.OpenFile(path, MemoryMap)
+	assert.Nil(t, err)
+	assert.IsType(t, &MMap{}, ioManager)
+	assert.Nil(t, ioManager.Close())
+
+	// 其他实例不受影响
+	_, err = OSFileSystem{}.OpenFile("/tmp/custom.data", customIO)
+	assert.Equal(t, ErrUnsupportedIOType, err)
+}
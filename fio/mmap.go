@@ -6,7 +6,7 @@ import (
 	"golang.org/x/exp/mmap"
 )
 
-// MMap IO，内存文件映射
+// MMap IO，只读的内存文件映射，写入、截断以及持久化都返回 ErrReadOnlyIOManager
 type MMap struct {
 	readerAt *mmap.ReaderAt
 }
@@ -30,11 +30,15 @@ func (mmap *MMap) ReadAt(b []byte, offset int64) (int, error) {
 }
 
 func (mmap *MMap) Write([]byte) (int, error) {
-	panic("not implemented")
+	return 0, ErrReadOnlyIOManager
+}
+
+func (mmap *MMap) Truncate(int64) error {
+	return ErrReadOnlyIOManager
 }
 
 func (mmap *MMap) Sync() error {
-	panic("not implemented")
+	return ErrReadOnlyIOManager
 }
 
 func (mmap *MMap) Close() error {
@@ -0,0 +1,168 @@
+package fio
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapMinGrowSize 映射空间不够时至少扩展的大小
+const mmapMinGrowSize = 1 << 20
+
+// Preallocator 可以预先分配文件空间的 IOManager
+type Preallocator interface {
+	// Preallocate 将文件在磁盘上的大小扩展到 size，不影响 Size 返回的数据长度
+	Preallocate(size int64) error
+}
+
+// MMapRW 可读写的内存文件映射，写入直接拷贝到映射的内存中，读写都不需要系统调用
+// 文件在磁盘上的大小可能大于写入的数据长度，多出来的部分为 0，Close 时截断到写入的数据长度
+type MMapRW struct {
+	mu   sync.RWMutex
+	fd   *os.File
+	data []byte // 映射的内存，长度为文件在磁盘上的大小
+	size int64  // 已经写入的数据长度
+}
+
+// NewMMapRWIOManager 打开可读写的内存文件映射，文件不存在时创建文件
+func NewMMapRWIOManager(filename string) (*MMapRW, error) {
+	fd, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	m := &MMapRW{fd: fd, size: stat.Size()}
+	if err := m.remap(stat.Size()); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// remap 重新映射文件，size 为文件在磁盘上的大小，需要持有锁
+func (m *MMapRW) remap(size int64) error {
+	if m.data != nil {
+		if err := unix.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if size == 0 {
+		return nil
+	}
+
+	data, err := unix.Mmap(int(m.fd.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+// grow 扩展文件以及映射的空间到 size，需要持有锁
+func (m *MMapRW) grow(size int64) error {
+	if size <= int64(len(m.data)) {
+		return nil
+	}
+	if err := m.fd.Truncate(size); err != nil {
+		return err
+	}
+	return m.remap(size)
+}
+
+func (m *MMapRW) Preallocate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.grow(size)
+}
+
+func (m *MMapRW) ReadAt(b []byte, offset int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if offset >= m.size {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(b, m.data[offset:m.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MMapRW) Write(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	end := m.size + int64(len(b))
+	if end > int64(len(m.data)) {
+		// 成倍扩展，减少重新映射的次数
+		newSize := max(end, 2*int64(len(m.data)), mmapMinGrowSize)
+		if err := m.grow(newSize); err != nil {
+			return 0, err
+		}
+	}
+	copy(m.data[m.size:], b)
+	m.size = end
+	return len(b), nil
+}
+
+func (m *MMapRW) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size, nil
+}
+
+// Truncate 截断写入的数据，截掉的部分清零，保证崩溃之后重新打开时不会读到
+func (m *MMapRW) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size > m.size {
+		if err := m.grow(size); err != nil {
+			return err
+		}
+	} else {
+		clear(m.data[size:m.size])
+	}
+	m.size = size
+	return nil
+}
+
+func (m *MMapRW) Sync() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.data == nil {
+		return nil
+	}
+	return unix.Msync(m.data, unix.MS_SYNC)
+}
+
+// Close 解除映射，并将文件截断到写入的数据长度
+func (m *MMapRW) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.data != nil {
+		if err := unix.Munmap(m.data); err != nil {
+			return err
+		}
+		m.data = nil
+	}
+	if err := m.fd.Truncate(m.size); err != nil {
+		_ = m.fd.Close()
+		return err
+	}
+	return m.fd.Close()
+}
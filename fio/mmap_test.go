@@ -1,7 +1,9 @@
 package fio
 
 import (
+	"bytes"
 	"io"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -41,4 +43,64 @@ func TestMMap_Read(t *testing.T) {
 	n2, err := mmapIO2.ReadAt(b2, 0)
 	assert.Nil(t, err)
 	assert.Equal(t, 2, n2)
+
+	// 只读映射不支持修改，返回错误而不是 panic
+	_, err = mmapIO2.Write([]byte("dd"))
+	assert.Equal(t, ErrReadOnlyIOManager, err)
+	assert.Equal(t, ErrReadOnlyIOManager, mmapIO2.Truncate(2))
+	assert.Equal(t, ErrReadOnlyIOManager, mmapIO2.Sync())
+}
+
+func TestMMapRW(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-rw.data")
+	defer destroyFile(path)
+
+	mmapIO, err := NewMMapRWIOManager(path)
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO.Preallocate(4096))
+
+	// 预先分配的空间不计入数据长度
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4096), stat.Size())
+
+	_, err = mmapIO.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	// 超出预先分配的空间时扩展映射
+	_, err = mmapIO.Write(bytes.Repeat([]byte("b"), 8192))
+	assert.Nil(t, err)
+	size, err = mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5+8192), size)
+
+	b := make([]byte, 5)
+	n, err := mmapIO.ReadAt(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, []byte("key-a"), b)
+	_, err = mmapIO.ReadAt(b, size-2)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, mmapIO.Sync())
+
+	assert.Nil(t, mmapIO.Truncate(5))
+	_, err = mmapIO.ReadAt(b[:1], 5)
+	assert.Equal(t, io.EOF, err)
+
+	// 关闭时截断到写入的数据长度
+	assert.Nil(t, mmapIO.Close())
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), content)
+
+	mmapIO2, err := NewMMapRWIOManager(path)
+	assert.Nil(t, err)
+	_, err = mmapIO2.Write([]byte("c"))
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO2.Close())
+	content, err = os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-ac"), content)
 }
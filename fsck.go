@@ -0,0 +1,458 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+)
+
+// FsckIssueKind fsck 发现的问题类型
+type FsckIssueKind string
+
+const (
+	FsckBadFileHeader     FsckIssueKind = "bad-file-header"    // 文件头部无法解析或者版本不支持
+	FsckBadCRC            FsckIssueKind = "bad-crc"            // 记录的 crc 校验失败
+	FsckBadVarint         FsckIssueKind = "bad-varint"         // 记录 header 或者 key 中的变长编码无法解析
+	FsckTruncatedRecord   FsckIssueKind = "truncated-record"   // 文件末尾的记录不完整
+	FsckDecryptFailed     FsckIssueKind = "decrypt-failed"     // 记录无法解密
+	FsckOrphanedTxn       FsckIssueKind = "orphaned-txn"       // 事务的数据没有对应的事务完成标识
+	FsckHintPastEOF       FsckIssueKind = "hint-past-eof"      // hint 中的位置超出了数据文件的范围
+	FsckBadMetaFile       FsckIssueKind = "bad-meta-file"      // 事务序列号或者 merge 完成标识文件的内容不正确
+	FsckLeftoverMergeDir  FsckIssueKind = "leftover-merge-dir" // 没有安装的 merge 目录
+	FsckUnreadableSegment FsckIssueKind = "unreadable-segment" // 损坏的记录之后跳过的数据
+)
+
+// FsckIssue fsck 发现的问题
+type FsckIssue struct {
+	Kind    FsckIssueKind
+	File    string // 所在的文件，相对于数据目录
+	Offset  int64  // 问题在文件中的位置，不包含文件头部，-1 表示与位置无关
+	Message string
+}
+
+func (issue FsckIssue) String() string {
+	if issue.Offset < 0 {
+		return fmt.Sprintf("%s: %s: %s", issue.File, issue.Kind, issue.Message)
+	}
+	return fmt.Sprintf("%s@%d: %s: %s", issue.File, issue.Offset, issue.Kind, issue.Message)
+}
+
+// FsckReport fsck 的检查结果
+type FsckReport struct {
+	Files           int   // 检查的文件数量
+	Records         int64 // 可以正常读取的记录数量
+	SalvagedRecords int64 // repair 时写入到新目录的记录数量
+	Issues          []FsckIssue
+}
+
+// Fsck 离线检查数据目录中的数据文件、hint 文件、事务序列号文件以及 merge 完成标识文件，数据库需要处于关闭状态
+// 加密的数据目录需要传入 keys，不会修改目录中的任何文件
+func Fsck(dirPath string, keys KeyProvider, opts ...FsckOption) (*FsckReport, error) {
+	fsckOpt := DefaultFsckOption
+	for _, opt := range opts {
+		opt(&fsckOpt)
+	}
+	return fsck(fsckOpt.fileSystem, dirPath, keys, nil)
+}
+
+// FsckRepair 检查数据目录，并把所有可以读取的数据写入到新的目录 destPath 中，没有完成的事务会被丢弃
+// destPath 不能已经存在数据，新目录使用 keys 的当前密钥加密
+func FsckRepair(dirPath, destPath string, keys KeyProvider, opts ...FsckOption) (*FsckReport, error) {
+	fsckOpt := DefaultFsckOption
+	for _, opt := range opts {
+		opt(&fsckOpt)
+	}
+	if entries, err := fsckOpt.fileSystem.ReadDir(destPath); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("repair destination %s is not empty", destPath)
+	}
+
+	var dbOpts []DBOption
+	dbOpts = append(dbOpts, WithDBDirPath(destPath), WithDBFileSystem(fsckOpt.fileSystem))
+	if keys != nil {
+		dbOpts = append(dbOpts, WithDBKeyProvider(keys))
+	}
+	destDB, err := Open(dbOpts...)
+	if err != nil {
+		return nil, err
+	}
+	destDB.rawLog = true
+
+	report, err := fsck(fsckOpt.fileSystem, dirPath, keys, destDB)
+	if closeErr := destDB.Close(); err == nil {
+		err = closeErr
+	}
+	return report, err
+}
+
+const (
+	// fsckMaxSkipBytes 损坏的记录之后最多逐字节查找这么多数据，超过时放弃文件剩余的部分
+	fsckMaxSkipBytes = 1 << 20
+	// fsckZeroRecordPrefix 一条记录开头最多可能为 0 的字节数，即 crc 以及类型
+	fsckZeroRecordPrefix = 5
+)
+
+type fscker struct {
+	fileSystem fio.FileSystem
+	dirPath    string
+	keys       KeyProvider
+	destDB     *DB // repair 时写入的新数据库
+	report     *FsckReport
+	maxSeq     uint64
+	maxSkip    int64 // 损坏的记录之后最多跳过的数据量
+}
+
+func fsck(fileSystem fio.FileSystem, dirPath string, keys KeyProvider, destDB *DB) (*FsckReport, error) {
+	fileLock, locked, err := fileSystem.TryLock(filepath.Join(dirPath, fileLockName))
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	f := &fscker{fileSystem: fileSystem, dirPath: dirPath, keys: keys, destDB: destDB, report: &FsckReport{}, maxSkip: fsckMaxSkipBytes}
+	if err := f.checkDataFiles(); err != nil {
+		return nil, err
+	}
+	if err := f.checkHintFiles(); err != nil {
+		return nil, err
+	}
+	if err := f.checkMetaFiles(); err != nil {
+		return nil, err
+	}
+	f.checkMergeDir()
+
+	if destDB != nil && f.maxSeq > destDB.seqNo {
+		destDB.seqNo = f.maxSeq
+	}
+	return f.report, nil
+}
+
+func (f *fscker) addIssue(kind FsckIssueKind, file string, offset int64, format string, args ...any) {
+	f.report.Issues = append(f.report.Issues, FsckIssue{
+		Kind:    kind,
+		File:    file,
+		Offset:  offset,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// openFile 以只读的方式打开已有的文件，空文件返回 nil
+func (f *fscker) openFile(name string, fileID uint32) (*data.DataFile, error) {
+	fileName := filepath.Join(f.dirPath, name)
+	stat, err := f.fileSystem.Stat(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	f.report.Files++
+	if stat.Size() == 0 {
+		return nil, nil
+	}
+
+	dataFile, err := f.openDataFile(fileName, fileID)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidFileHeader) || errors.Is(err, data.ErrUnsupportedVersion) ||
+			errors.Is(err, data.ErrLegacyFormat) || errors.Is(err, data.ErrMissingKeyProvider) {
+			f.addIssue(FsckBadFileHeader, name, -1, "%v", err)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return dataFile, nil
+}
+
+// openDataFile 通过文件系统以只读方式打开已有的文件
+func (f *fscker) openDataFile(fileName string, fileID uint32) (*data.DataFile, error) {
+	ioManager, err := f.fileSystem.OpenFile(fileName, fio.ReadOnlyFileIO)
+	if err != nil {
+		return nil, err
+	}
+	return data.NewDataFile(ioManager, fileID, fio.ReadOnlyFileIO, f.keys)
+}
+
+// scanFile 遍历文件中所有可以读取的记录，遇到损坏的记录时逐字节向后查找下一条可以读取的记录
+// 查找超过 maxSkip 字节时放弃文件剩余的部分，全部作为无法读取的数据
+func (f *fscker) scanFile(name string, dataFile *data.DataFile, fn func(record *data.LogRecord, offset, size int64)) error {
+	fileSize, err := dataFile.Size()
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	badOffset := int64(-1) // 正在跳过的损坏数据的起始位置
+	for offset < fileSize {
+		record, size, err := dataFile.ReadLogRecord(offset)
+		if err == nil {
+			if badOffset >= 0 {
+				f.addIssue(FsckUnreadableSegment, name, badOffset, "skipped %d unreadable bytes", offset-badOffset)
+				badOffset = -1
+			}
+			f.report.Records++
+			fn(record, offset, size)
+			offset += size
+			continue
+		}
+		if err == io.EOF {
+			// 全零的 header 之后还有数据时说明中间的数据被清零，整段跳过
+			next, err := dataFile.SkipZeros(offset)
+			if err != nil {
+				return err
+			}
+			if next >= fileSize {
+				break
+			}
+			if badOffset < 0 {
+				badOffset = offset
+			}
+			// 记录开头的 crc 以及类型可能为 0，从第一个不为 0 的字节之前开始继续查找
+			offset = max(offset+1, next-fsckZeroRecordPrefix)
+			if offset-badOffset >= f.maxSkip {
+				break
+			}
+			continue
+		}
+
+		if badOffset < 0 {
+			switch err {
+			case data.ErrInvalidCRC:
+				f.addIssue(FsckBadCRC, name, offset, "crc mismatch")
+			case data.ErrInvalidRecordHeader:
+				f.addIssue(FsckBadVarint, name, offset, "cannot decode record header")
+			case io.ErrUnexpectedEOF:
+				f.addIssue(FsckTruncatedRecord, name, offset, "record extends past the end of file")
+			case data.ErrDecryptFailed:
+				f.addIssue(FsckDecryptFailed, name, offset, "%v", err)
+			default:
+				return err
+			}
+			badOffset = offset
+		}
+		offset++
+		if offset-badOffset >= f.maxSkip {
+			break
+		}
+	}
+
+	if badOffset >= 0 {
+		if offset < fileSize {
+			f.addIssue(FsckUnreadableSegment, name, badOffset, "skipped %d unreadable bytes, gave up after %d bytes without a readable record",
+				fileSize-badOffset, offset-badOffset)
+		} else {
+			f.addIssue(FsckUnreadableSegment, name, badOffset, "skipped %d unreadable bytes", fileSize-badOffset)
+		}
+	}
+	return nil
+}
+
+func (f *fscker) checkDataFiles() error {
+	fileIDs, err := getDataFileIDs(f.fileSystem, f.dirPath)
+	if err != nil {
+		return err
+	}
+
+	type txnRecord struct {
+		file   string
+		offset int64
+		record *data.LogRecord
+	}
+	// 暂存事务数据，事务可能跨越多个文件
+	txnRecords := make(map[uint64][]*txnRecord)
+
+	for _, fid := range fileIDs {
+		fileID := uint32(fid)
+		name := filepath.Base(data.GetDataFileName(f.dirPath, fileID))
+		dataFile, err := f.openFile(name, fileID)
+		if err != nil {
+			return err
+		}
+		if dataFile == nil {
+			continue
+		}
+
+		var writeErr error
+		err = f.scanFile(name, dataFile, func(record *data.LogRecord, offset, size int64) {
+			seqNo, n := binary.Uvarint(record.Key)
+			if n <= 0 {
+				f.addIssue(FsckBadVarint, name, offset, "cannot decode transaction sequence number in key")
+				return
+			}
+			if seqNo > f.maxSeq {
+				f.maxSeq = seqNo
+			}
+
+			switch {
+			case seqNo == nonTransactionSeqNo:
+				writeErr = errors.Join(writeErr, f.salvage(record))
+			case record.Type == data.LogRecordTxnFinished:
+				for _, txn := range txnRecords[seqNo] {
+					writeErr = errors.Join(writeErr, f.salvage(txn.record))
+				}
+				writeErr = errors.Join(writeErr, f.salvage(record))
+				delete(txnRecords, seqNo)
+			default:
+				txnRecords[seqNo] = append(txnRecords[seqNo], &txnRecord{file: name, offset: offset, record: record})
+			}
+		})
+		_ = dataFile.Close()
+		if err != nil {
+			return err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+
+	seqNos := make([]uint64, 0, len(txnRecords))
+	for seqNo := range txnRecords {
+		seqNos = append(seqNos, seqNo)
+	}
+	sort.Slice(seqNos, func(i, j int) bool { return seqNos[i] < seqNos[j] })
+	for _, seqNo := range seqNos {
+		first := txnRecords[seqNo][0]
+		f.addIssue(FsckOrphanedTxn, first.file, first.offset,
+			"transaction %d has %d records without a finished marker", seqNo, len(txnRecords[seqNo]))
+	}
+	return nil
+}
+
+// salvage repair 时把可以读取的记录写入到新的数据库中
+func (f *fscker) salvage(record *data.LogRecord) error {
+	if f.destDB == nil {
+		return nil
+	}
+	if _, err := f.destDB.appendLogRecord(record); err != nil {
+		return err
+	}
+	f.report.SalvagedRecords++
+	return nil
+}
+
+func (f *fscker) checkHintFiles() error {
+	entries, err := f.fileSystem.ReadDir(f.dirPath)
+	if err != nil {
+		return err
+	}
+
+	dataSizes := make(map[uint32]int64)
+	dataSize := func(fileID uint32) (int64, bool) {
+		if size, ok := dataSizes[fileID]; ok {
+			return size, size >= 0
+		}
+		size := int64(-1)
+		if dataFile, err := f.openDataFile(data.GetDataFileName(f.dirPath, fileID), fileID); err == nil {
+			if size, err = dataFile.Size(); err != nil {
+				size = -1
+			}
+			_ = dataFile.Close()
+		}
+		dataSizes[fileID] = size
+		return size, size >= 0
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		var fileID uint32
+		switch {
+		case name == data.HintFileName:
+		case strings.HasSuffix(name, data.DataHintFileSuffix):
+			id, err := strconv.Atoi(strings.TrimSuffix(name, data.DataHintFileSuffix))
+			if err != nil {
+				continue
+			}
+			fileID = uint32(id)
+		default:
+			continue
+		}
+
+		hintFile, err := f.openFile(name, fileID)
+		if err != nil {
+			return err
+		}
+		if hintFile == nil {
+			continue
+		}
+		err = f.scanFile(name, hintFile, func(record *data.LogRecord, offset, size int64) {
+			// 单文件 hint 的第一条记录是数据文件的大小
+			if offset == 0 && string(record.Key) == dataHintSizeKey {
+				return
+			}
+			pos := data.DecodeLogRecordPos(record.Value)
+			size, ok := dataSize(pos.FileID)
+			if !ok {
+				f.addIssue(FsckHintPastEOF, name, offset, "key %q points to missing data file %d", record.Key, pos.FileID)
+			} else if pos.Offset+int64(pos.Size) > size {
+				f.addIssue(FsckHintPastEOF, name, offset, "key %q points to %d+%d past the end of data file %d (size %d)",
+					record.Key, pos.Offset, pos.Size, pos.FileID, size)
+			}
+		})
+		_ = hintFile.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMetaFiles 检查事务序列号文件以及 merge 完成标识文件
+func (f *fscker) checkMetaFiles() error {
+	for _, meta := range []struct {
+		name string
+		key  string
+	}{
+		{data.SeqNoFileName, seqNoKey},
+		{data.MergeFinishedFileName, mergeFinishedKey},
+	} {
+		metaFile, err := f.openFile(meta.name, 0)
+		if err != nil {
+			return err
+		}
+		if metaFile == nil {
+			continue
+		}
+
+		var records []*data.LogRecord
+		err = f.scanFile(meta.name, metaFile, func(record *data.LogRecord, offset, size int64) {
+			records = append(records, record)
+		})
+		_ = metaFile.Close()
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if string(records[0].Key) != meta.key {
+			f.addIssue(FsckBadMetaFile, meta.name, 0, "unexpected key %q", records[0].Key)
+		} else if _, err := strconv.ParseUint(string(records[0].Value), 10, 64); err != nil {
+			f.addIssue(FsckBadMetaFile, meta.name, 0, "invalid value %q", records[0].Value)
+		}
+	}
+	return nil
+}
+
+func (f *fscker) checkMergeDir() {
+	mergePath := getMergePath(f.dirPath)
+	if _, err := f.fileSystem.Stat(mergePath); err != nil {
+		return
+	}
+	if _, err := f.fileSystem.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); err == nil {
+		f.addIssue(FsckLeftoverMergeDir, filepath.Base(mergePath), -1, "finished merge has not been installed, it will be installed on next open")
+	} else {
+		f.addIssue(FsckLeftoverMergeDir, filepath.Base(mergePath), -1, "unfinished merge directory, it will be removed on next open")
+	}
+}
@@ -0,0 +1,259 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+)
+
+func fsckIssueKinds(report *FsckReport) map[FsckIssueKind]int {
+	kinds := make(map[FsckIssueKind]int)
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	return kinds
+}
+
+func TestFsck_Clean(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	db, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024), WithDBDataFileMergeRatio(0))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	wb := db.NewWriteBatch()
+	for i := 1000; i < 1010; i++ {
+		assert.Nil(t, wb.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Merge())
+
+	// 数据库打开时不能检查
+	_, err = Fsck(dir, nil)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	assert.Nil(t, db.Close())
+	report, err := Fsck(dir, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, report.Issues)
+	assert.Greater(t, report.Files, 1)
+	assert.GreaterOrEqual(t, report.Records, int64(1011))
+}
+
+func TestFsck_Repair(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024)}
+	db, err := Open(opts...)
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	wb := db.NewWriteBatch()
+	for i := 1000; i < 1010; i++ {
+		assert.Nil(t, wb.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, wb.Commit())
+	batchSeqNo := db.seqNo
+
+	// 没有事务完成标识的事务数据
+	_, err = db.appendLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeqNo([]byte("orphaned-key"), db.seqNo+100),
+		Value: randomValue(128),
+		Type:  data.LogRecordNormal,
+	})
+	assert.Nil(t, err)
+	activeFileID := db.activeFile.FileID
+	assert.Nil(t, db.Close())
+
+	// 第一个数据文件中间的记录损坏
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[len(content)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+
+	// 活跃文件末尾写入一半的记录
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{Key: logRecordKeyWithSeqNo([]byte("torn-key"), nonTransactionSeqNo), Value: randomValue(128)})
+	activeFile, err := os.OpenFile(data.GetDataFileName(dir, activeFileID), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = activeFile.Write(encRecord[:len(encRecord)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, activeFile.Close())
+
+	// hint 中的位置超出了数据文件的范围
+	hintFile, err := data.OpenHintFile(fio.OSFileSystem{}, dir, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, hintFile.WriteHintRecord([]byte("hint-key"), &data.LogRecordPos{FileID: 0, Offset: 1 << 30, Size: 100}))
+	assert.Nil(t, hintFile.Close())
+
+	// 没有完成的 merge 目录
+	assert.Nil(t, os.MkdirAll(getMergePath(dir), os.ModePerm))
+	defer os.RemoveAll(getMergePath(dir))
+
+	report, err := Fsck(dir, nil)
+	assert.Nil(t, err)
+	kinds := fsckIssueKinds(report)
+	assert.Equal(t, 1, kinds[FsckBadCRC])
+	assert.Equal(t, 1, kinds[FsckTruncatedRecord])
+	assert.Equal(t, 2, kinds[FsckUnreadableSegment])
+	assert.Equal(t, 1, kinds[FsckOrphanedTxn])
+	assert.Equal(t, 1, kinds[FsckHintPastEOF])
+	assert.Equal(t, 1, kinds[FsckLeftoverMergeDir])
+	assert.Equal(t, int64(0), report.SalvagedRecords)
+
+	// 检查不会修改原目录
+	after, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, content, after)
+
+	destDir := dir + "-repaired"
+	defer os.RemoveAll(destDir)
+	report, err = FsckRepair(dir, destDir, nil)
+	assert.Nil(t, err)
+	// 损坏的一条记录以及没有完成的事务被丢弃
+	assert.Equal(t, int64(999+10+1), report.SalvagedRecords)
+
+	_, err = FsckRepair(dir, destDir, nil)
+	assert.NotNil(t, err)
+
+	repaired, err := Open(WithDBDirPath(destDir))
+	assert.Nil(t, err)
+	defer repaired.Close()
+	keys, err := repaired.ListKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 999+10, len(keys))
+	for i := 1000; i < 1010; i++ {
+		_, err := repaired.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = repaired.Get([]byte("orphaned-key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, batchSeqNo, repaired.seqNo)
+}
+
+func TestFsck_FileSystem(t *testing.T) {
+	memFS := fio.NewMemFileSystem()
+	db, err := Open(WithDBDirPath("/bitcask"), WithDBFileSystem(memFS), WithDBDataFileSize(32*1024))
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 目录不在磁盘上
+	_, err = Fsck("/bitcask", nil)
+	assert.NotNil(t, err)
+
+	report, err := Fsck("/bitcask", nil, WithFsckFileSystem(memFS))
+	assert.Nil(t, err)
+	assert.Empty(t, report.Issues)
+	assert.Greater(t, report.Files, 1)
+	assert.GreaterOrEqual(t, report.Records, int64(500))
+
+	report, err = FsckRepair("/bitcask", "/bitcask-repaired", nil, WithFsckFileSystem(memFS))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(500), report.SalvagedRecords)
+
+	repaired, err := Open(WithDBDirPath("/bitcask-repaired"), WithDBFileSystem(memFS))
+	assert.Nil(t, err)
+	defer repaired.Close()
+	value, err := repaired.Get(getTestKey(10))
+	assert.Nil(t, err)
+	assert.NotNil(t, value)
+}
+
+func TestFsck_MaxSkip(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	defer os.RemoveAll(dir)
+	db, err := Open(WithDBDirPath(dir))
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 文件中间 4KB 的数据损坏
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	for i := 0; i < 4096; i++ {
+		content[len(content)/4+i] ^= 0xff
+	}
+	assert.Nil(t, os.WriteFile(fileName, content, 0644))
+
+	scan := func(maxSkip int64) *FsckReport {
+		f := &fscker{fileSystem: fio.OSFileSystem{}, dirPath: dir, report: &FsckReport{}, maxSkip: maxSkip}
+		name := filepath.Base(fileName)
+		dataFile, err := f.openFile(name, 0)
+		assert.Nil(t, err)
+		defer dataFile.Close()
+		assert.Nil(t, f.scanFile(name, dataFile, func(record *data.LogRecord, offset, size int64) {}))
+		return f.report
+	}
+
+	// 越过损坏的数据之后继续读取
+	report := scan(fsckMaxSkipBytes)
+	assert.Equal(t, 1, fsckIssueKinds(report)[FsckUnreadableSegment])
+	assert.Greater(t, report.Records, int64(150))
+
+	// 查找超过上限时放弃文件剩余的部分
+	report = scan(1024)
+	kinds := fsckIssueKinds(report)
+	assert.Equal(t, 1, kinds[FsckUnreadableSegment])
+	assert.Less(t, report.Records, int64(100))
+	last := report.Issues[len(report.Issues)-1]
+	assert.Equal(t, FsckUnreadableSegment, last.Kind)
+	assert.Contains(t, last.Message, "gave up after 1024 bytes")
+}
+
+func TestFsck_ZeroedSegment(t *testing.T) {
+	for _, shift := range []int64{0, 7} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+		db, err := Open(WithDBDirPath(dir))
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(16)))
+		}
+		pos, err := db.indexer.Get(getTestKey(10))
+		assert.Nil(t, err)
+		writeOffset := db.activeFile.WriteOffset
+		assert.Nil(t, db.Close())
+
+		// 从一条记录的开头或者中间开始清零 200 字节
+		fileName := data.GetDataFileName(dir, 0)
+		content, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		start := int64(len(content)) - writeOffset + pos.Offset + shift
+		clear(content[start : start+200])
+		assert.Nil(t, os.WriteFile(fileName, content, 0644))
+
+		report, err := Fsck(dir, nil)
+		assert.Nil(t, err)
+		kinds := fsckIssueKinds(report)
+		assert.Equal(t, 1, kinds[FsckUnreadableSegment])
+		for _, issue := range report.Issues {
+			assert.NotContains(t, issue.Message, "gave up")
+		}
+		// 清零的数据之后的记录可以正常读取
+		assert.Greater(t, report.Records, int64(90))
+
+		destDir := dir + "-repaired"
+		report, err = FsckRepair(dir, destDir, nil)
+		assert.Nil(t, err)
+		assert.Greater(t, report.SalvagedRecords, int64(90))
+		repaired, err := Open(WithDBDirPath(destDir))
+		assert.Nil(t, err)
+		_, err = repaired.Get(getTestKey(99))
+		assert.Nil(t, err)
+		removeDB(repaired)
+		_ = os.RemoveAll(dir)
+	}
+}
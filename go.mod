@@ -4,11 +4,13 @@ go 1.22.3
 
 require (
 	github.com/gofrs/flock v0.12.1
+	github.com/golang/snappy v0.0.4
 	github.com/google/btree v1.1.3
-	github.com/plar/go-adaptive-radix-tree v1.0.5
+	github.com/klauspost/compress v1.17.9
 	github.com/stretchr/testify v1.9.0
 	go.etcd.io/bbolt v1.3.11
 	golang.org/x/exp v0.0.0-20240823005443-9b4947da3948
+	golang.org/x/sys v0.22.0
 )
 
 require (
@@ -16,6 +18,5 @@ require (
 	github.com/kr/text v0.2.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rogpeppe/go-internal v1.12.0 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -103,7 +103,11 @@ func handleStat(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	stat := db.Stat()
+	stat, err := db.Stat()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	writer.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(writer).Encode(stat)
 }
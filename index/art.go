@@ -4,142 +4,522 @@ import (
 	"bytes"
 	"sort"
 	"sync"
+	"sync/atomic"
 
-	goart "github.com/plar/go-adaptive-radix-tree"
 	"github.com/ysoding/bitcask/data"
 )
 
+// artGeneration 分配节点版本号，所有的树共用，保证不同的树以及快照的版本号不会重复
+var artGeneration atomic.Uint64
+
 // AdaptiveRadixTree 自适应基数树索引
-// 主要封装了 https://github.com/plar/go-adaptive-radix-tree 库
+// 节点带有版本号，只有版本号和树相同的节点可以直接修改。创建迭代器或者快照时树换成新的版本号，
+// 之前的节点被共享，之后的写入只复制从根节点到目标 key 的路径上的节点，被引用的节点不会再被修改
 type AdaptiveRadixTree struct {
-	tree goart.Tree
+	root *artNode
+	size int
+	gen  uint64 // 当前可以直接修改的节点的版本号
 	lock *sync.RWMutex
 }
 
 func NewART() *AdaptiveRadixTree {
-	return &AdaptiveRadixTree{tree: goart.New(), lock: new(sync.RWMutex)}
+	return &AdaptiveRadixTree{gen: artGeneration.Add(1), lock: new(sync.RWMutex)}
+}
+
+// artLeaf 叶子，保存完整的 key
+type artLeaf struct {
+	key   []byte
+	value *data.LogRecordPos
+}
+
+// artNode 树的节点，prefix 为压缩之后的路径，leaf 为正好在这个节点结束的 key
+// 子节点不超过 48 个时按照对应的字节有序存储在 keys 和 children 中，容量依次为 4、16、48，
+// 更多时 children 的长度为 256，按照字节直接索引
+type artNode struct {
+	gen      uint64
+	prefix   []byte
+	leaf     *artLeaf
+	keys     []byte
+	children []*artNode
+	num      int // 子节点的数量
+}
+
+const (
+	artNode48Size  = 48
+	artNode256Size = 256
+)
+
+func (n *artNode) isNode256() bool {
+	return len(n.children) == artNode256Size
+}
+
+// lowerBound 返回第一个对应的字节大于等于 b 的子节点的位置，以及这个子节点是否正好对应 b
+// node256 中位置就是 b，对应的子节点可能为空
+func (n *artNode) lowerBound(b byte) (int, bool) {
+	if n.isNode256() {
+		return int(b), n.children[b] != nil
+	}
+	pos := sort.Search(len(n.keys), func(i int) bool { return n.keys[i] >= b })
+	return pos, pos < len(n.keys) && n.keys[pos] == b
+}
+
+func (n *artNode) findChild(b byte) *artNode {
+	if pos, ok := n.lowerBound(b); ok {
+		return n.children[pos]
+	}
+	return nil
+}
+
+// writable 返回可以直接修改的节点，版本号不同时复制一个新的节点
+func (n *artNode) writable(gen uint64) *artNode {
+	if n.gen == gen {
+		return n
+	}
+	cloned := *n
+	cloned.gen = gen
+	if n.keys != nil {
+		cloned.keys = make([]byte, len(n.keys), cap(n.keys))
+		copy(cloned.keys, n.keys)
+	}
+	if n.children != nil {
+		cloned.children = make([]*artNode, len(n.children), cap(n.children))
+		copy(cloned.children, n.children)
+	}
+	return &cloned
+}
+
+// setChild 设置字节 b 对应的子节点，child 为空时删除，容量不够时扩容，子节点较少时缩容
+func (n *artNode) setChild(b byte, child *artNode) {
+	pos, ok := n.lowerBound(b)
+	switch {
+	case ok && child != nil:
+		n.children[pos] = child
+	case ok:
+		n.num--
+		if n.isNode256() {
+			n.children[b] = nil
+		} else {
+			n.keys = append(n.keys[:pos], n.keys[pos+1:]...)
+			copy(n.children[pos:], n.children[pos+1:])
+			n.children[len(n.children)-1] = nil
+			n.children = n.children[:len(n.children)-1]
+		}
+		n.shrink()
+	case child != nil:
+		n.num++
+		if n.isNode256() {
+			n.children[b] = child
+			return
+		}
+		if len(n.keys) == artNode48Size {
+			n.toNode256()
+			n.children[b] = child
+			return
+		}
+		if len(n.keys) == cap(n.keys) {
+			n.resize(artGrowSize(cap(n.keys)))
+		}
+		n.keys = append(n.keys, 0)
+		copy(n.keys[pos+1:], n.keys[pos:])
+		n.keys[pos] = b
+		n.children = append(n.children, nil)
+		copy(n.children[pos+1:], n.children[pos:])
+		n.children[pos] = child
+	}
+}
+
+// resize 有序存储的子节点换成容量为 size 的数组
+func (n *artNode) resize(size int) {
+	keys := make([]byte, len(n.keys), size)
+	copy(keys, n.keys)
+	children := make([]*artNode, len(n.children), size)
+	copy(children, n.children)
+	n.keys, n.children = keys, children
+}
+
+func (n *artNode) toNode256() {
+	children := make([]*artNode, artNode256Size)
+	for i, b := range n.keys {
+		children[b] = n.children[i]
+	}
+	n.keys, n.children = nil, children
+}
+
+// shrink 子节点较少时换成更小的节点
+func (n *artNode) shrink() {
+	if n.isNode256() {
+		if n.num > artNode48Size-12 {
+			return
+		}
+		keys := make([]byte, 0, artNode48Size)
+		children := make([]*artNode, 0, artNode48Size)
+		for b, child := range n.children {
+			if child != nil {
+				keys = append(keys, byte(b))
+				children = append(children, child)
+			}
+		}
+		n.keys, n.children = keys, children
+		return
+	}
+	switch {
+	case cap(n.keys) == artNode48Size && len(n.keys) <= 12:
+		n.resize(16)
+	case cap(n.keys) == 16 && len(n.keys) <= 3:
+		n.resize(4)
+	}
+}
+
+// artGrowSize 有序存储的子节点扩容之后的容量，依次为 4、16、48
+func artGrowSize(size int) int {
+	switch {
+	case size < 4:
+		return 4
+	case size < 16:
+		return 16
+	default:
+		return artNode48Size
+	}
+}
+
+// compact 删除之后整理节点，没有数据的节点删除，没有 leaf 并且只有一个子节点时和子节点合并
+func (n *artNode) compact(gen uint64) *artNode {
+	if n.leaf != nil || n.num > 1 {
+		return n
+	}
+	if n.num == 0 {
+		return nil
+	}
+	var b byte
+	var child *artNode
+	for i, c := range n.children {
+		if c != nil {
+			child = c
+			if n.isNode256() {
+				b = byte(i)
+			} else {
+				b = n.keys[i]
+			}
+			break
+		}
+	}
+	prefix := make([]byte, 0, len(n.prefix)+1+len(child.prefix))
+	prefix = append(prefix, n.prefix...)
+	prefix = append(prefix, b)
+	prefix = append(prefix, child.prefix...)
+	child = child.writable(gen)
+	child.prefix = prefix
+	return child
+}
+
+func commonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// artInsert 在以 n 为根的子树中写入 leaf，depth 为 n 的 prefix 在 key 中的起始位置，返回新的子树根节点以及被替换的旧数据
+func artInsert(n *artNode, key []byte, depth int, leaf *artLeaf, gen uint64) (*artNode, *artLeaf) {
+	if n == nil {
+		return &artNode{gen: gen, prefix: key[depth:], leaf: leaf}, nil
+	}
+
+	p := commonPrefix(n.prefix, key[depth:])
+	if p < len(n.prefix) {
+		// key 在 prefix 的中间分叉，分裂出一个新的父节点
+		parent := &artNode{gen: gen, prefix: n.prefix[:p]}
+		edge := n.prefix[p]
+		child := n.writable(gen)
+		child.prefix = n.prefix[p+1:]
+		parent.setChild(edge, child)
+		if depth+p == len(key) {
+			parent.leaf = leaf
+		} else {
+			parent.setChild(key[depth+p], &artNode{gen: gen, prefix: key[depth+p+1:], leaf: leaf})
+		}
+		return parent, nil
+	}
+
+	n = n.writable(gen)
+	depth += p
+	if depth == len(key) {
+		old := n.leaf
+		n.leaf = leaf
+		return n, old
+	}
+	b := key[depth]
+	child, old := artInsert(n.findChild(b), key, depth+1, leaf, gen)
+	n.setChild(b, child)
+	return n, old
 }
 
-func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
+// artDelete 在以 n 为根的子树中删除 key，返回新的子树根节点以及被删除的数据，key 不存在时子树不变
+func artDelete(n *artNode, key []byte, depth int, gen uint64) (*artNode, *artLeaf) {
+	if n == nil || !bytes.HasPrefix(key[depth:], n.prefix) {
+		return n, nil
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf == nil {
+			return n, nil
+		}
+		old := n.leaf
+		n = n.writable(gen)
+		n.leaf = nil
+		return n.compact(gen), old
+	}
+
+	b := key[depth]
+	child, old := artDelete(n.findChild(b), key, depth+1, gen)
+	if old == nil {
+		return n, nil
+	}
+	n = n.writable(gen)
+	n.setChild(b, child)
+	return n.compact(gen), old
+}
+
+func (art *AdaptiveRadixTree) Get(key []byte) (*data.LogRecordPos, error) {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	value, found := art.tree.Search(key)
-	if !found {
-		return nil
+
+	n, depth := art.root, 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil, nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil, nil
+			}
+			return n.leaf.value, nil
+		}
+		n = n.findChild(key[depth])
+		depth++
 	}
-	return value.(*data.LogRecordPos)
+	return nil, nil
 }
 
-func (art *AdaptiveRadixTree) Put(key []byte, val *data.LogRecordPos) *data.LogRecordPos {
+func (art *AdaptiveRadixTree) Put(key []byte, val *data.LogRecordPos) (*data.LogRecordPos, error) {
 	art.lock.Lock()
-	oldValue, _ := art.tree.Insert(key, val)
-	art.lock.Unlock()
-	if oldValue == nil {
-		return nil
+	defer art.lock.Unlock()
+
+	var old *artLeaf
+	art.root, old = artInsert(art.root, key, 0, &artLeaf{key: key, value: val}, art.gen)
+	if old == nil {
+		art.size++
+		return nil, nil
 	}
-	return oldValue.(*data.LogRecordPos)
+	return old.value, nil
 }
 
-func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	art.lock.Lock()
-	oldValue, deleted := art.tree.Delete(key)
-	art.lock.Unlock()
-	if oldValue == nil {
-		return nil, false
+	defer art.lock.Unlock()
+
+	var old *artLeaf
+	art.root, old = artDelete(art.root, key, 0, art.gen)
+	if old == nil {
+		return nil, false, nil
 	}
-	return oldValue.(*data.LogRecordPos), deleted
+	art.size--
+	return old.value, true, nil
 }
 
-func (art *AdaptiveRadixTree) Size() int {
+func (art *AdaptiveRadixTree) Size() (int, error) {
 	art.lock.RLock()
-	size := art.tree.Size()
+	size := art.size
 	art.lock.RUnlock()
-	return size
+	return size, nil
 }
 
 func (art *AdaptiveRadixTree) Close() error {
 	return nil
 }
 
-func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.lock.RLock()
-	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+// share 共享当前所有的节点，之后的写入需要先复制，需要持有写锁
+func (art *AdaptiveRadixTree) share() *artNode {
+	art.gen = artGeneration.Add(1)
+	return art.root
 }
 
-type artIterator struct {
-	currIndex int
-	reverse   bool
-	values    []*Item
+func (art *AdaptiveRadixTree) Iterator(reverse bool) (Iterator, error) {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	return newARTIterator(art.share(), reverse), nil
 }
 
-func newARTIterator(tree goart.Tree, reverse bool) *artIterator {
-	index := 0
-	if reverse {
-		index = tree.Size() - 1
-	}
+func (art *AdaptiveRadixTree) Snapshot() (Indexer, error) {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	// 快照使用自己的版本号，两边的写入都不会修改共享的节点
+	return &AdaptiveRadixTree{root: art.share(), size: art.size, gen: artGeneration.Add(1), lock: new(sync.RWMutex)}, nil
+}
+
+// artFrame 迭代器在一个节点中的位置
+type artFrame struct {
+	node     *artNode
+	pos      int  // 下一个要访问的子节点的位置，反向遍历时递减
+	leafDone bool // 节点的 leaf 是否已经访问过或者需要跳过
+}
+
+// artIterator 遍历创建迭代器时的树，保存从根节点到当前位置的路径
+// 正向遍历时先访问节点的 leaf 再按照字节从小到大访问子节点，反向遍历时顺序相反
+type artIterator struct {
+	root    *artNode
+	reverse bool
+	stack   []artFrame
+	curr    *artLeaf // 当前位置，为空表示遍历结束
+}
 
-	values := make([]*Item, tree.Size())
+func newARTIterator(root *artNode, reverse bool) *artIterator {
+	iter := &artIterator{root: root, reverse: reverse}
+	iter.Rewind()
+	return iter
+}
 
-	tree.ForEach(func(node goart.Node) (cont bool) {
-		values[index] = &Item{
-			key:  node.Key(),
-			data: node.Value().(*data.LogRecordPos),
+// descend 进入节点 n，移动到 n 的子树中的第一个数据
+func (it *artIterator) descend(n *artNode) {
+	if it.reverse {
+		it.stack = append(it.stack, artFrame{node: n, pos: len(n.children) - 1})
+	} else {
+		it.stack = append(it.stack, artFrame{node: n, pos: 0, leafDone: true})
+		if n.leaf != nil {
+			it.curr = n.leaf
+			return
 		}
-		if reverse {
-			index--
+	}
+	it.next()
+}
+
+// next 从路径上最深的节点开始查找下一个没有访问过的数据
+func (it *artIterator) next() {
+	it.curr = nil
+	for len(it.stack) > 0 {
+		f := &it.stack[len(it.stack)-1]
+		if it.reverse {
+			for ; f.pos >= 0; f.pos-- {
+				if child := f.node.children[f.pos]; child != nil {
+					f.pos--
+					it.descend(child)
+					return
+				}
+			}
+			if !f.leafDone {
+				f.leafDone = true
+				if f.node.leaf != nil {
+					it.curr = f.node.leaf
+					return
+				}
+			}
 		} else {
-			index++
+			for ; f.pos < len(f.node.children); f.pos++ {
+				if child := f.node.children[f.pos]; child != nil {
+					f.pos++
+					it.descend(child)
+					return
+				}
+			}
 		}
-		return true
-	})
-
-	return &artIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+		it.stack = it.stack[:len(it.stack)-1]
 	}
 }
 
 // Rewind 重新回到迭代器的起点，即第一个数据
 func (it *artIterator) Rewind() {
-	it.currIndex = 0
+	it.stack = it.stack[:0]
+	it.curr = nil
+	if it.root != nil {
+		it.descend(it.root)
+	}
 }
 
 // Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+// 沿着 key 的路径向下查找，只访问路径上的节点
 func (it *artIterator) Seek(key []byte) {
-	if it.reverse {
-		it.currIndex = sort.Search(len(it.values), func(i int) bool {
-			return bytes.Compare(it.values[i].key, key) <= 0
-		})
-	} else {
-		it.currIndex = sort.Search(len(it.values), func(i int) bool {
-			return bytes.Compare(it.values[i].key, key) >= 0
-		})
+	it.stack = it.stack[:0]
+	it.curr = nil
+
+	n, depth := it.root, 0
+	for n != nil {
+		rest := key[depth:]
+		cmp := bytes.Compare(n.prefix, rest[:min(len(rest), len(n.prefix))])
+		if cmp == 0 && len(rest) < len(n.prefix) {
+			// key 在 prefix 的中间结束，子树中的 key 都更大
+			cmp = 1
+		}
+		if cmp != 0 {
+			// 子树中的 key 全部大于或者全部小于 key，要么整个子树都在遍历的范围内，要么整个跳过
+			if (cmp > 0) != it.reverse {
+				it.descend(n)
+			} else {
+				it.next()
+			}
+			return
+		}
+
+		depth += len(n.prefix)
+		if depth == len(key) {
+			// leaf 等于 key，子节点都大于 key
+			if it.reverse {
+				it.stack = append(it.stack, artFrame{node: n, pos: -1})
+				it.next()
+			} else {
+				it.descend(n)
+			}
+			return
+		}
+
+		// leaf 小于 key，正向遍历时跳过，反向遍历时在子节点之后访问
+		pos, ok := n.lowerBound(key[depth])
+		f := artFrame{node: n, leafDone: !it.reverse}
+		switch {
+		case it.reverse:
+			f.pos = pos - 1
+		case ok:
+			f.pos = pos + 1
+		default:
+			f.pos = pos
+		}
+		it.stack = append(it.stack, f)
+		if !ok {
+			it.next()
+			return
+		}
+		n = n.children[pos]
+		depth++
 	}
 }
 
 // Next 跳转到下一个 key
 func (it *artIterator) Next() {
-	it.currIndex += 1
+	if it.curr != nil {
+		it.next()
+	}
 }
 
 // Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
 func (it *artIterator) Valid() bool {
-	return it.currIndex < len(it.values)
+	return it.curr != nil
 }
 
 // Key 当前遍历位置的 Key 数据
 func (it *artIterator) Key() []byte {
-	return it.values[it.currIndex].key
+	return it.curr.key
 }
 
 // Value 当前遍历位置的 Value 数据
 func (it *artIterator) Value() *data.LogRecordPos {
-	return it.values[it.currIndex].data
+	return it.curr.value
 }
 
 // Close 关闭迭代器，释放相应资源
-func (it *artIterator) Close() {
-	it.values = nil
+func (it *artIterator) Close() error {
+	it.root = nil
+	it.stack = nil
+	it.curr = nil
+	return nil
 }
@@ -1,6 +1,8 @@
 package index
 
 import (
+	"fmt"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,14 +11,18 @@ import (
 
 func TestAdaptiveRadixTree_Put(t *testing.T) {
 	art := NewART()
-	res1 := art.Put([]byte("key-1"), &data.LogRecordPos{FileID: 1, Offset: 12})
+	res1, err := art.Put([]byte("key-1"), &data.LogRecordPos{FileID: 1, Offset: 12})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	res2 := art.Put([]byte("key-2"), &data.LogRecordPos{FileID: 1, Offset: 12})
+	res2, err := art.Put([]byte("key-2"), &data.LogRecordPos{FileID: 1, Offset: 12})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	res3 := art.Put([]byte("key-3"), &data.LogRecordPos{FileID: 1, Offset: 12})
+	res3, err := art.Put([]byte("key-3"), &data.LogRecordPos{FileID: 1, Offset: 12})
+	assert.Nil(t, err)
 	assert.Nil(t, res3)
 
-	res4 := art.Put([]byte("key-3"), &data.LogRecordPos{FileID: 99, Offset: 88})
+	res4, err := art.Put([]byte("key-3"), &data.LogRecordPos{FileID: 99, Offset: 88})
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), res4.FileID)
 	assert.Equal(t, int64(12), res4.Offset)
 }
@@ -24,43 +30,49 @@ func TestAdaptiveRadixTree_Put(t *testing.T) {
 func TestAdaptiveRadixTree_Get(t *testing.T) {
 	art := NewART()
 	art.Put([]byte("key-1"), &data.LogRecordPos{FileID: 1, Offset: 12})
-	pos := art.Get([]byte("key-1"))
+	pos, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos)
 
-	pos1 := art.Get([]byte("not exist"))
+	pos1, err := art.Get([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos1)
 
 	art.Put([]byte("key-1"), &data.LogRecordPos{FileID: 1123, Offset: 990})
-	pos2 := art.Get([]byte("key-1"))
+	pos2, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos2)
 }
 
 func TestAdaptiveRadixTree_Delete(t *testing.T) {
 	art := NewART()
 
-	res1, ok1 := art.Delete([]byte("not exist"))
+	res1, ok1, err := art.Delete([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
 	assert.False(t, ok1)
 
 	art.Put([]byte("key-1"), &data.LogRecordPos{FileID: 1, Offset: 12})
-	res2, ok2 := art.Delete([]byte("key-1"))
+	res2, ok2, err := art.Delete([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.True(t, ok2)
 	assert.Equal(t, uint32(1), res2.FileID)
 	assert.Equal(t, int64(12), res2.Offset)
 
-	pos := art.Get([]byte("key-1"))
+	pos, err := art.Get([]byte("key-1"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 }
 
 func TestAdaptiveRadixTree_Size(t *testing.T) {
 	art := NewART()
 
-	assert.Equal(t, 0, art.Size())
+	assert.Equal(t, 0, indexSize(t, art))
 
 	art.Put([]byte("key-1"), &data.LogRecordPos{FileID: 1, Offset: 12})
 	art.Put([]byte("key-2"), &data.LogRecordPos{FileID: 1, Offset: 12})
 	art.Put([]byte("key-1"), &data.LogRecordPos{FileID: 1, Offset: 12})
-	assert.Equal(t, 2, art.Size())
+	assert.Equal(t, 2, indexSize(t, art))
 }
 
 func TestAdaptiveRadixTree_Iterator(t *testing.T) {
@@ -71,9 +83,183 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 	art.Put([]byte("bbde"), &data.LogRecordPos{FileID: 1, Offset: 12})
 	art.Put([]byte("bade"), &data.LogRecordPos{FileID: 1, Offset: 12})
 
-	iter := art.Iterator(true)
+	iter, err := art.Iterator(true)
+	assert.Nil(t, err)
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestAdaptiveRadixTree_Snapshot(t *testing.T) {
+	art := NewART()
+	art.Put([]byte("a"), &data.LogRecordPos{FileID: 1, Offset: 1})
+
+	snapshot, err := art.Snapshot()
+	assert.Nil(t, err)
+	art.Put([]byte("a"), &data.LogRecordPos{FileID: 2, Offset: 1})
+	art.Put([]byte("b"), &data.LogRecordPos{FileID: 2, Offset: 2})
+
+	assert.Equal(t, 1, indexSize(t, snapshot))
+	assert.Equal(t, uint32(1), indexGet(t, snapshot, []byte("a")).FileID)
+	assert.Nil(t, indexGet(t, snapshot, []byte("b")))
+}
+
+func TestAdaptiveRadixTree_IteratorCursor(t *testing.T) {
+	testIteratorCursor(t, NewART())
+}
+
+func TestAdaptiveRadixTree_CopyOnWrite(t *testing.T) {
+	art := NewART()
+	for i := 0; i < 100; i++ {
+		art.Put([]byte(fmt.Sprintf("a-%03d", i)), &data.LogRecordPos{FileID: 1, Offset: int64(i)})
+		art.Put([]byte(fmt.Sprintf("b-%03d", i)), &data.LogRecordPos{FileID: 1, Offset: int64(i)})
+	}
+
+	// 没有被引用时直接修改
+	root := art.root
+	art.Put([]byte("a-100"), &data.LogRecordPos{FileID: 1, Offset: 100})
+	assert.True(t, root == art.root)
+
+	// 被引用时只复制写入路径上的节点，其他的子树共享
+	iter, err := art.Iterator(false)
+	assert.Nil(t, err)
+	defer iter.Close()
+	root = art.root
+	bNode := root.findChild('b')
+	art.Put([]byte("a-101"), &data.LogRecordPos{FileID: 1, Offset: 101})
+	assert.False(t, root == art.root)
+	assert.True(t, bNode == art.root.findChild('b'))
+	assert.False(t, root.findChild('a') == art.root.findChild('a'))
+
+	// 只复制一次
+	root = art.root
+	art.Put([]byte("a-102"), &data.LogRecordPos{FileID: 1, Offset: 102})
+	assert.True(t, root == art.root)
+
+	// 迭代器看到的是创建时的数据
+	n := 0
+	for ; iter.Valid(); iter.Next() {
+		n++
+	}
+	assert.Equal(t, 201, n)
+}
+
+func TestAdaptiveRadixTree_Compare(t *testing.T) {
+	art, bt := NewART(), NewBTree()
+	rnd := rand.New(rand.NewSource(1))
+	// 前缀重叠、长短不一的 key，覆盖节点的分裂、扩容、缩容以及合并
+	randKey := func() []byte {
+		key := make([]byte, rnd.Intn(6))
+		for i := range key {
+			key[i] = "ab\x00\xff"[rnd.Intn(4)] + byte(rnd.Intn(3))*byte(i%2)
+		}
+		if rnd.Intn(4) == 0 {
+			key = append(key, byte(rnd.Intn(256)))
+		}
+		return key
+	}
+
+	var snapshots []Indexer
+	var expected [][]string
+	keys := func(indexer Indexer, reverse bool) []string {
+		iter, err := indexer.Iterator(reverse)
+		assert.Nil(t, err)
+		defer iter.Close()
+		var res []string
+		for ; iter.Valid(); iter.Next() {
+			res = append(res, string(iter.Key()))
+		}
+		return res
+	}
+	for i := 0; i < 20000; i++ {
+		key := randKey()
+		if rnd.Intn(3) == 0 {
+			old1, ok1, _ := art.Delete(key)
+			old2, ok2, _ := bt.Delete(key)
+			assert.Equal(t, old2, old1)
+			assert.Equal(t, ok2, ok1)
+		} else {
+			pos := &data.LogRecordPos{FileID: 1, Offset: int64(i)}
+			old1, _ := art.Put(key, pos)
+			old2, _ := bt.Put(key, pos)
+			assert.Equal(t, old2, old1)
+		}
+		if i%2000 == 0 {
+			snapshot, err := art.Snapshot()
+			assert.Nil(t, err)
+			snapshots = append(snapshots, snapshot)
+			expected = append(expected, keys(bt, false))
+		}
+	}
+	assert.Equal(t, indexSize(t, bt), indexSize(t, art))
+	assert.Equal(t, keys(bt, false), keys(art, false))
+	assert.Equal(t, keys(bt, true), keys(art, true))
+	for i, snapshot := range snapshots {
+		assert.Equal(t, expected[i], keys(snapshot, false))
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := randKey()
+		assert.Equal(t, indexGet(t, bt, key), indexGet(t, art, key))
+		for _, reverse := range []bool{false, true} {
+			iter1, _ := art.Iterator(reverse)
+			iter2, _ := bt.Iterator(reverse)
+			iter1.Seek(key)
+			iter2.Seek(key)
+			for j := 0; j < 3; j++ {
+				assert.Equal(t, iter2.Valid(), iter1.Valid())
+				if !iter2.Valid() {
+					break
+				}
+				assert.Equal(t, iter2.Key(), iter1.Key())
+				iter1.Next()
+				iter2.Next()
+			}
+			iter1.Close()
+			iter2.Close()
+		}
+	}
+}
+
+func TestAdaptiveRadixTree_NodeSize(t *testing.T) {
+	art := NewART()
+	art.Put([]byte("n"), &data.LogRecordPos{FileID: 1})
+	childNum := func() (int, int) {
+		return len(art.root.children), cap(art.root.children)
+	}
+
+	for i := 0; i < 256; i++ {
+		art.Put([]byte{'n', byte(i)}, &data.LogRecordPos{FileID: 1, Offset: int64(i)})
+		switch i + 1 {
+		case 4, 16, 48:
+			_, c := childNum()
+			assert.Equal(t, i+1, c)
+		case 49:
+			assert.True(t, art.root.isNode256())
+		}
+	}
+
+	for i := 255; i >= 0; i-- {
+		_, deleted, err := art.Delete([]byte{'n', byte(i)})
+		assert.Nil(t, err)
+		assert.True(t, deleted)
+		switch i {
+		case 36:
+			l, c := childNum()
+			assert.Equal(t, 36, l)
+			assert.Equal(t, 48, c)
+		case 12:
+			_, c := childNum()
+			assert.Equal(t, 16, c)
+		case 3:
+			_, c := childNum()
+			assert.Equal(t, 4, c)
+		}
+		pos, err := art.Get([]byte{'n', byte(i / 2)})
+		assert.Nil(t, err)
+		assert.Equal(t, i > 0, pos != nil)
+	}
+	assert.Equal(t, 1, indexSize(t, art))
+	assert.Equal(t, 0, art.root.num)
+}
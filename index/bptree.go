@@ -1,6 +1,8 @@
 package index
 
 import (
+	"bytes"
+	"fmt"
 	"path/filepath"
 
 	"github.com/ysoding/bitcask/data"
@@ -17,13 +19,13 @@ type BPlusTree struct {
 	tree *bbolt.DB
 }
 
-func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
+func NewBPlusTree(dirPath string, syncWrites bool) (*BPlusTree, error) {
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
 
 	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
 	if err != nil {
-		panic("failed to open bptree")
+		return nil, fmt.Errorf("failed to open bptree: %w", err)
 	}
 
 	// 创建对应的 bucket
@@ -31,15 +33,15 @@ func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
 		_, err := tx.CreateBucketIfNotExists(indexBucketName)
 		return err
 	}); err != nil {
-
-		panic("failed to create bucket in bptree")
+		_ = bptree.Close()
+		return nil, fmt.Errorf("failed to create bucket in bptree: %w", err)
 	}
 
-	return &BPlusTree{tree: bptree}
+	return &BPlusTree{tree: bptree}, nil
 
 }
 
-func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+func (bpt *BPlusTree) Get(key []byte) (*data.LogRecordPos, error) {
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -49,27 +51,27 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 		}
 		return nil
 	}); err != nil {
-		panic("failed to get value in bptree")
+		return nil, fmt.Errorf("failed to get value in bptree: %w", err)
 	}
-	return pos
+	return pos, nil
 }
 
-func (bpt *BPlusTree) Put(key []byte, value *data.LogRecordPos) *data.LogRecordPos {
+func (bpt *BPlusTree) Put(key []byte, value *data.LogRecordPos) (*data.LogRecordPos, error) {
 	var oldVal []byte
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		oldVal = bucket.Get(key)
 		return bucket.Put(key, data.EncodeLogRecordPos(value))
 	}); err != nil {
-		panic("failed to put value in bptree")
+		return nil, fmt.Errorf("failed to put value in bptree: %w", err)
 	}
 	if len(oldVal) == 0 {
-		return nil
+		return nil, nil
 	}
-	return data.DecodeLogRecordPos(oldVal)
+	return data.DecodeLogRecordPos(oldVal), nil
 }
 
-func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	var oldVal []byte
 	if err := bpt.tree.Update(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -78,35 +80,51 @@ func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 		}
 		return nil
 	}); err != nil {
-		panic("failed to put value in bptree")
+		return nil, false, fmt.Errorf("failed to delete value in bptree: %w", err)
 	}
 
 	if len(oldVal) == 0 {
-		return nil, false
+		return nil, false, nil
 	}
-	return data.DecodeLogRecordPos(oldVal), true
+	return data.DecodeLogRecordPos(oldVal), true, nil
 }
 
-func (bpt *BPlusTree) Size() int {
+func (bpt *BPlusTree) Size() (int, error) {
 	var size int
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
 		size = bucket.Stats().KeyN
 		return nil
 	}); err != nil {
-		panic("failed to get size in bptree")
+		return 0, fmt.Errorf("failed to get size in bptree: %w", err)
 	}
-	return size
+	return size, nil
 }
 
 func (bpt *BPlusTree) Close() error {
 	return bpt.tree.Close()
 }
 
-func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
+func (bpt *BPlusTree) Iterator(reverse bool) (Iterator, error) {
 	return newBptreeIterator(bpt.tree, reverse)
 }
 
+// Snapshot 将索引拷贝到内存中的 BTree，避免长时间持有 bbolt 的读事务
+func (bpt *BPlusTree) Snapshot() (Indexer, error) {
+	snapshot := NewBTree()
+	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+			key := make([]byte, len(k))
+			copy(key, k)
+			snapshot.tree.ReplaceOrInsert(&Item{key: key, data: data.DecodeLogRecordPos(v)})
+			return nil
+		})
+	}); err != nil {
+		return nil, fmt.Errorf("failed to snapshot bptree: %w", err)
+	}
+	return snapshot, nil
+}
+
 // B+树迭代器
 type bptreeIterator struct {
 	tx        *bbolt.Tx
@@ -116,10 +134,10 @@ type bptreeIterator struct {
 	currValue []byte
 }
 
-func newBptreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
+func newBptreeIterator(tree *bbolt.DB, reverse bool) (*bptreeIterator, error) {
 	tx, err := tree.Begin(false)
 	if err != nil {
-		panic("failed to begin a transaction")
+		return nil, fmt.Errorf("failed to begin a transaction: %w", err)
 	}
 	bpi := &bptreeIterator{
 		tx:      tx,
@@ -127,7 +145,7 @@ func newBptreeIterator(tree *bbolt.DB, reverse bool) *bptreeIterator {
 		reverse: reverse,
 	}
 	bpi.Rewind()
-	return bpi
+	return bpi, nil
 }
 
 func (bpi *bptreeIterator) Rewind() {
@@ -138,8 +156,17 @@ func (bpi *bptreeIterator) Rewind() {
 	}
 }
 
+// Seek 正向遍历时定位到第一个大于等于 key 的位置，反向遍历时定位到最后一个小于等于 key 的位置
 func (bpi *bptreeIterator) Seek(key []byte) {
 	bpi.currKey, bpi.currValue = bpi.cursor.Seek(key)
+	if !bpi.reverse {
+		return
+	}
+	if bpi.currKey == nil {
+		bpi.currKey, bpi.currValue = bpi.cursor.Last()
+	} else if bytes.Compare(bpi.currKey, key) > 0 {
+		bpi.currKey, bpi.currValue = bpi.cursor.Prev()
+	}
 }
 
 func (bpi *bptreeIterator) Next() {
@@ -162,6 +189,6 @@ func (bpi *bptreeIterator) Value() *data.LogRecordPos {
 	return data.DecodeLogRecordPos(bpi.currValue)
 }
 
-func (bpi *bptreeIterator) Close() {
-	_ = bpi.tx.Rollback()
+func (bpi *bptreeIterator) Close() error {
+	return bpi.tx.Rollback()
 }
@@ -15,16 +15,22 @@ func TestBPlusTree_Put(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	defer tree.Close()
 
-	res1 := tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 123, Offset: 999})
+	res1, err := tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res1)
-	res2 := tree.Put([]byte("abc"), &data.LogRecordPos{FileID: 123, Offset: 999})
+	res2, err := tree.Put([]byte("abc"), &data.LogRecordPos{FileID: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res2)
-	res3 := tree.Put([]byte("acc"), &data.LogRecordPos{FileID: 123, Offset: 999})
+	res3, err := tree.Put([]byte("acc"), &data.LogRecordPos{FileID: 123, Offset: 999})
+	assert.Nil(t, err)
 	assert.Nil(t, res3)
 
-	res4 := tree.Put([]byte("acc"), &data.LogRecordPos{FileID: 7744, Offset: 883})
+	res4, err := tree.Put([]byte("acc"), &data.LogRecordPos{FileID: 7744, Offset: 883})
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(123), res4.FileID)
 	assert.Equal(t, int64(999), res4.Offset)
 }
@@ -35,17 +41,22 @@ func TestBPlusTree_Get(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	defer tree.Close()
 
-	pos := tree.Get([]byte("not exist"))
+	pos, err := tree.Get([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 123, Offset: 999})
-	pos1 := tree.Get([]byte("aac"))
+	pos1, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos1)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 9884, Offset: 1232})
-	pos2 := tree.Get([]byte("aac"))
+	pos2, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.NotNil(t, pos2)
 }
 
@@ -55,19 +66,24 @@ func TestBPlusTree_Delete(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	defer tree.Close()
 
-	res1, ok1 := tree.Delete([]byte("not exist"))
+	res1, ok1, err := tree.Delete([]byte("not exist"))
+	assert.Nil(t, err)
 	assert.False(t, ok1)
 	assert.Nil(t, res1)
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 123, Offset: 999})
-	res2, ok2 := tree.Delete([]byte("aac"))
+	res2, ok2, err := tree.Delete([]byte("aac"))
+	assert.Nil(t, err)
 	assert.True(t, ok2)
 	assert.Equal(t, uint32(123), res2.FileID)
 	assert.Equal(t, int64(999), res2.Offset)
 
-	pos1 := tree.Get([]byte("aac"))
+	pos1, err := tree.Get([]byte("aac"))
+	assert.Nil(t, err)
 	assert.Nil(t, pos1)
 }
 
@@ -77,15 +93,17 @@ func TestBPlusTree_Size(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	defer tree.Close()
 
-	assert.Equal(t, 0, tree.Size())
+	assert.Equal(t, 0, indexSize(t, tree))
 
 	tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 123, Offset: 999})
 	tree.Put([]byte("abc"), &data.LogRecordPos{FileID: 123, Offset: 999})
 	tree.Put([]byte("acc"), &data.LogRecordPos{FileID: 123, Offset: 999})
 
-	assert.Equal(t, 3, tree.Size())
+	assert.Equal(t, 3, indexSize(t, tree))
 }
 
 func TestBPlusTree_Iterator(t *testing.T) {
@@ -94,7 +112,9 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	defer func() {
 		_ = os.RemoveAll(path)
 	}()
-	tree := NewBPlusTree(path, false)
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	defer tree.Close()
 
 	tree.Put([]byte("caac"), &data.LogRecordPos{FileID: 123, Offset: 999})
 	tree.Put([]byte("bbca"), &data.LogRecordPos{FileID: 123, Offset: 999})
@@ -102,9 +122,70 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	tree.Put([]byte("ccec"), &data.LogRecordPos{FileID: 123, Offset: 999})
 	tree.Put([]byte("bbba"), &data.LogRecordPos{FileID: 123, Offset: 999})
 
-	iter := tree.Iterator(true)
+	iter, err := tree.Iterator(true)
+	assert.Nil(t, err)
+	defer iter.Close()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		assert.NotNil(t, iter.Key())
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestBPlusTree_Iterator_ReverseSeek(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-reverse-seek")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	defer tree.Close()
+	for _, key := range []string{"a1", "a2", "a3"} {
+		_, err := tree.Put([]byte(key), &data.LogRecordPos{FileID: 1, Offset: 10})
+		assert.Nil(t, err)
+	}
+
+	iter, err := tree.Iterator(true)
+	assert.Nil(t, err)
+	defer iter.Close()
+
+	// 大于所有的 key
+	iter.Seek([]byte("b"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("a3"), iter.Key())
+	// key 不存在时定位到前一个
+	iter.Seek([]byte("a25"))
+	assert.Equal(t, []byte("a2"), iter.Key())
+	iter.Next()
+	assert.Equal(t, []byte("a1"), iter.Key())
+	iter.Seek([]byte("a2"))
+	assert.Equal(t, []byte("a2"), iter.Key())
+	// 小于所有的 key
+	iter.Seek([]byte("a"))
+	assert.False(t, iter.Valid())
+}
+
+func TestBPlusTree_Closed(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-closed")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree, err := NewBPlusTree(path, false)
+	assert.Nil(t, err)
+	_, err = tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 123, Offset: 999})
+	assert.Nil(t, err)
+	assert.Nil(t, tree.Close())
+
+	// 关闭之后的操作返回错误
+	_, err = tree.Get([]byte("aac"))
+	assert.NotNil(t, err)
+	_, err = tree.Put([]byte("abc"), &data.LogRecordPos{FileID: 123, Offset: 999})
+	assert.NotNil(t, err)
+	_, _, err = tree.Delete([]byte("aac"))
+	assert.NotNil(t, err)
+	_, err = tree.Size()
+	assert.NotNil(t, err)
+	_, err = tree.Iterator(false)
+	assert.NotNil(t, err)
+}
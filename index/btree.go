@@ -2,7 +2,6 @@ package index
 
 import (
 	"bytes"
-	"sort"
 	"sync"
 
 	"github.com/google/btree"
@@ -21,18 +20,20 @@ func NewBTree() *BTree {
 	}
 }
 
-func (b *BTree) Get(key []byte) *data.LogRecordPos {
+func (b *BTree) Get(key []byte) (*data.LogRecordPos, error) {
 	item := &Item{key: key}
 
+	b.mu.RLock()
 	bitem := b.tree.Get(item)
+	b.mu.RUnlock()
 	if bitem == nil {
-		return nil
+		return nil, nil
 	}
 
-	return bitem.(*Item).data
+	return bitem.(*Item).data, nil
 }
 
-func (b *BTree) Put(key []byte, data *data.LogRecordPos) *data.LogRecordPos {
+func (b *BTree) Put(key []byte, data *data.LogRecordPos) (*data.LogRecordPos, error) {
 
 	item := &Item{key: key, data: data}
 
@@ -41,13 +42,29 @@ func (b *BTree) Put(key []byte, data *data.LogRecordPos) *data.LogRecordPos {
 	b.mu.Unlock()
 
 	if bitem == nil {
-		return nil
+		return nil, nil
 	}
 
-	return bitem.(*Item).data
+	return bitem.(*Item).data, nil
+}
+
+// putIfNewer key 不存在或者已有的位置比 pos 更早时写入 pos，返回已经无效的位置
+func (b *BTree) putIfNewer(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+	item := &Item{key: key, data: pos}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if bitem := b.tree.Get(item); bitem != nil && !bitem.(*Item).data.Before(pos) {
+		return pos
+	}
+	if bitem := b.tree.ReplaceOrInsert(item); bitem != nil {
+		return bitem.(*Item).data
+	}
+	return nil
 }
 
-func (b *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
+func (b *BTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
 	item := &Item{key: key}
 
 	b.mu.Lock()
@@ -55,97 +72,122 @@ func (b *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	b.mu.Unlock()
 
 	if bitem == nil {
-		return nil, false
+		return nil, false, nil
 	}
 
-	return bitem.(*Item).data, true
+	return bitem.(*Item).data, true, nil
 }
 
-func (b *BTree) Size() int {
-	return b.tree.Len()
+func (b *BTree) Size() (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.tree.Len(), nil
 }
 
 func (b *BTree) Close() error {
 	return nil
 }
 
-func (b *BTree) Iterator(reverse bool) Iterator {
-	if b.tree == nil {
-		return nil
-	}
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	return newBtreeIterator(b.tree, reverse)
+func (b *BTree) Iterator(reverse bool) (Iterator, error) {
+	// Clone 会修改原来的树的写时复制标记，需要加写锁
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return newBtreeIterator(b.tree.Clone(), reverse), nil
+}
+
+func (b *BTree) Snapshot() (Indexer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Clone 使用写时复制，代价很小
+	return &BTree{tree: b.tree.Clone(), mu: new(sync.RWMutex)}, nil
 }
 
+// btreeIteratorBatch 迭代器每次从树中取出的数据量
+const btreeIteratorBatch = 64
+
+// btreeIterator 按批次遍历树的游标，遍历的是创建迭代器时的写时复制克隆，不受之后的写入影响
 type btreeIterator struct {
-	currIdx int
-	reverse bool
-	values  []*Item
+	tree      *btree.BTree
+	reverse   bool
+	items     []*Item // 当前批次的数据
+	currIdx   int
+	exhausted bool // 当前批次之后已经没有数据
 }
 
 func newBtreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	idx := 0
-	values := make([]*Item, tree.Len())
-
-	iter := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
-		return true
+	iter := &btreeIterator{
+		tree:    tree,
+		reverse: reverse,
+		items:   make([]*Item, 0, btreeIteratorBatch),
 	}
+	iter.Rewind()
+	return iter
+}
+
+// fill 从 pivot 开始取出下一批数据，pivot 为空时从头开始，inclusive 表示是否包含 pivot 本身
+func (b *btreeIterator) fill(pivot *Item, inclusive bool) {
+	b.items = b.items[:0]
+	b.currIdx = 0
 
-	if reverse {
-		tree.Descend(iter)
-	} else {
-		tree.Ascend(iter)
+	iter := func(it btree.Item) bool {
+		item := it.(*Item)
+		if !inclusive && bytes.Equal(item.key, pivot.key) {
+			return true
+		}
+		b.items = append(b.items, item)
+		return len(b.items) < btreeIteratorBatch
 	}
 
-	return &btreeIterator{
-		currIdx: 0,
-		reverse: reverse,
-		values:  values,
+	switch {
+	case pivot == nil && b.reverse:
+		b.tree.Descend(iter)
+	case pivot == nil:
+		b.tree.Ascend(iter)
+	case b.reverse:
+		b.tree.DescendLessOrEqual(pivot, iter)
+	default:
+		b.tree.AscendGreaterOrEqual(pivot, iter)
 	}
+	b.exhausted = len(b.items) < btreeIteratorBatch
 }
 
 // Rewind 重新回到迭代器的起点，即第一个数据
 func (b *btreeIterator) Rewind() {
-	b.currIdx = 0
+	b.fill(nil, true)
 }
 
 // Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
 func (b *btreeIterator) Seek(key []byte) {
-	if b.reverse {
-		b.currIdx = sort.Search(len(b.values), func(i int) bool {
-			return bytes.Compare(b.values[i].key, key) <= 0
-		})
-	} else {
-		b.currIdx = sort.Search(len(b.values), func(i int) bool {
-			return bytes.Compare(b.values[i].key, key) >= 0
-		})
-	}
+	b.fill(&Item{key: key}, true)
 }
 
 // Next 跳转到下一个 key
 func (b *btreeIterator) Next() {
 	b.currIdx++
+	if b.currIdx == len(b.items) && !b.exhausted {
+		b.fill(b.items[len(b.items)-1], false)
+	}
 }
 
 // Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
 func (b *btreeIterator) Valid() bool {
-	return b.currIdx < len(b.values)
+	return b.currIdx < len(b.items)
 }
 
 // Key 当前遍历位置的 Key 数据
 func (b *btreeIterator) Key() []byte {
-	return b.values[b.currIdx].key
+	return b.items[b.currIdx].key
 }
 
 // Value 当前遍历位置的 Value 数据
 func (b *btreeIterator) Value() *data.LogRecordPos {
-	return b.values[b.currIdx].data
+	return b.items[b.currIdx].data
 }
 
 // Close 关闭迭代器，释放相应资源
-func (b *btreeIterator) Close() {
-	b.values = nil
+func (b *btreeIterator) Close() error {
+	b.tree = nil
+	b.items = nil
+	b.currIdx = 0
+	return nil
 }
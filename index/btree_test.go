@@ -1,6 +1,7 @@
 package index
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,19 +10,21 @@ import (
 
 func TestBTree_Delete(t *testing.T) {
 	bt := NewBTree()
-	assert.Equal(t, 0, bt.Size())
+	assert.Equal(t, 0, indexSize(t, bt))
 
 	bt.Put(nil, &data.LogRecordPos{FileID: 1, Offset: 1})
-	assert.Equal(t, 1, bt.Size())
+	assert.Equal(t, 1, indexSize(t, bt))
 
-	result, ok := bt.Delete(nil)
+	result, ok, err := bt.Delete(nil)
+	assert.Nil(t, err)
 	assert.True(t, ok)
 	assert.Equal(t, uint32(1), result.FileID)
 	assert.Equal(t, int64(1), result.Offset)
 
-	assert.Equal(t, 0, bt.Size())
+	assert.Equal(t, 0, indexSize(t, bt))
 
-	result, ok = bt.Delete([]byte("a"))
+	result, ok, err = bt.Delete([]byte("a"))
+	assert.Nil(t, err)
 	assert.False(t, ok)
 	assert.Nil(t, result)
 }
@@ -31,39 +34,45 @@ func TestBTree_Get(t *testing.T) {
 
 	bt.Put(nil, &data.LogRecordPos{FileID: 1, Offset: 1})
 
-	result := bt.Get(nil)
+	result, err := bt.Get(nil)
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), result.FileID)
 	assert.Equal(t, int64(1), result.Offset)
 
-	assert.Nil(t, bt.Get([]byte("a")))
-	assert.Equal(t, 1, bt.Size())
+	assert.Nil(t, indexGet(t, bt, []byte("a")))
+	assert.Equal(t, 1, indexSize(t, bt))
 }
 
 func TestBTree_Put(t *testing.T) {
 	bt := NewBTree()
 
-	result := bt.Put(nil, &data.LogRecordPos{FileID: 1})
+	result, err := bt.Put(nil, &data.LogRecordPos{FileID: 1})
+	assert.Nil(t, err)
 	assert.Nil(t, result)
 
-	result = bt.Put([]byte("a"), &data.LogRecordPos{FileID: 1, Offset: 1})
+	result, err = bt.Put([]byte("a"), &data.LogRecordPos{FileID: 1, Offset: 1})
+	assert.Nil(t, err)
 	assert.Nil(t, result)
 
-	result = bt.Put([]byte("a"), &data.LogRecordPos{FileID: 1, Offset: 2})
+	result, err = bt.Put([]byte("a"), &data.LogRecordPos{FileID: 1, Offset: 2})
+	assert.Nil(t, err)
 	assert.Equal(t, uint32(1), result.FileID)
 	assert.Equal(t, int64(1), result.Offset)
 
-	assert.Equal(t, 2, bt.Size())
+	assert.Equal(t, 2, indexSize(t, bt))
 }
 
 func TestBTree_Iterator(t *testing.T) {
 	bt1 := NewBTree()
 	// 1.BTree 为空的情况
-	iter1 := bt1.Iterator(false)
+	iter1, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, false, iter1.Valid())
 
 	//	2.BTree 有数据的情况
 	bt1.Put([]byte("ccde"), &data.LogRecordPos{FileID: 1, Offset: 10})
-	iter2 := bt1.Iterator(false)
+	iter2, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	assert.Equal(t, true, iter2.Valid())
 	assert.NotNil(t, iter2.Key())
 	assert.NotNil(t, iter2.Value())
@@ -74,25 +83,121 @@ func TestBTree_Iterator(t *testing.T) {
 	bt1.Put([]byte("acee"), &data.LogRecordPos{FileID: 1, Offset: 10})
 	bt1.Put([]byte("eede"), &data.LogRecordPos{FileID: 1, Offset: 10})
 	bt1.Put([]byte("bbcd"), &data.LogRecordPos{FileID: 1, Offset: 10})
-	iter3 := bt1.Iterator(false)
+	iter3, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.NotNil(t, iter3.Key())
 	}
 
-	iter4 := bt1.Iterator(true)
+	iter4, err := bt1.Iterator(true)
+	assert.Nil(t, err)
 	for iter4.Rewind(); iter4.Valid(); iter4.Next() {
 		assert.NotNil(t, iter4.Key())
 	}
 
 	// 4.测试 seek
-	iter5 := bt1.Iterator(false)
+	iter5, err := bt1.Iterator(false)
+	assert.Nil(t, err)
 	for iter5.Seek([]byte("cc")); iter5.Valid(); iter5.Next() {
 		assert.NotNil(t, iter5.Key())
 	}
 
 	// 5.反向遍历的 seek
-	iter6 := bt1.Iterator(true)
+	iter6, err := bt1.Iterator(true)
+	assert.Nil(t, err)
 	for iter6.Seek([]byte("zz")); iter6.Valid(); iter6.Next() {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+func TestBTree_Snapshot(t *testing.T) {
+	bt := NewBTree()
+	bt.Put([]byte("a"), &data.LogRecordPos{FileID: 1, Offset: 1})
+	bt.Put([]byte("b"), &data.LogRecordPos{FileID: 1, Offset: 2})
+
+	snapshot, err := bt.Snapshot()
+	assert.Nil(t, err)
+
+	// 修改原索引不影响快照
+	bt.Put([]byte("a"), &data.LogRecordPos{FileID: 2, Offset: 1})
+	bt.Delete([]byte("b"))
+	bt.Put([]byte("c"), &data.LogRecordPos{FileID: 2, Offset: 2})
+
+	assert.Equal(t, 2, indexSize(t, snapshot))
+	assert.Equal(t, uint32(1), indexGet(t, snapshot, []byte("a")).FileID)
+	assert.NotNil(t, indexGet(t, snapshot, []byte("b")))
+	assert.Nil(t, indexGet(t, snapshot, []byte("c")))
+
+	assert.Equal(t, 2, indexSize(t, bt))
+	assert.Equal(t, uint32(2), indexGet(t, bt, []byte("a")).FileID)
+}
+
+// indexSize 测试中使用的索引不会出错，直接返回 key 的数量
+func indexSize(t *testing.T, indexer Indexer) int {
+	size, err := indexer.Size()
+	assert.Nil(t, err)
+	return size
+}
+
+// indexGet 测试中使用的索引不会出错，直接返回 key 的位置索引
+func indexGet(t *testing.T, indexer Indexer, key []byte) *data.LogRecordPos {
+	pos, err := indexer.Get(key)
+	assert.Nil(t, err)
+	return pos
+}
+
+// testIteratorCursor 遍历超过一个批次的数据，并检查迭代器不受创建之后的写入影响
+func testIteratorCursor(t *testing.T, indexer Indexer) {
+	for i := 0; i < 1000; i++ {
+		indexer.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{FileID: 1, Offset: int64(i)})
+	}
+
+	forward, err := indexer.Iterator(false)
+	assert.Nil(t, err)
+	reverse, err := indexer.Iterator(true)
+	assert.Nil(t, err)
+
+	// 创建迭代器之后的修改
+	indexer.Delete([]byte("key-0000"))
+	indexer.Put([]byte("key-0001"), &data.LogRecordPos{FileID: 2, Offset: 1})
+	indexer.Put([]byte("key-1000"), &data.LogRecordPos{FileID: 2, Offset: 1000})
+
+	i := 0
+	for forward.Rewind(); forward.Valid(); forward.Next() {
+		assert.Equal(t, fmt.Sprintf("key-%04d", i), string(forward.Key()))
+		assert.Equal(t, &data.LogRecordPos{FileID: 1, Offset: int64(i)}, forward.Value())
+		i++
+	}
+	assert.Equal(t, 1000, i)
+	for reverse.Rewind(); reverse.Valid(); reverse.Next() {
+		i--
+		assert.Equal(t, fmt.Sprintf("key-%04d", i), string(reverse.Key()))
+	}
+	assert.Equal(t, 0, i)
+
+	forward.Seek([]byte("key-0500"))
+	assert.Equal(t, "key-0500", string(forward.Key()))
+	forward.Seek([]byte("key-0500x"))
+	assert.Equal(t, "key-0501", string(forward.Key()))
+	reverse.Seek([]byte("key-0500x"))
+	assert.Equal(t, "key-0500", string(reverse.Key()))
+	reverse.Next()
+	assert.Equal(t, "key-0499", string(reverse.Key()))
+	forward.Seek([]byte("zzz"))
+	assert.False(t, forward.Valid())
+	forward.Close()
+	reverse.Close()
+
+	// 新的迭代器可以看到之前的修改
+	iter, err := indexer.Iterator(false)
+	assert.Nil(t, err)
+	defer iter.Close()
+	assert.Equal(t, "key-0001", string(iter.Key()))
+	assert.Equal(t, uint32(2), iter.Value().FileID)
+	iter.Seek([]byte("key-1000"))
+	assert.Equal(t, "key-1000", string(iter.Key()))
+}
+
+func TestBTree_IteratorCursor(t *testing.T) {
+	testIteratorCursor(t, NewBTree())
+}
@@ -2,18 +2,35 @@ package index
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/google/btree"
 	"github.com/ysoding/bitcask/data"
 )
 
+// Indexer 内存或者磁盘上的索引，磁盘索引读写失败时返回错误
 type Indexer interface {
-	Get(key []byte) *data.LogRecordPos
-	Put(key []byte, data *data.LogRecordPos) *data.LogRecordPos
-	Delete(key []byte) (*data.LogRecordPos, bool)
-	Size() int
+	// Get 返回 key 对应的位置索引，key 不存在时返回空
+	Get(key []byte) (*data.LogRecordPos, error)
+	// Put 写入 key 对应的位置索引，返回之前的位置索引
+	Put(key []byte, data *data.LogRecordPos) (*data.LogRecordPos, error)
+	// Delete 删除 key，返回之前的位置索引以及 key 是否存在
+	Delete(key []byte) (*data.LogRecordPos, bool, error)
+	Size() (int, error)
 	Close() error
-	Iterator(reverse bool) Iterator
+	Iterator(reverse bool) (Iterator, error)
+
+	// Snapshot 返回当前索引的只读快照，之后对索引的修改不会影响快照
+	Snapshot() (Indexer, error)
+}
+
+// ConcurrentIndexer 支持多个写入者并行更新的索引，写入时只需要串行地追加数据文件
+type ConcurrentIndexer interface {
+	Indexer
+
+	// PutIfNewer 并行更新时同一个 key 的写入可能乱序到达，只有 key 不存在或者已有的位置比 pos 更早时才写入
+	// 返回已经无效的位置，没有写入时返回 pos 本身
+	PutIfNewer(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error)
 }
 
 type IndexerType byte
@@ -23,18 +40,22 @@ const (
 	// ART 自适应基数树索引
 	ART
 	BPTree
+	// ShardedBtree 按照 key 分片的 B 树索引
+	ShardedBtree
 )
 
-func NewIndexer(typ IndexerType, dirPath string, sync bool) Indexer {
+func NewIndexer(typ IndexerType, dirPath string, sync bool) (Indexer, error) {
 	switch typ {
 	case Btree:
-		return NewBTree()
+		return NewBTree(), nil
 	case ART:
-		return NewART()
+		return NewART(), nil
 	case BPTree:
 		return NewBPlusTree(dirPath, sync)
+	case ShardedBtree:
+		return NewShardedBTree(DefaultShardNum), nil
 	default:
-		panic("unsupported indexer type")
+		return nil, fmt.Errorf("unsupported indexer type %d", typ)
 	}
 }
 
@@ -67,5 +88,5 @@ type Iterator interface {
 	Value() *data.LogRecordPos
 
 	// Close 关闭迭代器，释放相应资源
-	Close()
+	Close() error
 }
@@ -0,0 +1,28 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewIndexer(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "indexer-new")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+
+	for _, typ := range []IndexerType{Btree, ART, BPTree, ShardedBtree} {
+		indexer, err := NewIndexer(typ, path, false)
+		assert.Nil(t, err)
+		assert.NotNil(t, indexer)
+		assert.Nil(t, indexer.Close())
+	}
+
+	indexer, err := NewIndexer(IndexerType(100), path, false)
+	assert.NotNil(t, err)
+	assert.Nil(t, indexer)
+}
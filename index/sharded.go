@@ -0,0 +1,194 @@
+package index
+
+import (
+	"bytes"
+	"container/heap"
+	"hash/maphash"
+
+	"github.com/ysoding/bitcask/data"
+)
+
+// DefaultShardNum 分片索引默认的分片数量
+const DefaultShardNum = 16
+
+// ShardedBTree 按照 key 的哈希值分片的 B 树索引，每个分片有自己的锁，不同分片的写入可以并行执行
+// 有序遍历时对所有分片的迭代器进行多路归并
+type ShardedBTree struct {
+	shards []*BTree
+	seed   maphash.Seed
+}
+
+func NewShardedBTree(shardNum int) *ShardedBTree {
+	if shardNum <= 0 {
+		shardNum = DefaultShardNum
+	}
+	shards := make([]*BTree, shardNum)
+	for i := range shards {
+		shards[i] = NewBTree()
+	}
+	return &ShardedBTree{shards: shards, seed: maphash.MakeSeed()}
+}
+
+// shard 返回 key 所在的分片
+func (s *ShardedBTree) shard(key []byte) *BTree {
+	return s.shards[maphash.Bytes(s.seed, key)%uint64(len(s.shards))]
+}
+
+func (s *ShardedBTree) Get(key []byte) (*data.LogRecordPos, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *ShardedBTree) Put(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	return s.shard(key).Put(key, pos)
+}
+
+func (s *ShardedBTree) PutIfNewer(key []byte, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	return s.shard(key).putIfNewer(key, pos), nil
+}
+
+func (s *ShardedBTree) Delete(key []byte) (*data.LogRecordPos, bool, error) {
+	return s.shard(key).Delete(key)
+}
+
+func (s *ShardedBTree) Size() (int, error) {
+	size := 0
+	for _, shard := range s.shards {
+		n, _ := shard.Size()
+		size += n
+	}
+	return size, nil
+}
+
+func (s *ShardedBTree) Close() error {
+	return nil
+}
+
+// Iterator 各个分片分别克隆，调用方需要保证期间没有跨分片的原子写入，例如持有 db 的锁
+func (s *ShardedBTree) Iterator(reverse bool) (Iterator, error) {
+	iters := make([]Iterator, len(s.shards))
+	for i, shard := range s.shards {
+		iters[i], _ = shard.Iterator(reverse)
+	}
+	return newMergeIterator(iters, reverse), nil
+}
+
+// Snapshot 与 Iterator 相同，各个分片分别克隆
+func (s *ShardedBTree) Snapshot() (Indexer, error) {
+	shards := make([]*BTree, len(s.shards))
+	for i, shard := range s.shards {
+		snapshot, _ := shard.Snapshot()
+		shards[i] = snapshot.(*BTree)
+	}
+	return &ShardedBTree{shards: shards, seed: s.seed}, nil
+}
+
+// mergeIterator 多路归并多个有序的迭代器，各个迭代器中的 key 互不相同
+type mergeIterator struct {
+	iters []Iterator
+	heap  iteratorHeap // 还没有遍历完的迭代器，堆顶是当前位置的 key 所在的迭代器
+}
+
+func newMergeIterator(iters []Iterator, reverse bool) *mergeIterator {
+	iter := &mergeIterator{
+		iters: iters,
+		heap:  iteratorHeap{iters: make([]Iterator, 0, len(iters)), reverse: reverse},
+	}
+	iter.Rewind()
+	return iter
+}
+
+// init 重新根据所有迭代器的当前位置建堆
+func (m *mergeIterator) init() {
+	m.heap.iters = m.heap.iters[:0]
+	for _, iter := range m.iters {
+		if iter.Valid() {
+			m.heap.iters = append(m.heap.iters, iter)
+		}
+	}
+	heap.Init(&m.heap)
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (m *mergeIterator) Rewind() {
+	for _, iter := range m.iters {
+		iter.Rewind()
+	}
+	m.init()
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (m *mergeIterator) Seek(key []byte) {
+	for _, iter := range m.iters {
+		iter.Seek(key)
+	}
+	m.init()
+}
+
+// Next 跳转到下一个 key
+func (m *mergeIterator) Next() {
+	if !m.Valid() {
+		return
+	}
+	top := m.heap.iters[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(&m.heap, 0)
+	} else {
+		heap.Pop(&m.heap)
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (m *mergeIterator) Valid() bool {
+	return len(m.heap.iters) > 0
+}
+
+// Key 当前遍历位置的 Key 数据
+func (m *mergeIterator) Key() []byte {
+	return m.heap.iters[0].Key()
+}
+
+// Value 当前遍历位置的 Value 数据
+func (m *mergeIterator) Value() *data.LogRecordPos {
+	return m.heap.iters[0].Value()
+}
+
+// Close 关闭迭代器，释放相应资源
+func (m *mergeIterator) Close() error {
+	var err error
+	for _, iter := range m.iters {
+		if closeErr := iter.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	m.iters = nil
+	m.heap.iters = nil
+	return err
+}
+
+// iteratorHeap 按照迭代器当前位置的 key 排序的堆，反向遍历时 key 最大的在堆顶
+type iteratorHeap struct {
+	iters   []Iterator
+	reverse bool
+}
+
+func (h *iteratorHeap) Len() int { return len(h.iters) }
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(h.iters[i].Key(), h.iters[j].Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) { h.iters[i], h.iters[j] = h.iters[j], h.iters[i] }
+
+func (h *iteratorHeap) Push(x any) { h.iters = append(h.iters, x.(Iterator)) }
+
+func (h *iteratorHeap) Pop() any {
+	n := len(h.iters)
+	iter := h.iters[n-1]
+	h.iters = h.iters[:n-1]
+	return iter
+}
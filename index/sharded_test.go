@@ -0,0 +1,116 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
+)
+
+func TestShardedBTree_PutGetDelete(t *testing.T) {
+	tree := NewShardedBTree(4)
+
+	res1, err := tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 1, Offset: 100})
+	assert.Nil(t, err)
+	assert.Nil(t, res1)
+	res2, err := tree.Put([]byte("aac"), &data.LogRecordPos{FileID: 1, Offset: 200})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), res2.Offset)
+
+	pos := indexGet(t, tree, []byte("aac"))
+	assert.Equal(t, int64(200), pos.Offset)
+	assert.Nil(t, indexGet(t, tree, []byte("not exist")))
+
+	res3, ok, err := tree.Delete([]byte("aac"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(200), res3.Offset)
+	assert.Equal(t, 0, indexSize(t, tree))
+}
+
+func TestShardedBTree_PutIfNewer(t *testing.T) {
+	tree := NewShardedBTree(4)
+	key := []byte("aac")
+
+	stale, err := tree.PutIfNewer(key, &data.LogRecordPos{FileID: 2, Offset: 100})
+	assert.Nil(t, err)
+	assert.Nil(t, stale)
+
+	// 更早的位置不会覆盖已有的位置，返回其本身
+	older := &data.LogRecordPos{FileID: 1, Offset: 500}
+	stale, err = tree.PutIfNewer(key, older)
+	assert.Nil(t, err)
+	assert.Same(t, older, stale)
+	older = &data.LogRecordPos{FileID: 2, Offset: 50}
+	stale, err = tree.PutIfNewer(key, older)
+	assert.Nil(t, err)
+	assert.Same(t, older, stale)
+
+	stale, err = tree.PutIfNewer(key, &data.LogRecordPos{FileID: 2, Offset: 300})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), stale.Offset)
+	assert.Equal(t, int64(300), indexGet(t, tree, key).Offset)
+}
+
+func TestShardedBTree_Iterator(t *testing.T) {
+	tree := NewShardedBTree(8)
+	btree := NewBTree()
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i*7%500))
+		pos := &data.LogRecordPos{FileID: 1, Offset: int64(i)}
+		_, _ = tree.Put(key, pos)
+		_, _ = btree.Put(key, pos)
+	}
+	assert.Equal(t, 500, indexSize(t, tree))
+
+	// 多路归并的结果与单个 B 树的遍历结果一致
+	collect := func(indexer Indexer, reverse bool, seek []byte) []string {
+		iter, err := indexer.Iterator(reverse)
+		assert.Nil(t, err)
+		defer iter.Close()
+		if seek != nil {
+			iter.Seek(seek)
+		}
+		var keys []string
+		for ; iter.Valid(); iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys
+	}
+	for _, reverse := range []bool{false, true} {
+		assert.Equal(t, collect(btree, reverse, nil), collect(tree, reverse, nil))
+		assert.Equal(t, collect(btree, reverse, []byte("key-250")), collect(tree, reverse, []byte("key-250")))
+		assert.Equal(t, collect(btree, reverse, []byte("key-2555")), collect(tree, reverse, []byte("key-2555")))
+	}
+
+	iter, err := tree.Iterator(false)
+	assert.Nil(t, err)
+	iter.Seek([]byte("zzz"))
+	assert.False(t, iter.Valid())
+	// 遍历结束之后继续调用 Next 不做任何处理
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Rewind()
+	assert.Equal(t, []byte("key-000"), iter.Key())
+	assert.NotNil(t, iter.Value())
+	assert.Nil(t, iter.Close())
+}
+
+func TestShardedBTree_Snapshot(t *testing.T) {
+	tree := NewShardedBTree(4)
+	for i := 0; i < 100; i++ {
+		_, _ = tree.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{FileID: 1, Offset: int64(i)})
+	}
+
+	snapshot, err := tree.Snapshot()
+	assert.Nil(t, err)
+	defer snapshot.Close()
+
+	// 快照之后的修改不影响快照
+	_, _, _ = tree.Delete([]byte("key-000"))
+	_, _ = tree.Put([]byte("key-100"), &data.LogRecordPos{FileID: 1, Offset: 100})
+	assert.Equal(t, 100, indexSize(t, snapshot))
+	assert.NotNil(t, indexGet(t, snapshot, []byte("key-000")))
+	assert.Nil(t, indexGet(t, snapshot, []byte("key-100")))
+}
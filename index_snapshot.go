@@ -0,0 +1,352 @@
+package bitcask
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+	"github.com/ysoding/bitcask/index"
+)
+
+// indexSnapshotKey 索引快照第一条记录的 key，记录的是快照覆盖的范围
+const indexSnapshotKey = "index.snapshot"
+
+// indexSnapshotWriteSize 不加密时索引快照中的记录攒够这么多字节之后一起写入
+const indexSnapshotWriteSize = 64 * 1024
+
+var errInvalidIndexSnapshot = errors.New("invalid index snapshot")
+
+// indexSnapshotMeta 索引快照覆盖的范围，快照中的索引等同于从头加载数据文件到 fileID 文件的 offset 处得到的索引
+type indexSnapshotMeta struct {
+	fileID    uint32
+	offset    int64
+	seqNo     uint64           // 快照时的事务序列号
+	count     uint64           // 快照中索引的数量
+	deadSizes map[uint32]int64 // 每个数据文件中无效的数据量
+}
+
+func (m *indexSnapshotMeta) encode() []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*(5+2*len(m.deadSizes)))
+	buf = binary.AppendUvarint(buf, uint64(m.fileID))
+	buf = binary.AppendVarint(buf, m.offset)
+	buf = binary.AppendUvarint(buf, m.seqNo)
+	buf = binary.AppendUvarint(buf, m.count)
+	buf = binary.AppendUvarint(buf, uint64(len(m.deadSizes)))
+	for fileID, size := range m.deadSizes {
+		buf = binary.AppendUvarint(buf, uint64(fileID))
+		buf = binary.AppendVarint(buf, size)
+	}
+	return buf
+}
+
+func decodeIndexSnapshotMeta(buf []byte) (*indexSnapshotMeta, error) {
+	var err error
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(buf)
+		if err != nil || n <= 0 {
+			err = errInvalidIndexSnapshot
+			return 0
+		}
+		buf = buf[n:]
+		return v
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(buf)
+		if err != nil || n <= 0 {
+			err = errInvalidIndexSnapshot
+			return 0
+		}
+		buf = buf[n:]
+		return v
+	}
+
+	meta := &indexSnapshotMeta{}
+	meta.fileID = uint32(uvarint())
+	meta.offset = varint()
+	meta.seqNo = uvarint()
+	meta.count = uvarint()
+	n := uvarint()
+	if err != nil || n > uint64(len(buf)) {
+		return nil, errInvalidIndexSnapshot
+	}
+	meta.deadSizes = make(map[uint32]int64, n)
+	for i := uint64(0); i < n; i++ {
+		fileID := uint32(uvarint())
+		meta.deadSizes[fileID] = varint()
+	}
+	if err != nil || len(buf) > 0 {
+		return nil, errInvalidIndexSnapshot
+	}
+	return meta, nil
+}
+
+// Checkpoint 将内存索引写入到索引快照中，重启时从快照加载索引，只需要重放快照之后写入的数据
+// Close 时会自动写入，B+ 树索引持久化在磁盘上不需要快照，只读模式下不做任何处理
+func (db *DB) Checkpoint() error {
+	if db.indexerType == BPlusTree || db.readOnly || db.rawLog {
+		return nil
+	}
+
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+
+	db.mu.RLock()
+	// 等待并行的索引更新完成，快照需要包含 offset 之前写入的所有数据的索引
+	db.applyMu.Lock()
+	unlock := func() {
+		db.applyMu.Unlock()
+		db.mu.RUnlock()
+	}
+	if db.activeFile == nil || db.indexSnapshot != nil &&
+		db.indexSnapshot.fileID == db.activeFile.FileID && db.indexSnapshot.offset == db.activeFile.WriteOffset {
+		// 上次快照之后没有新的写入
+		unlock()
+		return nil
+	}
+	// 快照只覆盖已经持久化的数据，断电之后快照中的位置依然有效
+	if err := db.activeFile.Sync(); err != nil {
+		unlock()
+		return err
+	}
+	meta := &indexSnapshotMeta{
+		fileID:    db.activeFile.FileID,
+		offset:    db.activeFile.WriteOffset,
+		seqNo:     db.seqNo,
+		deadSizes: maps.Clone(db.deadSizes),
+	}
+	indexer, err := db.indexer.Snapshot()
+	version := db.indexSnapshotVersion
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	// 写入时不持有 db 的锁，先写入临时文件，完成之后再替换
+	tempName := filepath.Join(db.dirPath, data.IndexSnapshotTempName)
+	err = db.writeIndexSnapshot(tempName, meta, indexer)
+	_ = indexer.Close()
+	if err != nil {
+		_ = db.fileSystem.Remove(tempName)
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// 写入期间 merge 重写了数据文件，快照中的位置已经失效
+	if db.indexSnapshotVersion != version {
+		return db.fileSystem.Remove(tempName)
+	}
+	if err := db.fileSystem.Rename(tempName, filepath.Join(db.dirPath, data.IndexSnapshotFileName)); err != nil {
+		return err
+	}
+	db.indexSnapshot = meta
+	return nil
+}
+
+// writeIndexSnapshot 写入索引快照，第一条记录是快照覆盖的范围，之后每条记录是一个 key 的位置索引
+func (db *DB) writeIndexSnapshot(fileName string, meta *indexSnapshotMeta, indexer index.Indexer) error {
+	if err := db.fileSystem.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	snapshotFile, err := db.openFile(fileName, 0, fio.StandardFileIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = snapshotFile.Close()
+	}()
+
+	count, err := indexer.Size()
+	if err != nil {
+		return err
+	}
+	meta.count = uint64(count)
+	buf, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte(indexSnapshotKey), Value: meta.encode()})
+
+	// 加密时每条记录需要单独加密写入
+	iter, err := indexer.Iterator(false)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if snapshotFile.Encrypted() || len(buf) >= indexSnapshotWriteSize {
+			if err := snapshotFile.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		record, _ := data.EncodeLogRecord(&data.LogRecord{Key: iter.Key(), Value: data.EncodeLogRecordPos(iter.Value())})
+		buf = append(buf, record...)
+	}
+	if err := snapshotFile.Write(buf); err != nil {
+		return err
+	}
+	return snapshotFile.Sync()
+}
+
+// loadIndexFromSnapshot 从索引快照中加载索引，返回快照覆盖的范围
+// 快照不存在时返回空，快照无效时丢弃已经加载的索引并返回空，此时需要从头加载数据文件
+func (db *DB) loadIndexFromSnapshot() (*indexSnapshotMeta, error) {
+	fileName := filepath.Join(db.dirPath, data.IndexSnapshotFileName)
+	if _, err := db.fileSystem.Stat(fileName); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	meta, err := db.readIndexSnapshot(fileName)
+	if err == nil {
+		db.indexSnapshot = meta
+		return meta, nil
+	}
+
+	log.Printf("bitcask: ignored index snapshot, loading index from data files: %v\n", err)
+	db.indexer, err = db.newIndexer()
+	if err != nil {
+		return nil, err
+	}
+	db.reclaimSize = 0
+	db.deadSizes = make(map[uint32]int64)
+	if db.readOnly {
+		return nil, nil
+	}
+	if err := db.fileSystem.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (db *DB) readIndexSnapshot(fileName string) (*indexSnapshotMeta, error) {
+	snapshotFile, err := db.openFile(fileName, 0, fio.ReadOnlyFileIO)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = snapshotFile.Close()
+	}()
+
+	record, offset, err := snapshotFile.ReadLogRecord(0)
+	if err != nil {
+		return nil, err
+	}
+	if string(record.Key) != indexSnapshotKey {
+		return nil, errInvalidIndexSnapshot
+	}
+	meta, err := decodeIndexSnapshotMeta(record.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	fileExists := func(fileID uint32) bool {
+		_, ok := db.oldFiles[fileID]
+		return ok || db.activeFile != nil && db.activeFile.FileID == fileID
+	}
+	// 快照覆盖的数据需要都还在数据文件中
+	if !fileExists(meta.fileID) {
+		return nil, errInvalidIndexSnapshot
+	}
+	dataFile := db.activeFile
+	if meta.fileID != dataFile.FileID {
+		dataFile = db.oldFiles[meta.fileID]
+	}
+	size, err := dataFile.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size < meta.offset {
+		return nil, errInvalidIndexSnapshot
+	}
+
+	now := time.Now().UnixNano()
+	for i := uint64(0); i < meta.count; i++ {
+		record, size, err := snapshotFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		offset += size
+
+		pos := data.DecodeLogRecordPos(record.Value)
+		if pos.FileID > meta.fileID || !fileExists(pos.FileID) {
+			return nil, errInvalidIndexSnapshot
+		}
+		// 已经过期的数据不再加载到索引中
+		if pos.IsExpired(now) {
+			db.markDead(pos)
+			continue
+		}
+		if _, err := db.indexer.Put(record.Key, pos); err != nil {
+			return nil, err
+		}
+	}
+	if _, _, err := snapshotFile.ReadLogRecord(offset); err != io.EOF {
+		return nil, errInvalidIndexSnapshot
+	}
+
+	for fileID, size := range meta.deadSizes {
+		db.deadSizes[fileID] += size
+		db.reclaimSize += size
+	}
+	return meta, nil
+}
+
+// removeIndexSnapshot merge 重写数据文件之前删除索引快照，快照中的位置在 merge 之后失效，需要持有 db 的锁
+func (db *DB) removeIndexSnapshot() error {
+	db.indexSnapshot = nil
+	db.indexSnapshotVersion++
+	err := db.fileSystem.Remove(filepath.Join(db.dirPath, data.IndexSnapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// startCheckpoint 启动定期写入索引快照的协程
+func (db *DB) startCheckpoint() {
+	if db.checkpointInterval <= 0 || db.indexerType == BPlusTree || db.readOnly {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	db.checkpointCancel = cancel
+	db.checkpointWg.Add(1)
+	go db.checkpoint(ctx)
+}
+
+// stopCheckpoint 停止定期写入索引快照的协程，可以重复调用
+func (db *DB) stopCheckpoint() {
+	if db.checkpointCancel == nil {
+		return
+	}
+	db.checkpointCancel()
+	db.checkpointWg.Wait()
+	db.checkpointCancel = nil
+}
+
+func (db *DB) checkpoint(ctx context.Context) {
+	defer db.checkpointWg.Done()
+
+	ticker := time.NewTicker(db.checkpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// 失败时等待下一次写入，之前的快照依然有效
+			if err := db.Checkpoint(); err != nil {
+				log.Printf("bitcask: failed to write index snapshot: %v\n", err)
+			}
+		}
+	}
+}
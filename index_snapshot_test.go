@@ -0,0 +1,142 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+)
+
+func TestDB_IndexSnapshot(t *testing.T) {
+	for _, indexerType := range []IndexerType{BTree, ART, ShardedBTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-index-snapshot")
+		opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024), WithDBDataFileMergeRatio(0), WithDBIndexerType(indexerType)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Delete(getTestKey(i)))
+		}
+		wb := db.NewWriteBatch()
+		assert.Nil(t, wb.Put([]byte("batch"), []byte("value")))
+		assert.Nil(t, wb.Commit())
+		seqNo := db.seqNo
+		reclaimable := dbStat(t, db).ReclaimableSize
+		assert.Nil(t, db.Close())
+
+		// 快照覆盖的数据不会再读取，旧数据文件中间损坏也不影响启动
+		fileName := data.GetDataFileName(dir, 0)
+		content, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		content[len(content)/2] ^= 0xff
+		assert.Nil(t, os.WriteFile(fileName, content, 0644))
+
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		assert.NotNil(t, db.indexSnapshot)
+		assert.Equal(t, uint(901), dbStat(t, db).KeyNum)
+		assert.Equal(t, seqNo, db.seqNo)
+		assert.Equal(t, reclaimable, dbStat(t, db).ReclaimableSize)
+		val, err := db.Get([]byte("batch"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), val)
+
+		// 快照之后写入的数据从快照的位置继续加载
+		for i := 0; i < 50; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		assert.Nil(t, db.Delete(getTestKey(999)))
+		assert.Nil(t, db.Close())
+
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, uint(950), dbStat(t, db).KeyNum)
+		_, err = db.Get(getTestKey(999))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Nil(t, db.Close())
+
+		// 快照损坏时从头加载数据文件
+		snapshotName := filepath.Join(dir, data.IndexSnapshotFileName)
+		stat, err := os.Stat(snapshotName)
+		assert.Nil(t, err)
+		assert.Nil(t, os.Truncate(snapshotName, stat.Size()/2))
+		_, err = Open(opts...)
+		assert.ErrorIs(t, err, data.ErrInvalidCRC)
+
+		db, err = Open(append(opts, WithDBTruncateCorruptedFiles(true))...)
+		assert.Nil(t, err)
+		assert.Nil(t, db.indexSnapshot)
+		_, err = db.Get(getTestKey(999))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(getTestKey(49))
+		assert.Nil(t, err)
+
+		// merge 之后快照中的位置失效
+		size := int(dbStat(t, db).KeyNum)
+		assert.Nil(t, db.Checkpoint())
+		_, err = os.Stat(snapshotName)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Merge())
+		_, err = os.Stat(snapshotName)
+		assert.True(t, os.IsNotExist(err))
+		keys, err := db.ListKeys()
+		assert.Nil(t, err)
+		assert.Equal(t, size, len(keys))
+		removeDB(db)
+	}
+}
+
+func TestDB_IndexSnapshot_PowerCut(t *testing.T) {
+	db, faultFS, reopenOpts := openFaultDB(t)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Checkpoint())
+	snapshot := db.indexSnapshot
+	assert.NotNil(t, snapshot)
+	// 没有新的写入时不重复写入快照
+	assert.Nil(t, db.Checkpoint())
+	assert.Same(t, snapshot, db.indexSnapshot)
+
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Sync())
+	for i := 600; i < 700; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, faultFS.PowerCut())
+	_ = db.Close()
+
+	// 快照之后持久化的数据重新加载，没有持久化的数据丢失
+	db, err := Open(reopenOpts...)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, snapshot.offset, db.indexSnapshot.offset)
+	for i := 0; i < 600; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get(getTestKey(699))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_IndexSnapshot_Interval(t *testing.T) {
+	memFS := fio.NewMemFileSystem()
+	dir := filepath.Join("/", "bitcask-go-checkpoint")
+	db, err := Open(WithDBDirPath(dir), WithDBFileSystem(memFS), WithDBCheckpointInterval(10*time.Millisecond))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	assert.Eventually(t, func() bool {
+		_, err := memFS.Stat(filepath.Join(dir, data.IndexSnapshotFileName))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
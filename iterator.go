@@ -2,7 +2,9 @@ package bitcask
 
 import (
 	"bytes"
+	"time"
 
+	"github.com/ysoding/bitcask/data"
 	"github.com/ysoding/bitcask/index"
 )
 
@@ -10,46 +12,87 @@ type Iterator struct {
 	iteratorOption
 	indexerIter index.Iterator
 	db          *DB
+	snapshot    *Snapshot                 // 不为空时从快照中读取数据
+	files       map[uint32]*data.DataFile // 迭代器创建时引用的数据文件
+
+	lower, upper []byte // 遍历的范围 [lower, upper)，为空表示不限制
+	done         bool   // 已经超出了遍历的范围
+	count        int    // Rewind 或者 Seek 之后已经遍历的 key 的数量
 }
 
-func (db *DB) NewIterator(opts ...IteratorOption) *Iterator {
+func (db *DB) NewIterator(opts ...IteratorOption) (*Iterator, error) {
+	return newIterator(db, nil, db.indexer, opts...)
+}
 
+func newIterator(db *DB, snapshot *Snapshot, indexer index.Indexer, opts ...IteratorOption) (*Iterator, error) {
 	iter := &Iterator{
 		db:             db,
+		snapshot:       snapshot,
 		iteratorOption: DefaultIteratorOption,
 	}
 
 	for _, opt := range opts {
 		opt(&iter.iteratorOption)
 	}
+	iter.lower, iter.upper = iter.bounds()
+
+	var err error
+	if snapshot == nil {
+		// 索引和数据文件需要在同一时刻获取，避免 merge 替换文件之后读到错误的数据
+		db.mu.RLock()
+		iter.indexerIter, err = indexer.Iterator(iter.reverse)
+		if err == nil && !iter.keyOnly {
+			iter.files = db.pinFiles()
+		}
+		db.mu.RUnlock()
+	} else {
+		iter.indexerIter, err = indexer.Iterator(iter.reverse)
+	}
+	if err != nil {
+		return nil, err
+	}
+	iter.Rewind()
 
-	indexerIter := db.indexer.Iterator(iter.reverse)
-	iter.indexerIter = indexerIter
-
-	return iter
+	return iter, nil
 }
 
 // Rewind 重新回到迭代器的起点，即第一个数据
 func (it *Iterator) Rewind() {
-	it.indexerIter.Rewind()
+	// 从范围的边界开始遍历，不需要从头跳过范围之外的 key
+	switch {
+	case !it.reverse && it.lower != nil:
+		it.indexerIter.Seek(it.lower)
+	case it.reverse && it.upper != nil:
+		it.indexerIter.Seek(it.upper)
+	default:
+		it.indexerIter.Rewind()
+	}
+	it.count = 0
 	it.skipToNext()
 }
 
 // Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
 func (it *Iterator) Seek(key []byte) {
+	if !it.reverse && it.lower != nil && bytes.Compare(key, it.lower) < 0 ||
+		it.reverse && it.upper != nil && bytes.Compare(key, it.upper) > 0 {
+		it.Rewind()
+		return
+	}
 	it.indexerIter.Seek(key)
+	it.count = 0
 	it.skipToNext()
 }
 
 // Next 跳转到下一个 key
 func (it *Iterator) Next() {
 	it.indexerIter.Next()
+	it.count++
 	it.skipToNext()
 }
 
 // Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
 func (it *Iterator) Valid() bool {
-	return it.indexerIter.Valid()
+	return !it.done && it.indexerIter.Valid() && (it.limit <= 0 || it.count < it.limit)
 }
 
 // Key 当前遍历位置的 Key 数据
@@ -59,28 +102,62 @@ func (it *Iterator) Key() []byte {
 
 // Value 当前遍历位置的 Value 数据
 func (it *Iterator) Value() ([]byte, error) {
+	if it.keyOnly {
+		return nil, ErrIteratorKeyOnly
+	}
+
 	logRecordPos := it.indexerIter.Value()
-	it.db.mu.RLock()
-	defer it.db.mu.RUnlock()
-	return it.db.getValueByIndexInfo(logRecordPos)
+	if it.snapshot != nil {
+		it.snapshot.mu.RLock()
+		defer it.snapshot.mu.RUnlock()
+		if it.snapshot.released {
+			return nil, ErrSnapshotReleased
+		}
+		return it.snapshot.getValueByIndexInfo(logRecordPos)
+	}
+
+	return readValue(it.files[logRecordPos.FileID], logRecordPos)
 }
 
 // Close 关闭迭代器，释放相应资源
-func (it *Iterator) Close() {
-	it.indexerIter.Close()
+func (it *Iterator) Close() error {
+	err := it.indexerIter.Close()
+	if it.files != nil {
+		it.files = nil
+		it.db.unpinFiles()
+	}
+	return err
 }
 
+// skipToNext 跳过范围之外以及已经过期的 key，超出遍历方向上的边界之后结束遍历
 func (it *Iterator) skipToNext() {
-	prefixLen := len(it.prefix)
-	if prefixLen == 0 {
-		return
-	}
+	it.done = false
+	now := time.Now().UnixNano()
 
 	for ; it.indexerIter.Valid(); it.indexerIter.Next() {
 		key := it.indexerIter.Key()
 
-		if prefixLen <= len(key) && bytes.Equal(it.prefix, key[:prefixLen]) {
-			break
+		if !it.reverse {
+			if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+				it.done = true
+				return
+			}
+			if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+				continue
+			}
+		} else {
+			if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+				it.done = true
+				return
+			}
+			// 反向遍历时 upper 本身不在范围内
+			if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+				continue
+			}
+		}
+		if it.indexerIter.Value().IsExpired(now) {
+			continue
 		}
+		break
 	}
 }
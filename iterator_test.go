@@ -3,6 +3,7 @@ package bitcask
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,7 +18,9 @@ func TestDB_NewIterator(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, db)
 
-	iterator := db.NewIterator()
+	iterator, err := db.NewIterator()
+
+	assert.Nil(t, err)
 	assert.NotNil(t, iterator)
 	assert.Equal(t, false, iterator.Valid())
 }
@@ -34,7 +37,9 @@ func TestDB_Iterator_One_Value(t *testing.T) {
 	err = db.Put(getTestKey(10), getTestKey(10))
 	assert.Nil(t, err)
 
-	iterator := db.NewIterator()
+	iterator, err := db.NewIterator()
+
+	assert.Nil(t, err)
 	defer iterator.Close()
 	assert.NotNil(t, iterator)
 	assert.Equal(t, true, iterator.Valid())
@@ -65,7 +70,8 @@ func TestDB_Iterator_Multi_Values(t *testing.T) {
 	assert.Nil(t, err)
 
 	// 正向迭代
-	iter1 := db.NewIterator()
+	iter1, err := db.NewIterator()
+	assert.Nil(t, err)
 	for iter1.Rewind(); iter1.Valid(); iter1.Next() {
 		assert.NotNil(t, iter1.Key())
 	}
@@ -76,7 +82,8 @@ func TestDB_Iterator_Multi_Values(t *testing.T) {
 	iter1.Close()
 
 	// 反向迭代
-	iter2 := db.NewIterator(WithIteratorReverse(true))
+	iter2, err := db.NewIterator(WithIteratorReverse(true))
+	assert.Nil(t, err)
 	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
 		assert.NotNil(t, iter2.Key())
 	}
@@ -87,9 +94,131 @@ func TestDB_Iterator_Multi_Values(t *testing.T) {
 	iter2.Close()
 
 	// 指定了 prefix
-	iter3 := db.NewIterator(WithIteratorPrefix([]byte("aee")))
+	iter3, err := db.NewIterator(WithIteratorPrefix([]byte("aee")))
+	assert.Nil(t, err)
 	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
 		assert.NotNil(t, iter3.Key())
 	}
 	iter3.Close()
 }
+
+func TestDB_Iterator_Expired(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-4")
+	opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(64 * 1024 * 1024)}
+
+	db, err := Open(opts...)
+	defer removeDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.PutWithTTL([]byte("aaa"), randomValue(10), time.Millisecond*50)
+	assert.Nil(t, err)
+	err = db.Put([]byte("bbb"), randomValue(10))
+	assert.Nil(t, err)
+	err = db.PutWithTTL([]byte("ccc"), randomValue(10), time.Millisecond*50)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 100)
+
+	iter, err := db.NewIterator()
+
+	assert.Nil(t, err)
+	defer iter.Close()
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	assert.Equal(t, [][]byte{[]byte("bbb")}, keys)
+}
+
+func TestDB_Iterator_Bounds(t *testing.T) {
+	for _, indexerType := range []IndexerType{BTree, ART, BPlusTree, ShardedBTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-iterator-5")
+		db, err := Open(WithDBDirPath(dir), WithDBIndexerType(indexerType))
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), getTestKey(i)))
+		}
+
+		collect := func(iter *Iterator) []string {
+			var res []string
+			for ; iter.Valid(); iter.Next() {
+				res = append(res, string(iter.Key()))
+			}
+			return res
+		}
+		// seq 返回 from 到 to（包含）之间的 key，from 大于 to 时为倒序
+		seq := func(from, to int) []string {
+			step := 1
+			if from > to {
+				step = -1
+			}
+			var res []string
+			for i := from; i != to+step; i += step {
+				res = append(res, string(getTestKey(i)))
+			}
+			return res
+		}
+
+		// [key10, key20)
+		iter, err := db.NewIterator(WithIteratorLowerBound(getTestKey(10)), WithIteratorUpperBound(getTestKey(20)))
+		assert.Nil(t, err)
+		assert.Equal(t, seq(10, 19), collect(iter))
+		iter.Seek(getTestKey(0))
+		assert.Equal(t, seq(10, 19), collect(iter))
+		iter.Seek(getTestKey(25))
+		assert.False(t, iter.Valid())
+		iter.Close()
+
+		iter, err = db.NewIterator(WithIteratorLowerBound(getTestKey(10)), WithIteratorUpperBound(getTestKey(20)), WithIteratorReverse(true))
+
+		assert.Nil(t, err)
+		assert.Equal(t, seq(19, 10), collect(iter))
+		iter.Seek(getTestKey(99))
+		assert.Equal(t, seq(19, 10), collect(iter))
+		iter.Seek(getTestKey(5))
+		assert.False(t, iter.Valid())
+		iter.Close()
+
+		// 前缀和边界同时生效
+		iter, err = db.NewIterator(WithIteratorPrefix([]byte("bitcask-go-key-00000008")))
+		assert.Nil(t, err)
+		assert.Equal(t, seq(80, 89), collect(iter))
+		iter.Close()
+		iter, err = db.NewIterator(WithIteratorPrefix([]byte("bitcask-go-key-00000008")), WithIteratorLowerBound(getTestKey(85)), WithIteratorReverse(true))
+		assert.Nil(t, err)
+		assert.Equal(t, seq(89, 85), collect(iter))
+		iter.Close()
+
+		// 反向遍历的边界不是已有的 key，或者大于所有的 key
+		iter, err = db.NewIterator(WithIteratorPrefix([]byte("bitcask-go-key-00000009")), WithIteratorReverse(true))
+		assert.Nil(t, err)
+		assert.Equal(t, seq(99, 90), collect(iter))
+		iter.Close()
+		iter, err = db.NewIterator(WithIteratorUpperBound(append(getTestKey(30), 'x')), WithIteratorLimit(3), WithIteratorReverse(true))
+		assert.Nil(t, err)
+		assert.Equal(t, seq(30, 28), collect(iter))
+		iter.Seek(append(getTestKey(20), 'x'))
+		assert.Equal(t, seq(20, 18), collect(iter))
+		iter.Close()
+
+		// Rewind 以及 Seek 之后重新计数
+		iter, err = db.NewIterator(WithIteratorLimit(3), WithIteratorReverse(true))
+		assert.Nil(t, err)
+		assert.Equal(t, seq(99, 97), collect(iter))
+		iter.Seek(getTestKey(50))
+		assert.Equal(t, seq(50, 48), collect(iter))
+		iter.Close()
+
+		// 只遍历 key 时不读取 value，也不引用数据文件
+		iter, err = db.NewIterator(WithIteratorKeyOnly(true), WithIteratorLowerBound(getTestKey(90)))
+		assert.Nil(t, err)
+		assert.Equal(t, 0, db.filePins)
+		assert.True(t, iter.Valid())
+		_, err = iter.Value()
+		assert.Equal(t, ErrIteratorKeyOnly, err)
+		assert.Equal(t, seq(90, 99), collect(iter))
+		iter.Close()
+
+		removeDB(db)
+	}
+}
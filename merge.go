@@ -1,15 +1,17 @@
 package bitcask
 
 import (
+	"context"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/ysoding/bitcask/data"
-	"github.com/ysoding/bitcask/utils"
+	"github.com/ysoding/bitcask/fio"
 )
 
 const (
@@ -18,58 +20,82 @@ const (
 )
 
 // Merge 清理无效数据，生成 Hint 文件
+// 默认重写所有的旧数据文件，指定 WithMergeGarbageRatio 或者 WithMergeTopN 时只重写部分数据文件
+func (db *DB) Merge(opts ...MergeOption) error {
+	return db.MergeContext(context.Background(), opts...)
+}
+
+// MergeContext 同 Merge，ctx 取消之后在处理下一条数据之前停止并返回 ctx 的错误，数据库保持一致
+// 全量 merge 取消时丢弃整个 merge 目录，已经重写的数据需要重新 merge；增量 merge 已经完成替换的数据文件依然有效
+func (db *DB) MergeContext(ctx context.Context, opts ...MergeOption) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	mergeOpt := DefaultMergeOption
+	for _, opt := range opts {
+		opt(&mergeOpt)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-func (db *DB) Merge() error {
-	db.mu.Lock()
+	runner := newMergeRunner(ctx, mergeOpt)
+	if mergeOpt.garbageRatio > 0 || mergeOpt.topN > 0 {
+		return db.mergeIncremental(runner)
+	}
+
+	db.lock()
 
 	if db.activeFile == nil {
+		db.unlock()
 		return nil
 	}
 
 	if db.isMerging {
-		db.mu.Unlock()
+		db.unlock()
 		return ErrMergeIsProgress
 	}
 
 	// 查看可以 merge 的数据量是否达到了阈值
-	totalSize, err := utils.DirSize(db.dirPath)
+	totalSize, err := fio.DirSize(db.fileSystem, db.dirPath)
 	if err != nil {
-		db.mu.Unlock()
+		db.unlock()
+		return err
 	}
 
 	if float32(db.reclaimSize)/float32(totalSize) < db.dataFileMergeRatio {
-		db.mu.Unlock()
+		db.unlock()
 		return ErrMergeRatioUnreached
 	}
 
 	// 查看剩余的空间容量是否可以容纳 merge 之后的数据量
-	availableDiskSize, err := utils.AvailableDiskSize()
+	availableDiskSize, err := db.fileSystem.AvailableSize(db.dirPath)
 	if err != nil {
-		db.mu.Unlock()
+		db.unlock()
 		return err
 	}
 	if uint64(totalSize-db.reclaimSize) >= availableDiskSize {
-		db.mu.Unlock()
+		db.unlock()
 		return ErrNoEnoughSpaceForMerge
 	}
 
 	db.isMerging = true
 	defer func() {
+		db.mu.Lock()
 		db.isMerging = false
+		db.mu.Unlock()
 	}()
 
-	// 持久化当前活跃文件
-	if err := db.activeFile.Sync(); err != nil {
-		db.mu.Unlock()
+	// 持久化当前活跃文件，并将它转换为旧的数据文件
+	if err := db.sealActiveFile(); err != nil {
+		db.unlock()
 		return err
 	}
-
-	// 将当前活跃文件转换为旧的数据文件
-	db.oldFiles[db.activeFile.FileID] = db.activeFile
 	// 打开新的活跃文件
 	if err := db.updateActiveDataFile(); err != nil {
-		db.mu.Unlock()
-		return nil
+		db.unlock()
+		return err
 	}
 
 	// 记录最近没有参与 merge 的文件 id
@@ -80,42 +106,65 @@ func (db *DB) Merge() error {
 	for _, file := range db.oldFiles {
 		mergeFiles = append(mergeFiles, file)
 	}
-	db.mu.Unlock()
+	db.unlock()
 
 	//	待 merge 的文件从小到大进行排序，依次 merge
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileID < mergeFiles[j].FileID
 	})
 
+	runner.progress.FilesTotal = len(mergeFiles)
+	expiredKeys, err := db.writeMergeFiles(runner, mergeFiles, nonMergeFileId)
+	if err != nil {
+		// 没有完成的 merge 目录直接删除
+		_ = db.fileSystem.RemoveAll(db.getMergePath())
+		return err
+	}
+
+	// 将 merge 之后的文件替换到数据目录中，不需要重启
+	return db.applyMergeFiles(nonMergeFileId, expiredKeys)
+}
+
+// writeMergeFiles 将有效的数据重写到 merge 目录中，返回因为过期而被丢弃的 key
+func (db *DB) writeMergeFiles(runner *mergeRunner, mergeFiles []*data.DataFile, nonMergeFileId uint32) ([][]byte, error) {
 	mergePath := db.getMergePath()
 	// 如果目录存在，说明发生过 merge，将其删除掉
-	if _, err := os.Stat(mergePath); err == nil {
-		if err := os.RemoveAll(mergePath); err != nil {
-			return err
+	if _, err := db.fileSystem.Stat(mergePath); err == nil {
+		if err := db.fileSystem.RemoveAll(mergePath); err != nil {
+			return nil, err
 		}
 	}
 
 	// 新建一个 merge path 的目录
-	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
-		return err
+	if err := db.fileSystem.MkdirAll(mergePath); err != nil {
+		return nil, err
 	}
 
 	// 打开一个新的临时 bitcask 实例
-	mergeDB, err := Open(WithDBDirPath(mergePath))
+	mergeDB, err := Open(WithDBDirPath(mergePath), WithDBFileSystem(db.fileSystem))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer func() {
+		_ = mergeDB.Close()
+	}()
 	mergeDB.option = db.option
 	mergeDB.dirPath = mergePath
 	mergeDB.syncWrite = false
+	mergeDB.rawLog = true
 
 	// 打开 hint 文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := db.openFile(filepath.Join(mergePath, data.HintFileName), 0, fio.StandardFileIO)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
 
 	// 遍历处理每个数据文件
+	var expiredKeys [][]byte
+	now := time.Now().UnixNano()
 	for _, dataFile := range mergeFiles {
 		offset := int64(0)
 		for {
@@ -124,71 +173,241 @@ func (db *DB) Merge() error {
 				if err == io.EOF {
 					break
 				}
-				return err
+				return nil, err
+			}
+
+			if err := runner.read(size); err != nil {
+				return nil, err
 			}
 
 			realKey, _ := parseLogRecordKey(logRecord.Key)
-			logRecordPos := db.indexer.Get(realKey)
+			logRecordPos, err := db.indexer.Get(realKey)
+			if err != nil {
+				return nil, err
+			}
 
-			// 和内存中的索引位置进行比较，如果有效则重写
-			if logRecordPos != nil && logRecordPos.FileID == dataFile.FileID && logRecordPos.Offset == offset {
+			// 和内存中的索引位置进行比较，如果有效则重写，已经过期的数据直接丢弃
+			if logRecordPos != nil && logRecordPos.FileID == dataFile.FileID && logRecordPos.Offset == offset &&
+				!logRecordPos.IsExpired(now) {
 				// 清除事务标记
 				logRecord.Key = logRecordKeyWithSeqNo(realKey, nonTransactionSeqNo)
 				pos, err := mergeDB.appendLogRecord(logRecord)
 				if err != nil {
-					return err
+					return nil, err
 				}
+				runner.write(int64(pos.Size))
 
 				// 将当前位置索引写到 Hint 文件当中
 				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
-					return err
+					return nil, err
+				}
+			} else {
+				if logRecordPos != nil && logRecordPos.FileID == dataFile.FileID && logRecordPos.Offset == offset {
+					expiredKeys = append(expiredKeys, realKey)
 				}
+				runner.drop()
 			}
 
 			offset += size
 		}
+		runner.fileDone()
 	}
 
 	// sync 保证持久化
 	if err := hintFile.Sync(); err != nil {
-		return err
+		return nil, err
 	}
 	if err := mergeDB.Sync(); err != nil {
-		return err
+		return nil, err
 	}
 
 	// 写标识 merge 完成的文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
+	mergeFinishedFile, err := db.openFile(filepath.Join(mergePath, data.MergeFinishedFileName), 0, fio.StandardFileIO)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
 	mergeFinRecord := &data.LogRecord{
 		Key:   []byte(mergeFinishedKey),
 		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
 	}
 	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
 	if err := mergeFinishedFile.Write(encRecord); err != nil {
-		return err
+		return nil, err
 	}
 	if err := mergeFinishedFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	return expiredKeys, nil
+}
+
+// applyMergeFiles 在线替换 merge 之后的数据文件，并将索引指向新的位置
+func (db *DB) applyMergeFiles(nonMergeFileId uint32, expiredKeys [][]byte) error {
+	db.lock()
+	defer db.unlock()
+
+	if err := db.installMergeFiles(db.getMergePath(), nonMergeFileId); err != nil {
+		return err
+	}
+	// merge 之后的数据文件使用相同的文件 id，缓存中的位置已经失效
+	if db.valueCache != nil {
+		db.valueCache.purge()
+	}
+
+	// 将旧的数据文件替换为 merge 之后的数据文件
+	var retired []*data.DataFile
+	for fileID, dataFile := range db.oldFiles {
+		if fileID < nonMergeFileId {
+			retired = append(retired, dataFile)
+			delete(db.oldFiles, fileID)
+			db.resetDeadSize(fileID)
+		}
+	}
+	db.retireFiles(retired)
+
+	fileIDs, err := getDataFileIDs(db.fileSystem, db.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, fileID := range fileIDs {
+		if uint32(fileID) >= nonMergeFileId {
+			break
+		}
+		dataFile, err := db.openDataFile(db.dirPath, uint32(fileID), fio.StandardFileIO)
+		if err != nil {
+			return err
+		}
+		db.oldFiles[uint32(fileID)] = dataFile
+	}
+
+	// 更新内存索引，merge 期间被修改过的 key 对应的数据已经无效
+	if err := db.repointIndexFromHintFile(nonMergeFileId); err != nil {
 		return err
 	}
+	for _, key := range expiredKeys {
+		pos, err := db.indexer.Get(key)
+		if err != nil {
+			return err
+		}
+		if pos != nil && pos.FileID < nonMergeFileId {
+			if _, _, err := db.indexer.Delete(key); err != nil {
+				return indexUpdateErr(err)
+			}
+		}
+	}
 
 	return nil
 }
 
+// repointIndexFromHintFile 根据 hint 文件将仍然指向旧数据文件的索引更新到 merge 之后的位置，
+// merge 期间被修改过的 key 在新文件中的数据已经无效
+func (db *DB) repointIndexFromHintFile(nonMergeFileId uint32) error {
+	hintFile, err := db.openFile(filepath.Join(db.dirPath, data.HintFileName), 0, fio.StandardFileIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	offset := int64(0)
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		offset += size
+
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		oldPos, err := db.indexer.Get(logRecord.Key)
+		if err != nil {
+			return err
+		}
+		if oldPos != nil && oldPos.FileID < nonMergeFileId {
+			if _, err := db.indexer.Put(logRecord.Key, pos); err != nil {
+				return indexUpdateErr(err)
+			}
+		} else {
+			db.markDead(pos)
+		}
+	}
+
+	return nil
+}
+
+// installMergeFiles 将 merge 目录中的文件替换到数据目录中
+// 先删除被 merge 的旧数据文件，再将新的文件硬链接过来，标识 merge 完成的文件最后链接，
+// 最后删除 merge 目录。中途崩溃的话重启时会从 merge 目录重新执行，因此可以重复调用
+func (db *DB) installMergeFiles(mergePath string, nonMergeFileId uint32) error {
+	dirEntries, err := db.fileSystem.ReadDir(mergePath)
+	if err != nil {
+		return err
+	}
+
+	var mergeFileNames []string
+	for _, entry := range dirEntries {
+		if entry.Name() == data.SeqNoFileName || entry.Name() == fileLockName ||
+			entry.Name() == data.MergeFinishedFileName {
+			continue
+		}
+		mergeFileNames = append(mergeFileNames, entry.Name())
+	}
+	mergeFileNames = append(mergeFileNames, data.MergeFinishedFileName)
+
+	if err := db.removeIndexSnapshot(); err != nil {
+		return err
+	}
+
+	// 删除旧的数据文件
+	for fileID := uint32(0); fileID < nonMergeFileId; fileID++ {
+		filename := data.GetDataFileName(db.dirPath, fileID)
+		if err := db.fileSystem.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		hintFilename := data.GetDataHintFileName(db.dirPath, fileID)
+		if err := db.fileSystem.Remove(hintFilename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// 将新的文件链接到数据目录中
+	for _, filename := range mergeFileNames {
+		srcPath := filepath.Join(mergePath, filename)
+		destPath := filepath.Join(db.dirPath, filename)
+		if err := db.fileSystem.Remove(destPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := db.fileSystem.Link(srcPath, destPath); err != nil {
+			return err
+		}
+	}
+
+	return db.fileSystem.RemoveAll(mergePath)
+}
+
 func (db *DB) getMergePath() string {
-	dir := path.Dir(path.Clean(db.dirPath))
-	base := path.Base(db.dirPath)
+	return getMergePath(db.dirPath)
+}
+
+func getMergePath(dirPath string) string {
+	dir := path.Dir(path.Clean(dirPath))
+	base := path.Base(dirPath)
 	return filepath.Join(dir, base+mergeDirName)
 }
 
 func (db *DB) getNonMergeFileID(dirPath string) (uint32, error) {
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+	mergeFinishedFile, err := db.openFile(filepath.Join(dirPath, data.MergeFinishedFileName), 0, fio.ReadOnlyFileIO)
 	if err != nil {
 		return 0, err
 	}
 	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	_ = mergeFinishedFile.Close()
 	if err != nil {
 		return 0, err
 	}
@@ -198,3 +417,127 @@ func (db *DB) getNonMergeFileID(dirPath string) (uint32, error) {
 	}
 	return uint32(nonMergeFileId), nil
 }
+
+// startAutoMerge 启动后台自动 merge 的协程
+func (db *DB) startAutoMerge() {
+	if db.autoMergeInterval <= 0 || db.readOnly {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	db.autoMergeCancel = cancel
+	db.autoMergeWg.Add(1)
+	go db.autoMerge(ctx)
+}
+
+// stopAutoMerge 停止后台自动 merge 的协程，可以重复调用
+func (db *DB) stopAutoMerge() {
+	if db.autoMergeCancel == nil {
+		return
+	}
+	db.autoMergeCancel()
+	db.autoMergeWg.Wait()
+	db.autoMergeCancel = nil
+}
+
+func (db *DB) autoMerge(ctx context.Context) {
+	defer db.autoMergeWg.Done()
+
+	ticker := time.NewTicker(db.autoMergeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !inTimeWindow(now, db.autoMergeWindowStart, db.autoMergeWindowEnd) {
+				continue
+			}
+			// 未达到阈值、磁盘空间不足或者正在 merge 时等待下一次检查
+			_ = db.MergeContext(ctx)
+		}
+	}
+}
+
+// inTimeWindow 判断 now 是否在每天的 [start, end) 时间段内
+func inTimeWindow(now time.Time, start, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	if start < end {
+		return offset >= start && offset < end
+	}
+	// 时间段跨越零点
+	return offset >= start || offset < end
+}
+
+// MergeProgress merge 的进度
+type MergeProgress struct {
+	FilesTotal     int   // 需要 merge 的数据文件数量
+	FilesDone      int   // 已经处理完成的数据文件数量
+	BytesRead      int64 // 已经读取的数据量
+	BytesWritten   int64 // 已经重写的数据量
+	RecordsDropped int64 // 丢弃的无效数据条数
+}
+
+// 每处理这么多条数据回调一次进度
+const mergeProgressInterval = 1024
+
+// mergeRunner 负责 merge 过程中的取消、限速以及进度回调
+type mergeRunner struct {
+	ctx      context.Context
+	opt      mergeOption
+	start    time.Time
+	records  int
+	progress MergeProgress
+}
+
+func newMergeRunner(ctx context.Context, opt mergeOption) *mergeRunner {
+	return &mergeRunner{ctx: ctx, opt: opt, start: time.Now()}
+}
+
+// read 每读取一条数据调用一次，检查是否已经取消，并根据限速进行等待
+func (r *mergeRunner) read(size int64) error {
+	r.progress.BytesRead += size
+	r.records++
+	if r.records%mergeProgressInterval == 0 {
+		r.report()
+	}
+
+	if r.opt.bytesPerSecond > 0 {
+		expected := time.Duration(float64(r.progress.BytesRead) / float64(r.opt.bytesPerSecond) * float64(time.Second))
+		if wait := expected - time.Since(r.start); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-r.ctx.Done():
+			case <-timer.C:
+			}
+		}
+	}
+
+	return r.ctx.Err()
+}
+
+func (r *mergeRunner) write(size int64) {
+	r.progress.BytesWritten += size
+}
+
+func (r *mergeRunner) drop() {
+	r.progress.RecordsDropped++
+}
+
+func (r *mergeRunner) fileDone() {
+	r.progress.FilesDone++
+	r.report()
+}
+
+func (r *mergeRunner) report() {
+	if r.opt.progress != nil {
+		r.opt.progress(r.progress)
+	}
+}
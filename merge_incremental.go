@@ -0,0 +1,468 @@
+package bitcask
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+)
+
+// 单文件 hint 的第一条记录，保存对应数据文件的大小，用于判断 hint 是否与数据文件匹配
+const dataHintSizeKey = "data.size"
+
+// compactedRecord 增量 merge 时重写的有效数据
+type compactedRecord struct {
+	key    []byte
+	offset int64              // 在原数据文件中的位置
+	pos    *data.LogRecordPos // 在新数据文件中的位置，为空表示数据已经过期被丢弃
+}
+
+// mergeIncremental 增量 merge，只重写无效数据较多的旧数据文件
+// 每个数据文件原地重写，文件 id 保持不变，因此重启时按照文件 id 顺序加载的结果不受影响
+func (db *DB) mergeIncremental(runner *mergeRunner) error {
+	db.lock()
+
+	if db.isMerging {
+		db.unlock()
+		return ErrMergeIsProgress
+	}
+
+	mergeFiles, liveSize, err := db.pickMergeFiles(runner.opt)
+	if err != nil {
+		db.unlock()
+		return err
+	}
+	if len(mergeFiles) == 0 {
+		db.unlock()
+		return ErrMergeRatioUnreached
+	}
+
+	// 查看剩余的空间容量是否可以容纳 merge 之后的数据量
+	availableDiskSize, err := db.fileSystem.AvailableSize(db.dirPath)
+	if err != nil {
+		db.unlock()
+		return err
+	}
+	if uint64(liveSize) >= availableDiskSize {
+		db.unlock()
+		return ErrNoEnoughSpaceForMerge
+	}
+
+	// 比这个 id 小的数据文件由全量 merge 生成，每个 key 只会出现一次
+	nonMergeFileId := uint32(0)
+	if _, err := db.fileSystem.Stat(filepath.Join(db.dirPath, data.MergeFinishedFileName)); err == nil {
+		if nonMergeFileId, err = db.getNonMergeFileID(db.dirPath); err != nil {
+			db.unlock()
+			return err
+		}
+	}
+	minFileID := mergeFiles[0].FileID
+	for fileID := range db.oldFiles {
+		if fileID < minFileID {
+			minFileID = fileID
+		}
+	}
+
+	db.isMerging = true
+	defer func() {
+		db.mu.Lock()
+		db.isMerging = false
+		db.mu.Unlock()
+	}()
+	db.unlock()
+
+	// 重写的文件先写到 merge 目录中，完成之后再替换到数据目录
+	mergePath := db.getMergePath()
+	if err := db.fileSystem.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	if err := db.fileSystem.MkdirAll(mergePath); err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.fileSystem.RemoveAll(mergePath)
+	}()
+
+	// 每个文件重写完成之后立即替换，取消时已经完成的文件依然有效
+	runner.progress.FilesTotal = len(mergeFiles)
+	for _, dataFile := range mergeFiles {
+		// 更早的数据文件中可能还有相同 key 的旧数据，需要保留删除标识
+		keepTombstone := dataFile.FileID > minFileID && dataFile.FileID >= nonMergeFileId
+		if err := db.mergeDataFile(runner, mergePath, dataFile, keepTombstone); err != nil {
+			return err
+		}
+		runner.fileDone()
+	}
+
+	return nil
+}
+
+// pickMergeFiles 选出需要重写的旧数据文件，按照文件 id 从小到大排序，同时返回其中有效的数据量，需要持有 db 的锁
+func (db *DB) pickMergeFiles(opt mergeOption) ([]*data.DataFile, int64, error) {
+	fileStats, err := db.getDataFileStats()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var candidates []DataFileStat
+	for _, stat := range fileStats {
+		// 活跃文件不参与 merge
+		if db.activeFile != nil && stat.FileID == db.activeFile.FileID {
+			continue
+		}
+		if stat.Size == 0 || stat.DeadSize == 0 {
+			continue
+		}
+		if float32(stat.DeadSize)/float32(stat.Size) < opt.garbageRatio {
+			continue
+		}
+		candidates = append(candidates, stat)
+	}
+
+	// 无效数据比例从高到低排序
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].DeadSize*candidates[j].Size > candidates[j].DeadSize*candidates[i].Size
+	})
+	if opt.topN > 0 && len(candidates) > opt.topN {
+		candidates = candidates[:opt.topN]
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].FileID < candidates[j].FileID
+	})
+
+	var liveSize int64
+	mergeFiles := make([]*data.DataFile, 0, len(candidates))
+	for _, stat := range candidates {
+		mergeFiles = append(mergeFiles, db.oldFiles[stat.FileID])
+		liveSize += stat.LiveSize
+	}
+	return mergeFiles, liveSize, nil
+}
+
+// mergeDataFile 原地重写单个数据文件，只保留有效的数据，并生成该文件的 hint 文件
+func (db *DB) mergeDataFile(runner *mergeRunner, mergePath string, dataFile *data.DataFile, keepTombstone bool) error {
+	fileID := dataFile.FileID
+	mergeFile, err := db.openDataFile(mergePath, fileID, fio.StandardFileIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = mergeFile.Close()
+	}()
+
+	var records []*compactedRecord
+	var deadPositions []*data.LogRecordPos // 重写之后依然无效的数据，例如保留的删除标识
+	hintable := true                       // 只包含普通数据时才可以生成 hint 文件
+
+	write := func(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+		encRecord, _ := db.encodeLogRecord(logRecord)
+		offset := mergeFile.WriteOffset
+		if err := mergeFile.Write(encRecord); err != nil {
+			return nil, err
+		}
+		size := mergeFile.WriteOffset - offset
+		runner.write(size)
+		return &data.LogRecordPos{FileID: fileID, Offset: offset, Size: uint32(size), Expire: logRecord.Expire}, nil
+	}
+
+	now := time.Now().UnixNano()
+	firstSeqNo := nonTransactionSeqNo
+	offset := int64(0)
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if err := runner.read(size); err != nil {
+			return err
+		}
+
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+		if offset == 0 {
+			firstSeqNo = seqNo
+		}
+
+		switch logRecord.Type {
+		case data.LogRecordTxnFinished:
+			// 文件开头的事务可能有一部分数据在上一个文件中，需要保留事务完成的标识
+			if seqNo != nonTransactionSeqNo && seqNo == firstSeqNo {
+				pos, err := write(logRecord)
+				if err != nil {
+					return err
+				}
+				deadPositions = append(deadPositions, pos)
+				hintable = false
+			} else {
+				runner.drop()
+			}
+		case data.LogRecordDeleted:
+			// key 已经不存在，更早的数据文件中可能还有它的旧数据，保留删除标识
+			logRecordPos, err := db.indexer.Get(realKey)
+			if err != nil {
+				return err
+			}
+			if keepTombstone && logRecordPos == nil {
+				pos, err := write(&data.LogRecord{
+					Key:  logRecordKeyWithSeqNo(realKey, nonTransactionSeqNo),
+					Type: data.LogRecordDeleted,
+				})
+				if err != nil {
+					return err
+				}
+				deadPositions = append(deadPositions, pos)
+				hintable = false
+			} else {
+				runner.drop()
+			}
+		default:
+			logRecordPos, err := db.indexer.Get(realKey)
+			if err != nil {
+				return err
+			}
+			if logRecordPos == nil || logRecordPos.FileID != fileID || logRecordPos.Offset != offset {
+				runner.drop()
+				break
+			}
+
+			if logRecordPos.IsExpired(now) {
+				runner.drop()
+				// 已经过期的数据丢弃，必要时改写为删除标识
+				records = append(records, &compactedRecord{key: realKey, offset: offset})
+				if keepTombstone {
+					pos, err := write(&data.LogRecord{
+						Key:  logRecordKeyWithSeqNo(realKey, nonTransactionSeqNo),
+						Type: data.LogRecordDeleted,
+					})
+					if err != nil {
+						return err
+					}
+					deadPositions = append(deadPositions, pos)
+					hintable = false
+				}
+				break
+			}
+
+			// 清除事务标记
+			logRecord.Key = logRecordKeyWithSeqNo(realKey, nonTransactionSeqNo)
+			pos, err := write(logRecord)
+			if err != nil {
+				return err
+			}
+			records = append(records, &compactedRecord{key: realKey, offset: offset, pos: pos})
+		}
+
+		offset += size
+	}
+
+	// 没有可以回收的空间，并且已经使用当前的密钥加密
+	if mergeFile.WriteOffset >= offset && mergeFile.KeyID() == dataFile.KeyID() {
+		return nil
+	}
+
+	if err := mergeFile.Sync(); err != nil {
+		return err
+	}
+
+	if hintable {
+		if err := db.writeDataHintFile(mergePath, fileID, mergeFile.WriteOffset, records); err != nil {
+			return err
+		}
+	}
+
+	return db.applyMergeDataFile(mergePath, fileID, hintable, records, deadPositions)
+}
+
+// writeDataHintFile 生成单个数据文件的 hint 文件
+func (db *DB) writeDataHintFile(dirPath string, fileID uint32, dataSize int64, records []*compactedRecord) error {
+	hintFile, err := db.openFile(data.GetDataHintFileName(dirPath, fileID), fileID, fio.StandardFileIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	sizeRecord := &data.LogRecord{
+		Key:   []byte(dataHintSizeKey),
+		Value: []byte(strconv.FormatInt(dataSize, 10)),
+	}
+	encRecord, _ := data.EncodeLogRecord(sizeRecord)
+	if err := hintFile.Write(encRecord); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if record.pos == nil {
+			continue
+		}
+		if err := hintFile.WriteHintRecord(record.key, record.pos); err != nil {
+			return err
+		}
+	}
+	return hintFile.Sync()
+}
+
+// applyMergeDataFile 将重写之后的数据文件替换到数据目录中，并更新内存索引
+func (db *DB) applyMergeDataFile(mergePath string, fileID uint32, hintable bool,
+	records []*compactedRecord, deadPositions []*data.LogRecordPos) error {
+	db.lock()
+	defer db.unlock()
+
+	if err := db.removeIndexSnapshot(); err != nil {
+		return err
+	}
+
+	// 先替换 hint 文件再替换数据文件，hint 文件中记录了数据文件的大小，中途崩溃时不会误用
+	hintFileName := data.GetDataHintFileName(db.dirPath, fileID)
+	if hintable {
+		if err := db.fileSystem.Rename(data.GetDataHintFileName(mergePath, fileID), hintFileName); err != nil {
+			return err
+		}
+	} else if err := db.fileSystem.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := db.fileSystem.Rename(data.GetDataFileName(mergePath, fileID), data.GetDataFileName(db.dirPath, fileID)); err != nil {
+		return err
+	}
+
+	dataFile, err := db.openDataFile(db.dirPath, fileID, fio.StandardFileIO)
+	if err != nil {
+		return err
+	}
+	if oldFile, ok := db.oldFiles[fileID]; ok {
+		db.retireFiles([]*data.DataFile{oldFile})
+	}
+	db.oldFiles[fileID] = dataFile
+	// 重写之后的数据文件使用相同的文件 id，缓存中的位置已经失效
+	if db.valueCache != nil {
+		db.valueCache.purge()
+	}
+
+	// 更新内存索引，重写期间被修改过的 key 对应的数据已经无效
+	db.resetDeadSize(fileID)
+	for _, pos := range deadPositions {
+		db.markDead(pos)
+	}
+	for _, record := range records {
+		oldPos, err := db.indexer.Get(record.key)
+		if err != nil {
+			return err
+		}
+		stale := oldPos == nil || oldPos.FileID != fileID || oldPos.Offset != record.offset
+		switch {
+		case record.pos == nil:
+			if !stale {
+				if _, _, err := db.indexer.Delete(record.key); err != nil {
+					return indexUpdateErr(err)
+				}
+			}
+		case stale:
+			db.markDead(record.pos)
+		default:
+			if _, err := db.indexer.Put(record.key, record.pos); err != nil {
+				return indexUpdateErr(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getValidDataHints 找出与数据文件匹配的单文件 hint，只有被增量 merge 重写过的数据文件才会有
+// 活跃文件需要扫描得到写入位置，不使用 hint
+func (db *DB) getValidDataHints() (map[uint32]struct{}, error) {
+	hints := make(map[uint32]struct{})
+	for fileID, dataFile := range db.oldFiles {
+		hintFileName := data.GetDataHintFileName(db.dirPath, fileID)
+		if _, err := db.fileSystem.Stat(hintFileName); os.IsNotExist(err) {
+			continue
+		}
+
+		hintFile, err := db.openFile(hintFileName, fileID, fio.ReadOnlyFileIO)
+		if err != nil {
+			return nil, err
+		}
+		record, _, err := hintFile.ReadLogRecord(0)
+		_ = hintFile.Close()
+		if err != nil {
+			if err == io.EOF || err == data.ErrInvalidCRC {
+				continue
+			}
+			return nil, err
+		}
+
+		dataSize, err := dataFile.Size()
+		if err != nil {
+			return nil, err
+		}
+		if string(record.Key) == dataHintSizeKey && string(record.Value) == strconv.FormatInt(dataSize, 10) {
+			hints[fileID] = struct{}{}
+		}
+	}
+	return hints, nil
+}
+
+// loadIndexFromDataHintFile 遍历单文件 hint 中的索引信息
+func (db *DB) loadIndexFromDataHintFile(fileID uint32, fn func(key []byte, pos *data.LogRecordPos) error) error {
+	hintFile, err := db.openFile(data.GetDataHintFileName(db.dirPath, fileID), fileID, fio.ReadOnlyFileIO)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	// 跳过记录数据文件大小的第一条记录
+	_, offset, err := hintFile.ReadLogRecord(0)
+	if err != nil {
+		return err
+	}
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		offset += size
+		if err := fn(logRecord.Key, data.DecodeLogRecordPos(logRecord.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repointIndexFromDataHints B+ 树索引持久化在磁盘上，增量 merge 中途崩溃时可能还指向数据文件重写之前的位置，
+// 根据单文件 hint 重新更新索引
+func (db *DB) repointIndexFromDataHints() error {
+	dataHints, err := db.getValidDataHints()
+	if err != nil {
+		return err
+	}
+
+	for fileID := range dataHints {
+		err := db.loadIndexFromDataHintFile(fileID, func(key []byte, pos *data.LogRecordPos) error {
+			oldPos, err := db.indexer.Get(key)
+			if err != nil || oldPos == nil || oldPos.FileID != fileID {
+				return err
+			}
+			if _, err := db.indexer.Put(key, pos); err != nil {
+				return indexUpdateErr(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
+)
+
+func TestDB_Stat_DataFiles(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-incr-1")
+	db, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	// 覆盖写第一个文件中的部分数据
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+
+	stat := dbStat(t, db)
+	assert.Equal(t, int(stat.DataFileNum), len(stat.DataFiles))
+	assert.Greater(t, stat.DataFiles[0].DeadSize, int64(0))
+	assert.Equal(t, int64(0), stat.DataFiles[1].DeadSize)
+
+	var deadSize int64
+	for _, fileStat := range stat.DataFiles {
+		assert.Equal(t, fileStat.Size, fileStat.LiveSize+fileStat.DeadSize)
+		deadSize += fileStat.DeadSize
+	}
+	assert.Equal(t, stat.ReclaimableSize, deadSize)
+
+	// 重启之后统计信息保持一致
+	assert.Nil(t, db.Close())
+	db2, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024))
+	assert.Nil(t, err)
+	stat2 := dbStat(t, db2)
+	assert.Equal(t, stat.ReclaimableSize, stat2.ReclaimableSize)
+	assert.Equal(t, stat.DataFiles[0].DeadSize, stat2.DataFiles[0].DeadSize)
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_Merge_Incremental(t *testing.T) {
+	for _, typ := range []IndexerType{BTree, BPlusTree, ShardedBTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-merge-incr-2")
+		opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024), WithDBIndexerType(typ)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		// 第一个文件中的大部分数据被覆盖
+		for i := 0; i < 150; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		// 少量删除
+		assert.Nil(t, db.Delete(getTestKey(500)))
+
+		expected := make(map[string][]byte)
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(getTestKey(i))
+			if i != 500 {
+				assert.Nil(t, err)
+				expected[string(getTestKey(i))] = val
+			}
+		}
+
+		before := dbStat(t, db)
+		assert.Nil(t, db.Merge(WithMergeGarbageRatio(0.5)))
+		after := dbStat(t, db)
+
+		// 只有第一个文件被重写
+		assert.Less(t, after.DataFiles[0].Size, before.DataFiles[0].Size)
+		assert.Equal(t, int64(0), after.DataFiles[0].DeadSize)
+		for i := 1; i < len(before.DataFiles); i++ {
+			assert.Equal(t, before.DataFiles[i].Size, after.DataFiles[i].Size)
+		}
+		assert.Less(t, after.ReclaimableSize, before.ReclaimableSize)
+		_, err = os.Stat(data.GetDataHintFileName(dir, 0))
+		assert.Nil(t, err)
+
+		for key, val := range expected {
+			v, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, val, v)
+		}
+
+		// 没有满足条件的文件
+		assert.Equal(t, ErrMergeRatioUnreached, db.Merge(WithMergeGarbageRatio(0.5)))
+
+		// 重启之后从 hint 文件中加载
+		assert.Nil(t, db.Close())
+		db2, err := Open(opts...)
+		assert.Nil(t, err)
+		for key, val := range expected {
+			v, err := db2.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, val, v)
+		}
+		_, err = db2.Get(getTestKey(500))
+		assert.Equal(t, ErrKeyNotFound, err)
+		assert.Equal(t, uint(999), dbStat(t, db2).KeyNum)
+		removeDB(db2)
+	}
+}
+
+func TestDB_Merge_IncrementalTopN(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-incr-3")
+	db, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	// 前两个文件中都有无效数据，第二个文件更多
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	for i := 200; i < 350; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+
+	before := dbStat(t, db)
+	assert.Greater(t, before.DataFiles[0].DeadSize, int64(0))
+	assert.Greater(t, before.DataFiles[1].DeadSize, before.DataFiles[0].DeadSize)
+
+	assert.Nil(t, db.Merge(WithMergeTopN(1)))
+	after := dbStat(t, db)
+	assert.Equal(t, before.DataFiles[0].Size, after.DataFiles[0].Size)
+	assert.Less(t, after.DataFiles[1].Size, before.DataFiles[1].Size)
+
+	for i := 0; i < 1000; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+}
+
+// 删除标识所在的文件被重写之后，更早文件中的旧数据不能在重启之后恢复
+func TestDB_Merge_IncrementalTombstone(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-incr-4")
+	opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("deleted"), randomValue(128)))
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Delete([]byte("deleted")))
+	for i := 200; i < 600; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+
+	db.mu.RLock()
+	tombstoneFile := db.oldFiles[1]
+	db.mu.RUnlock()
+	mergePath := db.getMergePath()
+	assert.Nil(t, os.MkdirAll(mergePath, os.ModePerm))
+	assert.Nil(t, db.mergeDataFile(newMergeRunner(context.Background(), DefaultMergeOption), mergePath, tombstoneFile, true))
+	assert.Nil(t, os.RemoveAll(mergePath))
+
+	// 保留了删除标识的文件不生成 hint
+	_, err = os.Stat(data.GetDataHintFileName(dir, 1))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts...)
+	defer removeDB(db2)
+	assert.Nil(t, err)
+	_, err = db2.Get([]byte("deleted"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 0; i < 600; i++ {
+		_, err := db2.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+}
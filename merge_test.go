@@ -1,11 +1,15 @@
 package bitcask
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
 )
 
 // 没有任何数据的情况下进行 merge
@@ -206,3 +210,283 @@ func TestDB_Merge5(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+// 过期的数据在 merge 时被丢弃
+func TestDB_Merge_Expired(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-6")
+	opts := []DBOption{WithDBDataFileSize(32 * 1024 * 1024),
+		WithDBDirPath(dir), WithDBDataFileMergeRatio(0.0)}
+
+	db, err := Open(opts...)
+	defer removeDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10000; i++ {
+		err := db.PutWithTTL(getTestKey(i), randomValue(128), time.Millisecond*100)
+		assert.Nil(t, err)
+	}
+	for i := 10000; i < 20000; i++ {
+		err := db.Put(getTestKey(i), randomValue(128))
+		assert.Nil(t, err)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 重启校验
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts...)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+
+	keys, err := db2.ListKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, len(keys))
+	assert.Equal(t, uint(10000), dbStat(t, db2).KeyNum)
+}
+
+func TestDB_AutoMerge(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-7")
+	opts := []DBOption{WithDBDataFileSize(32 * 1024), WithDBDirPath(dir),
+		WithDBDataFileMergeRatio(0.3), WithDBAutoMergeInterval(20 * time.Millisecond)}
+
+	db, err := Open(opts...)
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	for i := 0; i < 800; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+
+	// 等待后台 merge 完成
+	mergeFinished := filepath.Join(dir, data.MergeFinishedFileName)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(mergeFinished)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Close 会停止后台 merge
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.autoMergeCancel)
+
+	db2, err := Open(opts...)
+	defer func() {
+		_ = db2.Close()
+	}()
+	assert.Nil(t, err)
+	keys, err := db2.ListKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(keys))
+}
+
+func TestInTimeWindow(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2024, 1, 1, hour, min, 0, 0, time.Local)
+	}
+
+	// 不限制时间段
+	assert.True(t, inTimeWindow(at(12, 0), 0, 0))
+
+	assert.True(t, inTimeWindow(at(2, 30), 2*time.Hour, 4*time.Hour))
+	assert.False(t, inTimeWindow(at(4, 0), 2*time.Hour, 4*time.Hour))
+	assert.False(t, inTimeWindow(at(1, 59), 2*time.Hour, 4*time.Hour))
+
+	// 跨越零点
+	assert.True(t, inTimeWindow(at(23, 0), 22*time.Hour, 2*time.Hour))
+	assert.True(t, inTimeWindow(at(1, 0), 22*time.Hour, 2*time.Hour))
+	assert.False(t, inTimeWindow(at(12, 0), 22*time.Hour, 2*time.Hour))
+}
+
+// merge 完成之后不需要重启即可生效
+func TestDB_Merge_Online(t *testing.T) {
+	for _, typ := range []IndexerType{BTree, ART, BPlusTree, ShardedBTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-merge-8")
+		db, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024),
+			WithDBDataFileMergeRatio(0), WithDBIndexerType(typ))
+		assert.Nil(t, err)
+
+		for i := 0; i < 2000; i++ {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+		for i := 0; i < 1500; i++ {
+			assert.Nil(t, db.Delete(getTestKey(i)))
+		}
+		assert.Nil(t, db.PutWithTTL(getTestKey(1999), randomValue(128), time.Millisecond))
+		time.Sleep(time.Millisecond * 5)
+
+		// merge 之前创建的迭代器在 merge 之后依然可以读到数据
+		iter, err := db.NewIterator()
+		assert.Nil(t, err)
+		sizeBefore := dbStat(t, db).DiskSize
+
+		// merge 的同时继续读写
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 2000; i < 2500; i++ {
+				assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+			}
+		}()
+		assert.Nil(t, db.Merge())
+		wg.Wait()
+
+		_, err = os.Stat(db.getMergePath())
+		assert.True(t, os.IsNotExist(err))
+		assert.Less(t, dbStat(t, db).DiskSize, sizeBefore)
+		assert.Less(t, dbStat(t, db).ReclaimableSize, int64(32*1024))
+
+		for i := 1500; i < 2500; i++ {
+			_, err := db.Get(getTestKey(i))
+			if i == 1999 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+		assert.Equal(t, uint(999), dbStat(t, db).KeyNum)
+
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			_, err := iter.Value()
+			assert.Nil(t, err)
+			count++
+		}
+		iter.Close()
+		assert.Equal(t, 499, count)
+
+		// 重启之后数据依然有效
+		assert.Nil(t, db.Close())
+		db2, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024), WithDBIndexerType(typ))
+		assert.Nil(t, err)
+		for i := 1500; i < 2500; i++ {
+			if i == 1999 {
+				continue
+			}
+			_, err := db2.Get(getTestKey(i))
+			assert.Nil(t, err)
+		}
+		removeDB(db2)
+	}
+}
+
+// merge 中途取消，数据库保持一致并且可以再次 merge
+func TestDB_MergeContext_Cancel(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-9")
+	opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024), WithDBDataFileMergeRatio(0)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	for i := 0; i < 2500; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+
+	// 已经取消的 ctx 不会开始 merge
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, db.MergeContext(ctx))
+
+	// 第一次回调进度时取消，全量 merge 丢弃所有已经重写的数据
+	reclaimable := dbStat(t, db).ReclaimableSize
+	ctx, cancel = context.WithCancel(context.Background())
+	err = db.MergeContext(ctx, WithMergeProgress(func(p MergeProgress) {
+		cancel()
+	}))
+	assert.Equal(t, context.Canceled, err)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, reclaimable, dbStat(t, db).ReclaimableSize)
+
+	// 增量 merge 同样可以取消，已经替换的数据文件依然有效
+	ctx, cancel = context.WithCancel(context.Background())
+	err = db.MergeContext(ctx, WithMergeGarbageRatio(0.1), WithMergeProgress(func(p MergeProgress) {
+		if p.FilesDone > 0 {
+			cancel()
+		}
+	}))
+	assert.Equal(t, context.Canceled, err)
+	assert.Less(t, dbStat(t, db).ReclaimableSize, reclaimable)
+
+	check := func(db *DB) {
+		for i := 0; i < 5000; i++ {
+			_, err := db.Get(getTestKey(i))
+			if i < 2500 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		}
+	}
+	check(db)
+	assert.Nil(t, db.Merge())
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts...)
+	defer removeDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+}
+
+func TestDB_Merge_Progress(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-10")
+	db, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024), WithDBDataFileMergeRatio(0))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+
+	var last MergeProgress
+	calls := 0
+	assert.Nil(t, db.Merge(WithMergeProgress(func(p MergeProgress) {
+		assert.GreaterOrEqual(t, p.BytesRead, last.BytesRead)
+		last = p
+		calls++
+	})))
+
+	assert.Greater(t, calls, 0)
+	assert.Greater(t, last.FilesTotal, 0)
+	assert.Equal(t, last.FilesTotal, last.FilesDone)
+	assert.Greater(t, last.BytesWritten, int64(0))
+	assert.Less(t, last.BytesWritten, last.BytesRead)
+	// 被删除的 1000 条数据以及对应的删除标识
+	assert.Equal(t, int64(2000), last.RecordsDropped)
+}
+
+func TestDB_Merge_RateLimit(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-11")
+	db, err := Open(WithDBDirPath(dir), WithDBDataFileMergeRatio(0))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(1024)))
+	}
+
+	// 大约 100KB 的数据，限速 200KB/s
+	start := time.Now()
+	assert.Nil(t, db.Merge(WithMergeRateLimit(200*1024)))
+	assert.Greater(t, time.Since(start), 300*time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		_, err := db.Get(getTestKey(i))
+		assert.Nil(t, err)
+	}
+}
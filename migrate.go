@@ -0,0 +1,56 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+)
+
+// Migrate 将旧版本没有文件头部的数据目录升级到当前的文件格式，升级时数据库需要处于关闭状态
+// 每个文件单独升级，中途失败之后重新执行即可，已经升级过的文件不会重复处理
+func Migrate(dirPath string) error {
+	fileSystem := fio.OSFileSystem{}
+	fileLock, locked, err := fileSystem.TryLock(filepath.Join(dirPath, fileLockName))
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return ErrDatabaseIsUsing
+	}
+	defer func() {
+		_ = fileLock.Unlock()
+	}()
+
+	// 没有完成安装的 merge 目录在下次启动时才会加载，同样需要升级
+	for _, dir := range []string{dirPath, getMergePath(dirPath)} {
+		entries, err := fileSystem.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !isFormattedFile(entry.Name()) {
+				continue
+			}
+			if _, err := data.MigrateFile(fileSystem, filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isFormattedFile 是否是带有文件头部的文件
+func isFormattedFile(name string) bool {
+	switch name {
+	case data.HintFileName, data.SeqNoFileName, data.MergeFinishedFileName:
+		return true
+	}
+	return strings.HasSuffix(name, data.DataFileNameSuffix) || strings.HasSuffix(name, data.DataHintFileSuffix)
+}
@@ -0,0 +1,74 @@
+package bitcask
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask/data"
+)
+
+// stripFileHeaders 去掉目录中所有文件的头部，模拟旧版本的数据目录
+func stripFileHeaders(t *testing.T, dir string) {
+	// 未加密文件的头部长度
+	const headerSize = 19
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if !isFormattedFile(entry.Name()) {
+			continue
+		}
+		fileName := filepath.Join(dir, entry.Name())
+		content, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		assert.True(t, bytes.HasPrefix(content, []byte("BCASKDAT")))
+		assert.Nil(t, os.WriteFile(fileName, content[headerSize:], 0644))
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-migrate")
+	opts := []DBOption{WithDBDirPath(dir), WithDBDataFileSize(32 * 1024), WithDBDataFileMergeRatio(0)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(getTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	for i := 1000; i < 1200; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+	assert.Nil(t, db.Close())
+	stripFileHeaders(t, dir)
+
+	// 旧版本的目录需要先升级
+	_, err = Open(opts...)
+	assert.ErrorIs(t, err, data.ErrLegacyFormat)
+
+	assert.Nil(t, Migrate(dir))
+	// 重复执行没有影响
+	assert.Nil(t, Migrate(dir))
+
+	db, err = Open(opts...)
+	defer removeDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1200; i++ {
+		_, err := db.Get(getTestKey(i))
+		if i < 500 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, db.Put(getTestKey(0), randomValue(128)))
+
+	// 数据库正在使用时不能升级
+	assert.Equal(t, ErrDatabaseIsUsing, Migrate(dir))
+}
@@ -1,24 +1,60 @@
 package bitcask
 
-import "os"
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/fio"
+	"github.com/ysoding/bitcask/index"
+)
 
 type DBOption func(opt *option)
 type IteratorOption func(opt *iteratorOption)
 type WriteBatchOption func(opt *writeBatchOption)
+type MergeOption func(opt *mergeOption)
+type FsckOption func(opt *fsckOption)
 
 type option struct {
 	indexerType        IndexerType
+	indexShardNum      int    // 分片索引的分片数量
 	dirPath            string // 存储目录
 	syncWrite          bool   // 每次写是否持久化
+	groupCommit        bool   // 同步写入时是否合并并发的写入，一起持久化
 	bytesPerSync       uint32
 	dataFileSize       int64   // 存储文件大小
 	mmapAtStartUp      bool    // 启动时是否使用 MMap 加载数据
+	mmapActiveFile     bool    // 活跃文件是否使用可写的 MMap 读写
 	dataFileMergeRatio float32 //	数据文件合并的阈值
+
+	autoMergeInterval    time.Duration // 后台自动 merge 的检查间隔，0 表示不开启
+	autoMergeWindowStart time.Duration // 允许自动 merge 的时间段起点，相对于当天零点
+	autoMergeWindowEnd   time.Duration // 允许自动 merge 的时间段终点，起点和终点相等表示不限制
+
+	checkpointInterval time.Duration // 定期写入索引快照的间隔，0 表示只在 Close 时写入
+
+	compression        CompressionType // value 的压缩算法，默认不压缩
+	compressionMinSize int             // 小于该长度的 value 不压缩
+
+	valueCacheSize int64 // value 缓存的容量，字节为单位，0 表示不缓存
+
+	keyProvider KeyProvider // 加密使用的密钥，为空表示不加密
+
+	truncateCorruptedFiles bool // 启动时截断所有数据文件中损坏的记录，默认只截断活跃文件末尾没有写完的记录
+
+	readOnly bool // 只读模式，可以和正在写入的进程共享同一个数据目录
+
+	fileSystem fio.FileSystem // 数据目录所在的文件系统，默认为操作系统的文件系统
 }
 
 type iteratorOption struct {
-	prefix  []byte // 遍历前缀为指定值的 Key，默认为空
-	reverse bool   // 是否反向遍历，默认 false 是正向
+	prefix     []byte // 遍历前缀为指定值的 Key，默认为空
+	reverse    bool   // 是否反向遍历，默认 false 是正向
+	lowerBound []byte // 只遍历大于等于该值的 key，为空表示不限制
+	upperBound []byte // 只遍历小于该值的 key，为空表示不限制
+	keyOnly    bool   // 只遍历 key，不读取 value
+	limit      int    // 最多遍历的 key 的数量，0 表示不限制
 }
 
 type writeBatchOption struct {
@@ -26,8 +62,29 @@ type writeBatchOption struct {
 	syncWrite   bool //	 提交时是否 sync 持久化
 }
 
+type mergeOption struct {
+	garbageRatio   float32               // 增量 merge，只重写无效数据比例达到该值的数据文件
+	topN           int                   // 增量 merge，只重写无效数据比例最高的 n 个数据文件
+	bytesPerSecond int64                 // 每秒最多读取的数据量，0 表示不限制
+	progress       func(p MergeProgress) // merge 进度回调
+}
+
+type fsckOption struct {
+	fileSystem fio.FileSystem // 数据目录所在的文件系统
+}
+
 type IndexerType = byte
 
+type CompressionType = data.CompressionType
+
+type KeyProvider = data.KeyProvider
+
+const (
+	NoCompression     = data.NoCompression
+	SnappyCompression = data.SnappyCompression
+	ZstdCompression   = data.ZstdCompression
+)
+
 const (
 	BTree IndexerType = iota
 
@@ -36,16 +93,24 @@ const (
 
 	// BPlusTree B+ 树索引，将索引存储到磁盘上
 	BPlusTree
+
+	// ShardedBTree 按照 key 的哈希值分片的 B 树索引，每个分片有自己的锁，写入只有追加数据文件是串行的，索引更新并行执行
+	ShardedBTree
 )
 
 var DefaultOption = option{
 	indexerType:        BTree,
+	indexShardNum:      index.DefaultShardNum,
 	dirPath:            os.TempDir(),
 	dataFileSize:       256 * 1024 * 1024, // 256MB
 	syncWrite:          false,
+	groupCommit:        true,
 	bytesPerSync:       0,
 	mmapAtStartUp:      true,
 	dataFileMergeRatio: 0.5,
+	compression:        NoCompression,
+	compressionMinSize: 64,
+	fileSystem:         fio.OSFileSystem{},
 }
 
 var DefaultIteratorOption = iteratorOption{
@@ -58,6 +123,18 @@ var DefaultWriteBatchOption = writeBatchOption{
 	syncWrite:   true,
 }
 
+// DefaultMergeOption 默认重写所有的旧数据文件
+var DefaultMergeOption = mergeOption{
+	garbageRatio:   0,
+	topN:           0,
+	bytesPerSecond: 0,
+	progress:       nil,
+}
+
+var DefaultFsckOption = fsckOption{
+	fileSystem: fio.OSFileSystem{},
+}
+
 func WithWriteSyncWrites(val bool) WriteBatchOption {
 	return func(opt *writeBatchOption) {
 		opt.syncWrite = val
@@ -82,12 +159,79 @@ func WithIteratorReverse(val bool) IteratorOption {
 	}
 }
 
+// WithIteratorLowerBound 只遍历大于等于 val 的 key，和前缀同时使用时取两者的交集
+func WithIteratorLowerBound(val []byte) IteratorOption {
+	return func(opt *iteratorOption) {
+		opt.lowerBound = val
+	}
+}
+
+// WithIteratorUpperBound 只遍历小于 val 的 key，和前缀同时使用时取两者的交集
+func WithIteratorUpperBound(val []byte) IteratorOption {
+	return func(opt *iteratorOption) {
+		opt.upperBound = val
+	}
+}
+
+// WithIteratorKeyOnly 只遍历 key，迭代器不会引用数据文件，Value 返回 ErrIteratorKeyOnly
+func WithIteratorKeyOnly(val bool) IteratorOption {
+	return func(opt *iteratorOption) {
+		opt.keyOnly = val
+	}
+}
+
+// WithIteratorLimit 最多遍历 val 个 key，Rewind 以及 Seek 之后重新计数
+func WithIteratorLimit(val int) IteratorOption {
+	return func(opt *iteratorOption) {
+		opt.limit = val
+	}
+}
+
+// bounds 根据前缀以及上下界计算遍历的范围 [lower, upper)，为空表示不限制
+func (opt *iteratorOption) bounds() (lower, upper []byte) {
+	lower, upper = opt.lowerBound, opt.upperBound
+	if len(opt.prefix) == 0 {
+		return lower, upper
+	}
+	if lower == nil || bytes.Compare(opt.prefix, lower) > 0 {
+		lower = opt.prefix
+	}
+	if end := prefixEnd(opt.prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+		upper = end
+	}
+	return lower, upper
+}
+
+// prefixEnd 大于所有以 prefix 为前缀的 key 的最小值，prefix 全部为 0xff 时返回空
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := append([]byte{}, prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// inRange key 是否在遍历的范围内
+func inRange(key, lower, upper []byte) bool {
+	return (lower == nil || bytes.Compare(key, lower) >= 0) && (upper == nil || bytes.Compare(key, upper) < 0)
+}
+
 func WithDBIndexerType(val IndexerType) DBOption {
 	return func(opt *option) {
 		opt.indexerType = val
 	}
 }
 
+// WithDBIndexShardNum 设置分片索引的分片数量，只对 ShardedBTree 生效
+func WithDBIndexShardNum(val int) DBOption {
+	return func(opt *option) {
+		opt.indexShardNum = val
+	}
+}
+
 func WithDBDirPath(val string) DBOption {
 	return func(opt *option) {
 		opt.dirPath = val
@@ -106,6 +250,14 @@ func WithDBSyncWrite(val bool) DBOption {
 	}
 }
 
+// WithDBGroupCommit 开启同步写入时，并发的 Put 和 Delete 合并为一组写入，整组只 Sync 一次，默认开启
+// 关闭之后每次写入都单独 Sync
+func WithDBGroupCommit(val bool) DBOption {
+	return func(opt *option) {
+		opt.groupCommit = val
+	}
+}
+
 func WithDBBytesPerWrite(val uint32) DBOption {
 	return func(opt *option) {
 		opt.bytesPerSync = val
@@ -123,3 +275,128 @@ func WithDBMmapAtStartUp(val bool) DBOption {
 		opt.mmapAtStartUp = val
 	}
 }
+
+// WithDBMmapActiveFile 活跃文件使用可写的 MMap 读写，创建时预先分配 dataFileSize 大小的空间，
+// 读写活跃文件不再需要系统调用，Sync 时 msync 到磁盘，关闭时截断到实际写入的长度
+func WithDBMmapActiveFile(val bool) DBOption {
+	return func(opt *option) {
+		opt.mmapActiveFile = val
+	}
+}
+
+// WithDBAutoMergeInterval 开启后台自动 merge，每隔 val 检查一次可回收的数据量是否达到阈值
+func WithDBAutoMergeInterval(val time.Duration) DBOption {
+	return func(opt *option) {
+		opt.autoMergeInterval = val
+	}
+}
+
+// WithDBAutoMergeWindow 限制自动 merge 只在每天的 [start, end) 时间段内进行，
+// start 和 end 为相对于零点的偏移，start 大于 end 时表示跨越零点
+func WithDBAutoMergeWindow(start, end time.Duration) DBOption {
+	return func(opt *option) {
+		opt.autoMergeWindowStart = start
+		opt.autoMergeWindowEnd = end
+	}
+}
+
+// WithDBCompression 设置 value 的压缩算法，只影响之后写入的数据，已有的数据依然可以读取
+// 每条数据单独记录压缩算法，同一个数据文件中可以同时存在压缩和未压缩的数据
+func WithDBCompression(val CompressionType) DBOption {
+	return func(opt *option) {
+		opt.compression = val
+	}
+}
+
+// WithDBCompressionMinSize 长度小于 val 的 value 不进行压缩
+func WithDBCompressionMinSize(val int) DBOption {
+	return func(opt *option) {
+		opt.compressionMinSize = val
+	}
+}
+
+// WithDBCheckpointInterval 每隔 val 将内存索引写入到索引快照中，崩溃重启时只需要重放最近一次快照之后写入的数据
+// 默认只在 Close 时写入，B+ 树索引不需要快照
+func WithDBCheckpointInterval(val time.Duration) DBOption {
+	return func(opt *option) {
+		opt.checkpointInterval = val
+	}
+}
+
+// WithDBValueCacheSize 开启 value 缓存，按照数据的位置缓存最近读取过的 value，val 为缓存的容量，字节为单位
+// 缓存的命中次数可以通过 Stat 查看
+func WithDBValueCacheSize(val int64) DBOption {
+	return func(opt *option) {
+		opt.valueCacheSize = val
+	}
+}
+
+// WithDBKeyProvider 开启加密，数据文件、hint 文件以及事务序列号文件都会加密之后再写入磁盘
+// 新文件使用 keys 的当前密钥加密，并在文件头部记录密钥 id，merge 时使用当前密钥重新加密
+// B+ 树索引文件中的 key 不会加密
+func WithDBKeyProvider(keys KeyProvider) DBOption {
+	return func(opt *option) {
+		opt.keyProvider = keys
+	}
+}
+
+// WithDBTruncateCorruptedFiles 启动时遇到损坏的记录，将数据文件截断到损坏的位置并继续启动，之后的数据会丢失
+// 默认只有活跃文件末尾的记录会被截断，这种情况通常是写入时进程崩溃导致的，其他位置的损坏会导致启动失败
+func WithDBTruncateCorruptedFiles(val bool) DBOption {
+	return func(opt *option) {
+		opt.truncateCorruptedFiles = val
+	}
+}
+
+// WithDBReadOnly 以只读模式打开数据库，不加文件锁，可以和正在写入的进程共享同一个数据目录
+// 只读模式下不会创建或者修改任何文件，写入以及 merge 返回 ErrReadOnly，通过 Refresh 加载写进程新追加的数据
+// B+ 树索引文件被写进程独占，只读模式下改为从数据文件中构建内存索引
+func WithDBReadOnly(val bool) DBOption {
+	return func(opt *option) {
+		opt.readOnly = val
+	}
+}
+
+// WithDBFileSystem 数据目录所在的文件系统，数据文件通过 fs.OpenFile 创建 IOManager，可以用来接入自定义的 IOManager
+// fio.NewMemFileSystem 创建的内存文件系统不会在磁盘上创建任何文件，B+ 树索引不支持内存文件系统
+func WithDBFileSystem(fs fio.FileSystem) DBOption {
+	return func(opt *option) {
+		opt.fileSystem = fs
+	}
+}
+
+// WithMergeGarbageRatio 增量 merge，只重写无效数据比例不小于 val 的数据文件
+func WithMergeGarbageRatio(val float32) MergeOption {
+	return func(opt *mergeOption) {
+		opt.garbageRatio = val
+	}
+}
+
+// WithMergeTopN 增量 merge，只重写无效数据比例最高的 val 个数据文件，
+// 和 WithMergeGarbageRatio 同时使用时从满足比例的文件中选取
+func WithMergeTopN(val int) MergeOption {
+	return func(opt *mergeOption) {
+		opt.topN = val
+	}
+}
+
+// WithMergeRateLimit 限制 merge 每秒读取的数据量，避免占满磁盘带宽
+func WithMergeRateLimit(bytesPerSecond int64) MergeOption {
+	return func(opt *mergeOption) {
+		opt.bytesPerSecond = bytesPerSecond
+	}
+}
+
+// WithMergeProgress 设置 merge 进度回调，在 merge 协程中同步调用
+func WithMergeProgress(fn func(p MergeProgress)) MergeOption {
+	return func(opt *mergeOption) {
+		opt.progress = fn
+	}
+}
+
+// WithFsckFileSystem 数据目录所在的文件系统，与打开数据库时 WithDBFileSystem 传入的相同
+func WithFsckFileSystem(fs fio.FileSystem) FsckOption {
+	return func(opt *fsckOption) {
+		opt.fileSystem = fs
+	}
+}
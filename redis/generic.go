@@ -0,0 +1,37 @@
+package redis
+
+import (
+	"errors"
+
+	"github.com/ysoding/bitcask"
+)
+
+// Del 删除一个 key，对于 Hash/Set/List/ZSet 只删除元数据，数据部分因为版本号失效而无法再访问
+func (rds *RedisDataStructure) Del(key []byte) error {
+	return rds.db.Delete(key)
+}
+
+// Type 获取 key 对应的数据类型
+func (rds *RedisDataStructure) Type(key []byte) (redisDataType, error) {
+	encValue, err := rds.db.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(encValue) == 0 {
+		return 0, errors.New("value is null")
+	}
+	// 第一个字节就是类型
+	return encValue[0], nil
+}
+
+// Exists 判断 key 是否存在
+func (rds *RedisDataStructure) Exists(key []byte) (bool, error) {
+	_, err := rds.db.Get(key)
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
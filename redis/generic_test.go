@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask"
+)
+
+func TestRedisDataStructure_Del_Type(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-del-type")
+
+	// del
+	err := rds.Del([]byte("key-not-exist"))
+	assert.Nil(t, err)
+
+	_, err = rds.HSet([]byte("myhash"), []byte("field1"), []byte("val-1"))
+	assert.Nil(t, err)
+
+	// type
+	typ, err := rds.Type([]byte("myhash"))
+	assert.Nil(t, err)
+	assert.Equal(t, Hash, typ)
+
+	ok, err := rds.Exists([]byte("myhash"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	err = rds.Del([]byte("myhash"))
+	assert.Nil(t, err)
+
+	_, err = rds.Type([]byte("myhash"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	ok, err = rds.Exists([]byte("myhash"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 删除之后重新写入，旧的字段不可见
+	_, err = rds.HSet([]byte("myhash"), []byte("field2"), []byte("val-2"))
+	assert.Nil(t, err)
+	val, err := rds.HGet([]byte("myhash"), []byte("field1"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+}
@@ -0,0 +1,133 @@
+package redis
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/ysoding/bitcask/utils"
+)
+
+const (
+	maxMetadataSize   = 1 + binary.MaxVarintLen64*2 + binary.MaxVarintLen32
+	extraListMetaSize = binary.MaxVarintLen64 * 2
+
+	initialListMark = math.MaxUint64 / 2
+)
+
+// metadata 数据结构的元数据，存储在用户指定的 key 下
+type metadata struct {
+	dataType redisDataType // 数据类型
+	version  int64         // 版本号，用于快速删除整个数据结构
+	size     uint32        // 数据量
+	head     uint64        // List 专用
+	tail     uint64        // List 专用
+}
+
+func (md *metadata) encode() []byte {
+	var size = maxMetadataSize
+	if md.dataType == List {
+		size += extraListMetaSize
+	}
+	buf := make([]byte, size)
+
+	buf[0] = md.dataType
+	var index = 1
+	index += binary.PutVarint(buf[index:], md.version)
+	index += binary.PutVarint(buf[index:], int64(md.size))
+
+	if md.dataType == List {
+		index += binary.PutUvarint(buf[index:], md.head)
+		index += binary.PutUvarint(buf[index:], md.tail)
+	}
+
+	return buf[:index]
+}
+
+func decodeMetadata(buf []byte) *metadata {
+	dataType := buf[0]
+
+	var index = 1
+	version, n := binary.Varint(buf[index:])
+	index += n
+	size, n := binary.Varint(buf[index:])
+	index += n
+
+	var head uint64 = 0
+	var tail uint64 = 0
+	if dataType == List {
+		head, n = binary.Uvarint(buf[index:])
+		index += n
+		tail, _ = binary.Uvarint(buf[index:])
+	}
+
+	return &metadata{
+		dataType: dataType,
+		version:  version,
+		size:     uint32(size),
+		head:     head,
+		tail:     tail,
+	}
+}
+
+// internalKeyPrefix 数据部分的 key 前缀：key + version
+func internalKeyPrefix(key []byte, version int64) []byte {
+	buf := make([]byte, len(key)+8)
+	copy(buf, key)
+	binary.LittleEndian.PutUint64(buf[len(key):], uint64(version))
+	return buf
+}
+
+// hashInternalKey Hash 数据部分的 key
+type hashInternalKey struct {
+	key     []byte
+	version int64
+	field   []byte
+}
+
+func (hk *hashInternalKey) encode() []byte {
+	return append(internalKeyPrefix(hk.key, hk.version), hk.field...)
+}
+
+// setInternalKey Set 数据部分的 key
+type setInternalKey struct {
+	key     []byte
+	version int64
+	member  []byte
+}
+
+func (sk *setInternalKey) encode() []byte {
+	buf := append(internalKeyPrefix(sk.key, sk.version), sk.member...)
+	// member size
+	return binary.LittleEndian.AppendUint32(buf, uint32(len(sk.member)))
+}
+
+// listInternalKey List 数据部分的 key
+type listInternalKey struct {
+	key     []byte
+	version int64
+	index   uint64
+}
+
+func (lk *listInternalKey) encode() []byte {
+	return binary.LittleEndian.AppendUint64(internalKeyPrefix(lk.key, lk.version), lk.index)
+}
+
+// zsetInternalKey ZSet 数据部分的 key
+type zsetInternalKey struct {
+	key     []byte
+	version int64
+	member  []byte
+	score   float64
+}
+
+// encodeWithMember key + version + member
+func (zk *zsetInternalKey) encodeWithMember() []byte {
+	return append(internalKeyPrefix(zk.key, zk.version), zk.member...)
+}
+
+// encodeWithScore key + version + score + member + member size
+func (zk *zsetInternalKey) encodeWithScore() []byte {
+	buf := append(internalKeyPrefix(zk.key, zk.version), utils.Float64ToBytes(zk.score)...)
+	buf = append(buf, zk.member...)
+	return binary.LittleEndian.AppendUint32(buf, uint32(len(zk.member)))
+}
@@ -0,0 +1,15 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadata_Encode(t *testing.T) {
+	md1 := &metadata{dataType: Hash, version: 1234, size: 10}
+	assert.Equal(t, md1, decodeMetadata(md1.encode()))
+
+	md2 := &metadata{dataType: List, version: 1234, size: 2, head: initialListMark - 1, tail: initialListMark + 1}
+	assert.Equal(t, md2, decodeMetadata(md2.encode()))
+}
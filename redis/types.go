@@ -0,0 +1,503 @@
+package redis
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ysoding/bitcask"
+	"github.com/ysoding/bitcask/utils"
+)
+
+var ErrWrongTypeOperation = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+type redisDataType = byte
+
+const (
+	String redisDataType = iota
+	Hash
+	Set
+	List
+	ZSet
+)
+
+// RedisDataStructure Redis 数据结构服务
+type RedisDataStructure struct {
+	db *bitcask.DB
+	mu *sync.Mutex // 保证读取元数据到写入数据的过程是串行的
+}
+
+// NewRedisDataStructure 初始化 Redis 数据结构服务
+func NewRedisDataStructure(opts ...bitcask.DBOption) (*RedisDataStructure, error) {
+	db, err := bitcask.Open(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisDataStructure{db: db, mu: new(sync.Mutex)}, nil
+}
+
+func (rds *RedisDataStructure) Close() error {
+	return rds.db.Close()
+}
+
+// ======================= String 数据结构 =======================
+
+// Set 写入 String 类型的数据，ttl 为 0 表示永不过期
+func (rds *RedisDataStructure) Set(key []byte, ttl time.Duration, value []byte) error {
+	if value == nil {
+		return nil
+	}
+
+	// 编码 value : type + payload
+	encValue := make([]byte, 1+len(value))
+	encValue[0] = String
+	copy(encValue[1:], value)
+
+	if ttl > 0 {
+		return rds.db.PutWithTTL(key, encValue, ttl)
+	}
+	return rds.db.Put(key, encValue)
+}
+
+// Get 读取 String 类型的数据
+func (rds *RedisDataStructure) Get(key []byte) ([]byte, error) {
+	encValue, err := rds.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if encValue[0] != String {
+		return nil, ErrWrongTypeOperation
+	}
+	return encValue[1:], nil
+}
+
+// ======================= Hash 数据结构 =======================
+
+// HSet 设置 Hash 的字段，字段之前不存在时返回 true
+func (rds *RedisDataStructure) HSet(key, field, value []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
+	// 先查找元数据
+	meta, err := rds.findMetadata(key, Hash)
+	if err != nil {
+		return false, err
+	}
+
+	// 构造 Hash 数据部分的 key
+	hk := &hashInternalKey{
+		key:     key,
+		version: meta.version,
+		field:   field,
+	}
+	encKey := hk.encode()
+
+	// 先查找是否存在
+	var exist = true
+	if _, err = rds.db.Get(encKey); err == bitcask.ErrKeyNotFound {
+		exist = false
+	} else if err != nil {
+		return false, err
+	}
+
+	wb := rds.db.NewWriteBatch()
+	// 不存在则更新元数据
+	if !exist {
+		meta.size++
+		_ = wb.Put(key, meta.encode())
+	}
+	_ = wb.Put(encKey, value)
+	if err = wb.Commit(); err != nil {
+		return false, err
+	}
+	return !exist, nil
+}
+
+// HGet 读取 Hash 的字段
+func (rds *RedisDataStructure) HGet(key, field []byte) ([]byte, error) {
+	meta, err := rds.findMetadata(key, Hash)
+	if err != nil {
+		return nil, err
+	}
+	if meta.size == 0 {
+		return nil, nil
+	}
+
+	hk := &hashInternalKey{
+		key:     key,
+		version: meta.version,
+		field:   field,
+	}
+	value, err := rds.db.Get(hk.encode())
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+// HDel 删除 Hash 的字段，字段存在时返回 true
+func (rds *RedisDataStructure) HDel(key, field []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
+	meta, err := rds.findMetadata(key, Hash)
+	if err != nil {
+		return false, err
+	}
+	if meta.size == 0 {
+		return false, nil
+	}
+
+	hk := &hashInternalKey{
+		key:     key,
+		version: meta.version,
+		field:   field,
+	}
+	encKey := hk.encode()
+
+	// 先查看是否存在
+	var exist = true
+	if _, err = rds.db.Get(encKey); err == bitcask.ErrKeyNotFound {
+		exist = false
+	} else if err != nil {
+		return false, err
+	}
+
+	if exist {
+		wb := rds.db.NewWriteBatch()
+		meta.size--
+		_ = wb.Put(key, meta.encode())
+		_ = wb.Delete(encKey)
+		if err = wb.Commit(); err != nil {
+			return false, err
+		}
+	}
+
+	return exist, nil
+}
+
+// ======================= Set 数据结构 =======================
+
+// SAdd 向 Set 中添加成员，成员之前不存在时返回 true
+func (rds *RedisDataStructure) SAdd(key, member []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
+	meta, err := rds.findMetadata(key, Set)
+	if err != nil {
+		return false, err
+	}
+
+	// 构造一个数据部分的 key
+	sk := &setInternalKey{
+		key:     key,
+		version: meta.version,
+		member:  member,
+	}
+
+	var ok bool
+	if _, err = rds.db.Get(sk.encode()); err == bitcask.ErrKeyNotFound {
+		// 不存在的话则更新
+		wb := rds.db.NewWriteBatch()
+		meta.size++
+		_ = wb.Put(key, meta.encode())
+		_ = wb.Put(sk.encode(), nil)
+		if err = wb.Commit(); err != nil {
+			return false, err
+		}
+		ok = true
+	} else if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// SIsMember 判断成员是否在 Set 中
+func (rds *RedisDataStructure) SIsMember(key, member []byte) (bool, error) {
+	meta, err := rds.findMetadata(key, Set)
+	if err != nil {
+		return false, err
+	}
+	if meta.size == 0 {
+		return false, nil
+	}
+
+	sk := &setInternalKey{
+		key:     key,
+		version: meta.version,
+		member:  member,
+	}
+
+	_, err = rds.db.Get(sk.encode())
+	if err != nil && err != bitcask.ErrKeyNotFound {
+		return false, err
+	}
+	if err == bitcask.ErrKeyNotFound {
+		return false, nil
+	}
+	return true, nil
+}
+
+// SRem 从 Set 中删除成员，成员存在时返回 true
+func (rds *RedisDataStructure) SRem(key, member []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
+	meta, err := rds.findMetadata(key, Set)
+	if err != nil {
+		return false, err
+	}
+	if meta.size == 0 {
+		return false, nil
+	}
+
+	sk := &setInternalKey{
+		key:     key,
+		version: meta.version,
+		member:  member,
+	}
+
+	if _, err = rds.db.Get(sk.encode()); err == bitcask.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// 更新
+	wb := rds.db.NewWriteBatch()
+	meta.size--
+	_ = wb.Put(key, meta.encode())
+	_ = wb.Delete(sk.encode())
+	if err = wb.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ======================= List 数据结构 =======================
+
+// LPush 从 List 头部插入元素，返回插入之后 List 的长度
+func (rds *RedisDataStructure) LPush(key, element []byte) (uint32, error) {
+	return rds.pushInner(key, element, true)
+}
+
+// RPush 从 List 尾部插入元素，返回插入之后 List 的长度
+func (rds *RedisDataStructure) RPush(key, element []byte) (uint32, error) {
+	return rds.pushInner(key, element, false)
+}
+
+// LPop 弹出 List 头部的元素，List 为空时返回 nil
+func (rds *RedisDataStructure) LPop(key []byte) ([]byte, error) {
+	return rds.popInner(key, true)
+}
+
+// RPop 弹出 List 尾部的元素，List 为空时返回 nil
+func (rds *RedisDataStructure) RPop(key []byte) ([]byte, error) {
+	return rds.popInner(key, false)
+}
+
+func (rds *RedisDataStructure) pushInner(key, element []byte, isLeft bool) (uint32, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
+	// 查找元数据
+	meta, err := rds.findMetadata(key, List)
+	if err != nil {
+		return 0, err
+	}
+
+	// 构造数据部分的 key
+	lk := &listInternalKey{
+		key:     key,
+		version: meta.version,
+	}
+	if isLeft {
+		lk.index = meta.head - 1
+	} else {
+		lk.index = meta.tail
+	}
+
+	// 更新元数据和数据部分
+	wb := rds.db.NewWriteBatch()
+	meta.size++
+	if isLeft {
+		meta.head--
+	} else {
+		meta.tail++
+	}
+	_ = wb.Put(key, meta.encode())
+	_ = wb.Put(lk.encode(), element)
+	if err = wb.Commit(); err != nil {
+		return 0, err
+	}
+
+	return meta.size, nil
+}
+
+func (rds *RedisDataStructure) popInner(key []byte, isLeft bool) ([]byte, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
+	// 查找元数据
+	meta, err := rds.findMetadata(key, List)
+	if err != nil {
+		return nil, err
+	}
+	if meta.size == 0 {
+		return nil, nil
+	}
+
+	// 构造数据部分的 key
+	lk := &listInternalKey{
+		key:     key,
+		version: meta.version,
+	}
+	if isLeft {
+		lk.index = meta.head
+	} else {
+		lk.index = meta.tail - 1
+	}
+
+	element, err := rds.db.Get(lk.encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// 更新元数据并删除数据部分
+	wb := rds.db.NewWriteBatch()
+	meta.size--
+	if isLeft {
+		meta.head++
+	} else {
+		meta.tail--
+	}
+	_ = wb.Put(key, meta.encode())
+	_ = wb.Delete(lk.encode())
+	if err = wb.Commit(); err != nil {
+		return nil, err
+	}
+
+	return element, nil
+}
+
+// ======================= ZSet 数据结构 =======================
+
+// ZAdd 向 ZSet 中添加成员或者更新成员的分数，成员之前不存在时返回 true
+func (rds *RedisDataStructure) ZAdd(key []byte, score float64, member []byte) (bool, error) {
+	rds.mu.Lock()
+	defer rds.mu.Unlock()
+
+	meta, err := rds.findMetadata(key, ZSet)
+	if err != nil {
+		return false, err
+	}
+
+	// 构造数据部分的key
+	zk := &zsetInternalKey{
+		key:     key,
+		version: meta.version,
+		score:   score,
+		member:  member,
+	}
+
+	var exist = true
+	// 查看是否已经存在
+	value, err := rds.db.Get(zk.encodeWithMember())
+	if err != nil && err != bitcask.ErrKeyNotFound {
+		return false, err
+	}
+	if err == bitcask.ErrKeyNotFound {
+		exist = false
+	}
+	if exist {
+		if score == utils.FloatFromBytes(value) {
+			return false, nil
+		}
+	}
+
+	// 更新元数据和数据
+	wb := rds.db.NewWriteBatch()
+	if !exist {
+		meta.size++
+		_ = wb.Put(key, meta.encode())
+	}
+	if exist {
+		oldKey := &zsetInternalKey{
+			key:     key,
+			version: meta.version,
+			member:  member,
+			score:   utils.FloatFromBytes(value),
+		}
+		_ = wb.Delete(oldKey.encodeWithScore())
+	}
+	_ = wb.Put(zk.encodeWithMember(), utils.Float64ToBytes(score))
+	_ = wb.Put(zk.encodeWithScore(), nil)
+	if err = wb.Commit(); err != nil {
+		return false, err
+	}
+
+	return !exist, nil
+}
+
+// ZScore 获取 ZSet 中成员的分数，成员不存在时返回 bitcask.ErrKeyNotFound
+func (rds *RedisDataStructure) ZScore(key []byte, member []byte) (float64, error) {
+	meta, err := rds.findMetadata(key, ZSet)
+	if err != nil {
+		return -1, err
+	}
+	if meta.size == 0 {
+		return -1, bitcask.ErrKeyNotFound
+	}
+
+	// 构造数据部分的key
+	zk := &zsetInternalKey{
+		key:     key,
+		version: meta.version,
+		member:  member,
+	}
+
+	value, err := rds.db.Get(zk.encodeWithMember())
+	if err != nil {
+		return -1, err
+	}
+
+	return utils.FloatFromBytes(value), nil
+}
+
+// findMetadata 查找 key 对应的元数据，不存在或者数据结构为空时返回一个新版本的元数据
+func (rds *RedisDataStructure) findMetadata(key []byte, dataType redisDataType) (*metadata, error) {
+	metaBuf, err := rds.db.Get(key)
+	if err != nil && err != bitcask.ErrKeyNotFound {
+		return nil, err
+	}
+
+	var meta *metadata
+	var exist = true
+	if err == bitcask.ErrKeyNotFound {
+		exist = false
+	} else {
+		meta = decodeMetadata(metaBuf)
+		// 判断数据类型
+		if meta.dataType != dataType {
+			return nil, ErrWrongTypeOperation
+		}
+		// 数据结构已经为空
+		if meta.size == 0 {
+			exist = false
+		}
+	}
+
+	if !exist {
+		meta = &metadata{
+			dataType: dataType,
+			version:  time.Now().UnixNano(),
+			size:     0,
+		}
+		if dataType == List {
+			meta.head = initialListMark
+			meta.tail = initialListMark
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,238 @@
+package redis
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ysoding/bitcask"
+)
+
+func newTestRDS(t *testing.T, name string) *RedisDataStructure {
+	dir, _ := os.MkdirTemp("", name)
+	rds, err := NewRedisDataStructure(bitcask.WithDBDirPath(dir))
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		_ = rds.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return rds
+}
+
+func TestRedisDataStructure_Get(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-get")
+
+	err := rds.Set([]byte("key-1"), 0, []byte("val-1"))
+	assert.Nil(t, err)
+	err = rds.Set([]byte("key-2"), time.Millisecond*50, []byte("val-2"))
+	assert.Nil(t, err)
+
+	val1, err := rds.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-1"), val1)
+
+	val2, err := rds.Get([]byte("key-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-2"), val2)
+
+	time.Sleep(time.Millisecond * 100)
+	_, err = rds.Get([]byte("key-2"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+}
+
+func TestRedisDataStructure_HGet(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-hget")
+
+	ok1, err := rds.HSet([]byte("myhash"), []byte("field1"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.True(t, ok1)
+
+	ok2, err := rds.HSet([]byte("myhash"), []byte("field1"), []byte("val-2"))
+	assert.Nil(t, err)
+	assert.False(t, ok2)
+
+	ok3, err := rds.HSet([]byte("myhash"), []byte("field2"), []byte("val-3"))
+	assert.Nil(t, err)
+	assert.True(t, ok3)
+
+	val1, err := rds.HGet([]byte("myhash"), []byte("field1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-2"), val1)
+
+	val2, err := rds.HGet([]byte("myhash"), []byte("field2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-3"), val2)
+
+	val3, err := rds.HGet([]byte("myhash"), []byte("field-not-exist"))
+	assert.Nil(t, err)
+	assert.Nil(t, val3)
+}
+
+func TestRedisDataStructure_HDel(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-hdel")
+
+	del1, err := rds.HDel([]byte("myhash"), nil)
+	assert.Nil(t, err)
+	assert.False(t, del1)
+
+	ok1, err := rds.HSet([]byte("myhash"), []byte("field1"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.True(t, ok1)
+
+	del2, err := rds.HDel([]byte("myhash"), []byte("field1"))
+	assert.Nil(t, err)
+	assert.True(t, del2)
+
+	val, err := rds.HGet([]byte("myhash"), []byte("field1"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+}
+
+func TestRedisDataStructure_SIsMember(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-sismember")
+
+	ok, err := rds.SAdd([]byte("myset"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = rds.SAdd([]byte("myset"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = rds.SAdd([]byte("myset"), []byte("val-2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = rds.SIsMember([]byte("myset-not-exist"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = rds.SIsMember([]byte("myset"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = rds.SIsMember([]byte("myset"), []byte("val-3"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestRedisDataStructure_SRem(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-srem")
+
+	ok, err := rds.SAdd([]byte("myset"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = rds.SAdd([]byte("myset"), []byte("val-2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = rds.SRem([]byte("myset-not-exist"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = rds.SRem([]byte("myset"), []byte("val-3"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = rds.SRem([]byte("myset"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = rds.SIsMember([]byte("myset"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestRedisDataStructure_LPop(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-lpop")
+
+	res, err := rds.LPush([]byte("mylist"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), res)
+	res, err = rds.LPush([]byte("mylist"), []byte("val-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), res)
+	res, err = rds.RPush([]byte("mylist"), []byte("val-3"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), res)
+
+	val, err := rds.LPop([]byte("mylist"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-2"), val)
+	val, err = rds.LPop([]byte("mylist"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-1"), val)
+	val, err = rds.LPop([]byte("mylist"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-3"), val)
+	val, err = rds.LPop([]byte("mylist"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+}
+
+func TestRedisDataStructure_RPop(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-rpop")
+
+	res, err := rds.RPush([]byte("mylist"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), res)
+	res, err = rds.RPush([]byte("mylist"), []byte("val-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), res)
+	res, err = rds.LPush([]byte("mylist"), []byte("val-3"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), res)
+
+	val, err := rds.RPop([]byte("mylist"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-2"), val)
+	val, err = rds.RPop([]byte("mylist"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-1"), val)
+	val, err = rds.RPop([]byte("mylist"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("val-3"), val)
+	val, err = rds.RPop([]byte("mylist"))
+	assert.Nil(t, err)
+	assert.Nil(t, val)
+}
+
+func TestRedisDataStructure_ZScore(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-zscore")
+
+	ok, err := rds.ZAdd([]byte("myzset"), 113, []byte("val-1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = rds.ZAdd([]byte("myzset"), 333, []byte("val-1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = rds.ZAdd([]byte("myzset"), 98.5, []byte("val-2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	score, err := rds.ZScore([]byte("myzset"), []byte("val-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(333), score)
+	score, err = rds.ZScore([]byte("myzset"), []byte("val-2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 98.5, score)
+
+	_, err = rds.ZScore([]byte("myzset"), []byte("val-3"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+}
+
+func TestRedisDataStructure_WrongType(t *testing.T) {
+	rds := newTestRDS(t, "bitcask-go-redis-wrong-type")
+
+	_, err := rds.HSet([]byte("key"), []byte("field1"), []byte("val-1"))
+	assert.Nil(t, err)
+
+	_, err = rds.SAdd([]byte("key"), []byte("val-1"))
+	assert.Equal(t, ErrWrongTypeOperation, err)
+	_, err = rds.LPush([]byte("key"), []byte("val-1"))
+	assert.Equal(t, ErrWrongTypeOperation, err)
+	_, err = rds.ZAdd([]byte("key"), 1, []byte("val-1"))
+	assert.Equal(t, ErrWrongTypeOperation, err)
+	_, err = rds.Get([]byte("key"))
+	assert.Equal(t, ErrWrongTypeOperation, err)
+
+	err = rds.Set([]byte("str"), 0, []byte("val-1"))
+	assert.Nil(t, err)
+	_, err = rds.HGet([]byte("str"), []byte("field1"))
+	assert.Equal(t, ErrWrongTypeOperation, err)
+}
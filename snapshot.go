@@ -0,0 +1,83 @@
+package bitcask
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ysoding/bitcask/data"
+	"github.com/ysoding/bitcask/index"
+)
+
+// Snapshot 数据库某一时刻的只读视图，创建之后的写入对快照不可见
+type Snapshot struct {
+	db       *DB
+	mu       *sync.RWMutex
+	indexer  index.Indexer
+	files    map[uint32]*data.DataFile // 快照创建时所有的数据文件 fileid->datafile
+	released bool
+}
+
+// NewSnapshot 创建快照，使用完毕之后需要调用 Release 释放
+// 快照引用的数据文件即使被 merge 替换掉，在快照释放之前也依然可读
+func (db *DB) NewSnapshot() (*Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	indexer, err := db.indexer.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		db:      db,
+		mu:      new(sync.RWMutex),
+		indexer: indexer,
+		files:   db.pinFiles(),
+	}, nil
+}
+
+// Get 从快照中读取数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	info, err := s.indexer.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+
+	return s.getValueByIndexInfo(info)
+}
+
+// NewIterator 创建遍历快照数据的迭代器
+func (s *Snapshot) NewIterator(opts ...IteratorOption) (*Iterator, error) {
+	return newIterator(s.db, s, s.indexer, opts...)
+}
+
+// Release 释放快照，释放之后快照不可再使用
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	_ = s.indexer.Close()
+	s.files = nil
+	s.db.unpinFiles()
+}
+
+func (s *Snapshot) getValueByIndexInfo(info *data.LogRecordPos) ([]byte, error) {
+	return readValue(s.files[info.FileID], info)
+}
@@ -0,0 +1,97 @@
+package bitcask
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-1")
+	db, err := Open(WithDBDirPath(dir))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), []byte("old")))
+	}
+
+	snapshot, err := db.NewSnapshot()
+
+	assert.Nil(t, err)
+
+	// 快照创建之后的修改对快照不可见
+	assert.Nil(t, db.Put(getTestKey(0), []byte("new")))
+	assert.Nil(t, db.Delete(getTestKey(1)))
+	assert.Nil(t, db.Put(getTestKey(100), []byte("new")))
+
+	val, err := snapshot.Get(getTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("old"), val)
+	val, err = snapshot.Get(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("old"), val)
+	_, err = snapshot.Get(getTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	iter, err := snapshot.NewIterator()
+
+	assert.Nil(t, err)
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("old"), val)
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 10, count)
+
+	val, err = db.Get(getTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+
+	snapshot.Release()
+	_, err = snapshot.Get(getTestKey(0))
+	assert.Equal(t, ErrSnapshotReleased, err)
+}
+
+func TestDB_Snapshot_Merge(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-2")
+	db, err := Open(WithDBDirPath(dir), WithDBDataFileSize(32*1024), WithDBDataFileMergeRatio(0))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+	}
+
+	snapshot, err := db.NewSnapshot()
+
+	assert.Nil(t, err)
+	defer snapshot.Release()
+
+	expected := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		val, err := snapshot.Get(getTestKey(i))
+		assert.Nil(t, err)
+		expected[string(getTestKey(i))] = val
+	}
+
+	for i := 0; i < 1000; i++ {
+		if i%2 == 0 {
+			assert.Nil(t, db.Delete(getTestKey(i)))
+		} else {
+			assert.Nil(t, db.Put(getTestKey(i), randomValue(128)))
+		}
+	}
+	assert.Nil(t, db.Merge())
+
+	// merge 之后快照引用的数据依然可读
+	for i := 0; i < 1000; i++ {
+		val, err := snapshot.Get(getTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, expected[string(getTestKey(i))], val)
+	}
+}
@@ -0,0 +1,417 @@
+package bitcask
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/ysoding/bitcask/data"
+)
+
+// Txn 乐观事务，提交前的写入只保存在内存中，提交时检测读过的 key 是否被其他提交修改过
+type Txn struct {
+	mu            *sync.Mutex
+	db            *DB
+	readOnly      bool
+	readTs        uint64 // 事务开始时的提交时间戳
+	reads         map[string]struct{}
+	pendingWrites map[string]*data.LogRecord
+	discarded     bool
+}
+
+// Begin 开启一个事务，readOnly 为 true 时事务中不允许写入
+func (db *DB) Begin(readOnly bool) *Txn {
+	return &Txn{
+		mu:            new(sync.Mutex),
+		db:            db,
+		readOnly:      readOnly,
+		readTs:        db.oracle.begin(),
+		reads:         make(map[string]struct{}),
+		pendingWrites: make(map[string]*data.LogRecord),
+	}
+}
+
+// Get 读取数据，优先返回当前事务中尚未提交的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.discarded {
+		return nil, ErrTxnDiscarded
+	}
+
+	if record, ok := txn.pendingWrites[string(key)]; ok {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+
+	txn.addRead(key)
+	return txn.db.Get(key)
+}
+
+func (txn *Txn) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.checkWritable(); err != nil {
+		return err
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Value: value, Type: data.LogRecordNormal}
+	return nil
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if err := txn.checkWritable(); err != nil {
+		return err
+	}
+
+	// 数据库中不存在该 key，只需要撤销事务内的写入
+	info, err := txn.db.indexer.Get(key)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		delete(txn.pendingWrites, string(key))
+		return nil
+	}
+
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	return nil
+}
+
+// Commit 提交事务，如果读过的 key 在事务开始后被其他提交修改过，返回 ErrTxnConflict
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+
+	if txn.discarded {
+		return ErrTxnDiscarded
+	}
+	defer txn.discard()
+
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+
+	if len(txn.pendingWrites) > DefaultWriteBatchOption.maxBatchNum {
+		return ErrExceedMaxBatchNum
+	}
+
+	txn.db.lock()
+	defer txn.db.unlock()
+
+	if txn.db.oracle.hasConflict(txn.readTs, txn.reads) {
+		return ErrTxnConflict
+	}
+
+	return txn.db.writeTxnRecords(txn.pendingWrites, txn.db.syncWrite)
+}
+
+// Discard 丢弃事务，释放相应资源，可以重复调用
+func (txn *Txn) Discard() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	txn.discard()
+}
+
+func (txn *Txn) discard() {
+	if txn.discarded {
+		return
+	}
+	txn.discarded = true
+	txn.pendingWrites = nil
+	txn.db.oracle.done(txn.readTs)
+}
+
+func (txn *Txn) checkWritable() error {
+	if txn.discarded {
+		return ErrTxnDiscarded
+	}
+	if txn.readOnly {
+		return ErrTxnReadOnly
+	}
+	return nil
+}
+
+func (txn *Txn) addRead(key []byte) {
+	if txn.readOnly {
+		return
+	}
+	txn.reads[string(key)] = struct{}{}
+}
+
+// TxnIterator 事务迭代器，合并遍历事务中尚未提交的写入以及数据库中的数据
+type TxnIterator struct {
+	txn     *Txn
+	dbIter  *Iterator
+	pending []*data.LogRecord // 按照遍历顺序排好序的事务内写入
+	reverse bool
+
+	idx         int  // pending 中的当前位置
+	fromPending bool // 当前位置的数据是否来自事务内的写入
+	valid       bool
+
+	keyOnly bool
+	limit   int // 合并之后最多遍历的 key 的数量
+	count   int
+}
+
+// NewIterator 创建事务迭代器，事务内的写入会覆盖数据库中的同名 key
+func (txn *Txn) NewIterator(opts ...IteratorOption) (*TxnIterator, error) {
+	iterOpt := DefaultIteratorOption
+	for _, opt := range opts {
+		opt(&iterOpt)
+	}
+
+	lower, upper := iterOpt.bounds()
+	txn.mu.Lock()
+	pending := make([]*data.LogRecord, 0, len(txn.pendingWrites))
+	for _, record := range txn.pendingWrites {
+		if !inRange(record.Key, lower, upper) {
+			continue
+		}
+		pending = append(pending, record)
+	}
+	txn.mu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		if iterOpt.reverse {
+			return bytes.Compare(pending[i].Key, pending[j].Key) > 0
+		}
+		return bytes.Compare(pending[i].Key, pending[j].Key) < 0
+	})
+
+	// 事务内的删除会跳过数据库中的 key，数量限制在合并之后计算
+	dbIter, err := txn.db.NewIterator(append(opts, WithIteratorLimit(0))...)
+	if err != nil {
+		return nil, err
+	}
+	it := &TxnIterator{
+		txn:     txn,
+		dbIter:  dbIter,
+		pending: pending,
+		reverse: iterOpt.reverse,
+		keyOnly: iterOpt.keyOnly,
+		limit:   iterOpt.limit,
+	}
+	it.settle()
+	return it, nil
+}
+
+// Rewind 重新回到迭代器的起点
+func (it *TxnIterator) Rewind() {
+	it.dbIter.Rewind()
+	it.idx = 0
+	it.count = 0
+	it.settle()
+}
+
+// Seek 查找到第一个大于（或小于）等于 key 的位置
+func (it *TxnIterator) Seek(key []byte) {
+	it.dbIter.Seek(key)
+	it.idx = sort.Search(len(it.pending), func(i int) bool {
+		return it.compare(it.pending[i].Key, key) >= 0
+	})
+	it.count = 0
+	it.settle()
+}
+
+// Next 跳转到下一个 key
+func (it *TxnIterator) Next() {
+	if !it.valid {
+		return
+	}
+	if it.fromPending {
+		if it.dbIter.Valid() && bytes.Equal(it.dbIter.Key(), it.pending[it.idx].Key) {
+			it.dbIter.Next()
+		}
+		it.idx++
+	} else {
+		it.dbIter.Next()
+	}
+	it.count++
+	it.settle()
+}
+
+func (it *TxnIterator) Valid() bool {
+	return it.valid && (it.limit <= 0 || it.count < it.limit)
+}
+
+func (it *TxnIterator) Key() []byte {
+	if it.fromPending {
+		return it.pending[it.idx].Key
+	}
+	return it.dbIter.Key()
+}
+
+func (it *TxnIterator) Value() ([]byte, error) {
+	if it.keyOnly {
+		return nil, ErrIteratorKeyOnly
+	}
+	if it.fromPending {
+		return it.pending[it.idx].Value, nil
+	}
+
+	it.txn.mu.Lock()
+	it.txn.addRead(it.dbIter.Key())
+	it.txn.mu.Unlock()
+	return it.dbIter.Value()
+}
+
+// Close 关闭迭代器，释放相应资源
+func (it *TxnIterator) Close() error {
+	return it.dbIter.Close()
+}
+
+func (it *TxnIterator) compare(a, b []byte) int {
+	if it.reverse {
+		return bytes.Compare(b, a)
+	}
+	return bytes.Compare(a, b)
+}
+
+// settle 在事务内写入和数据库数据之间选出下一个位置，跳过事务内已经删除的 key
+func (it *TxnIterator) settle() {
+	for {
+		hasPending := it.idx < len(it.pending)
+		hasDB := it.dbIter.Valid()
+
+		if !hasPending && !hasDB {
+			it.valid = false
+			return
+		}
+
+		if !hasPending || (hasDB && it.compare(it.pending[it.idx].Key, it.dbIter.Key()) > 0) {
+			it.fromPending = false
+			it.valid = true
+			return
+		}
+
+		record := it.pending[it.idx]
+		if record.Type == data.LogRecordDeleted {
+			if hasDB && bytes.Equal(record.Key, it.dbIter.Key()) {
+				it.dbIter.Next()
+			}
+			it.idx++
+			continue
+		}
+
+		it.fromPending = true
+		it.valid = true
+		return
+	}
+}
+
+// oracle 记录提交的时间戳以及最近提交修改过的 key，用于乐观事务的冲突检测
+type oracle struct {
+	mu        sync.Mutex
+	commitTs  uint64            // 最近一次提交的时间戳
+	committed []committedTxn    // 仍可能与活跃事务冲突的提交
+	active    map[uint64]uint32 // 活跃事务的 readTs 以及对应的事务数量
+}
+
+type committedTxn struct {
+	ts   uint64
+	keys map[string]struct{}
+}
+
+func newOracle() *oracle {
+	return &oracle{active: make(map[uint64]uint32)}
+}
+
+// begin 登记一个新的活跃事务，返回其 readTs
+func (o *oracle) begin() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ts := o.commitTs
+	o.active[ts]++
+	return ts
+}
+
+// done 事务结束，清理不再需要的提交记录
+func (o *oracle) done(readTs uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.active[readTs] <= 1 {
+		delete(o.active, readTs)
+	} else {
+		o.active[readTs]--
+	}
+	o.cleanup()
+}
+
+// commit 登记一次提交修改过的 key，调用方需要持有 db 的锁，或者在并行更新索引时持有 applyMu 的读锁
+func (o *oracle) commit(keys [][]byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.commitTs++
+	// 没有活跃事务时，之后开始的事务都不会与本次提交冲突
+	if len(o.active) == 0 {
+		return
+	}
+
+	keySet := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		keySet[string(key)] = struct{}{}
+	}
+	o.committed = append(o.committed, committedTxn{ts: o.commitTs, keys: keySet})
+}
+
+// hasConflict 判断 readTs 之后的提交是否修改过 reads 中的 key，调用方需要持有 db 的锁
+func (o *oracle) hasConflict(readTs uint64, reads map[string]struct{}) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, txn := range o.committed {
+		if txn.ts <= readTs {
+			continue
+		}
+		for key := range reads {
+			if _, ok := txn.keys[key]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o *oracle) cleanup() {
+	if len(o.active) == 0 {
+		o.committed = nil
+		return
+	}
+
+	minReadTs := o.commitTs
+	for ts := range o.active {
+		if ts < minReadTs {
+			minReadTs = ts
+		}
+	}
+
+	i := 0
+	for i < len(o.committed) && o.committed[i].ts <= minReadTs {
+		i++
+	}
+	o.committed = o.committed[i:]
+}
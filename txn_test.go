@@ -0,0 +1,202 @@
+package bitcask
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Txn_ReadYourWrites(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-1")
+	db, err := Open(WithDBDirPath(dir))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(getTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+
+	txn := db.Begin(false)
+	err = txn.Put(getTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+	err = txn.Delete(getTestKey(1))
+	assert.Nil(t, err)
+
+	// 事务内可以读到自己的写入
+	val, err := txn.Get(getTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = txn.Get(getTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 提交之前对数据库不可见
+	_, err = db.Get(getTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	err = txn.Commit()
+	assert.Nil(t, err)
+
+	val, err = db.Get(getTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+	_, err = db.Get(getTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 提交之后事务不可再使用
+	assert.Equal(t, ErrTxnDiscarded, txn.Put(getTestKey(3), []byte("v3")))
+	assert.Equal(t, ErrTxnDiscarded, txn.Commit())
+}
+
+func TestDB_Txn_Conflict(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-2")
+	db, err := Open(WithDBDirPath(dir))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put(getTestKey(1), []byte("100"))
+	assert.Nil(t, err)
+
+	txn1 := db.Begin(false)
+	txn2 := db.Begin(false)
+
+	_, err = txn1.Get(getTestKey(1))
+	assert.Nil(t, err)
+	_, err = txn2.Get(getTestKey(1))
+	assert.Nil(t, err)
+
+	assert.Nil(t, txn1.Put(getTestKey(1), []byte("101")))
+	assert.Nil(t, txn2.Put(getTestKey(1), []byte("102")))
+
+	assert.Nil(t, txn1.Commit())
+	assert.Equal(t, ErrTxnConflict, txn2.Commit())
+
+	val, err := db.Get(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("101"), val)
+
+	// 普通的 Put 同样会导致冲突
+	txn3 := db.Begin(false)
+	_, err = txn3.Get(getTestKey(1))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(getTestKey(1), []byte("103")))
+	assert.Nil(t, txn3.Put(getTestKey(2), []byte("v")))
+	assert.Equal(t, ErrTxnConflict, txn3.Commit())
+
+	// 读写不相交的事务不冲突
+	txn4 := db.Begin(false)
+	txn5 := db.Begin(false)
+	_, _ = txn4.Get(getTestKey(10))
+	_, _ = txn5.Get(getTestKey(20))
+	assert.Nil(t, txn4.Put(getTestKey(10), []byte("a")))
+	assert.Nil(t, txn5.Put(getTestKey(20), []byte("b")))
+	assert.Nil(t, txn4.Commit())
+	assert.Nil(t, txn5.Commit())
+	assert.Empty(t, db.oracle.committed)
+}
+
+func TestDB_Txn_ReadOnlyAndDiscard(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-3")
+	db, err := Open(WithDBDirPath(dir))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	txn := db.Begin(true)
+	assert.Equal(t, ErrTxnReadOnly, txn.Put(getTestKey(1), []byte("v")))
+	assert.Equal(t, ErrTxnReadOnly, txn.Delete(getTestKey(1)))
+	assert.Nil(t, txn.Commit())
+
+	txn = db.Begin(false)
+	assert.Nil(t, txn.Put(getTestKey(1), []byte("v")))
+	txn.Discard()
+	txn.Discard()
+	assert.Equal(t, ErrTxnDiscarded, txn.Commit())
+
+	_, err = db.Get(getTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Txn_Iterator(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-4")
+	db, err := Open(WithDBDirPath(dir))
+	defer removeDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("db-a")))
+	assert.Nil(t, db.Put([]byte("c"), []byte("db-c")))
+	assert.Nil(t, db.Put([]byte("e"), []byte("db-e")))
+
+	txn := db.Begin(false)
+	defer txn.Discard()
+	assert.Nil(t, txn.Put([]byte("b"), []byte("txn-b")))
+	assert.Nil(t, txn.Put([]byte("c"), []byte("txn-c")))
+	assert.Nil(t, txn.Delete([]byte("e")))
+	assert.Nil(t, txn.Put([]byte("f"), []byte("txn-f")))
+
+	collect := func(it *TxnIterator) []string {
+		var res []string
+		for ; it.Valid(); it.Next() {
+			val, err := it.Value()
+			assert.Nil(t, err)
+			res = append(res, string(it.Key())+"="+string(val))
+		}
+		return res
+	}
+
+	it, err := txn.NewIterator()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a=db-a", "b=txn-b", "c=txn-c", "f=txn-f"}, collect(it))
+	it.Seek([]byte("bb"))
+	assert.Equal(t, []string{"c=txn-c", "f=txn-f"}, collect(it))
+	it.Close()
+
+	it, err = txn.NewIterator(WithIteratorReverse(true))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"f=txn-f", "c=txn-c", "b=txn-b", "a=db-a"}, collect(it))
+	it.Seek([]byte("d"))
+	assert.Equal(t, []string{"c=txn-c", "b=txn-b", "a=db-a"}, collect(it))
+	it.Close()
+
+	// 范围和数量限制同时作用于事务中的写入
+	it, err = txn.NewIterator(WithIteratorLowerBound([]byte("b")), WithIteratorUpperBound([]byte("f")), WithIteratorReverse(true))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c=txn-c", "b=txn-b"}, collect(it))
+	it.Close()
+	it, err = txn.NewIterator(WithIteratorLimit(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a=db-a", "b=txn-b"}, collect(it))
+	it.Close()
+}
+
+func TestDB_Txn_Restart(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-5")
+	db, err := Open(WithDBDirPath(dir))
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put(getTestKey(1), randomValue(10)))
+
+	txn := db.Begin(false)
+	assert.Nil(t, txn.Put(getTestKey(2), randomValue(10)))
+	assert.Nil(t, txn.Delete(getTestKey(1)))
+	assert.Nil(t, txn.Commit())
+
+	// 未提交的事务不会写入数据文件
+	txn = db.Begin(false)
+	assert.Nil(t, txn.Put(getTestKey(3), randomValue(10)))
+	txn.Discard()
+
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(WithDBDirPath(dir))
+	defer removeDB(db2)
+	assert.Nil(t, err)
+
+	_, err = db2.Get(getTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db2.Get(getTestKey(2))
+	assert.Nil(t, err)
+	_, err = db2.Get(getTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, uint64(1), db2.seqNo)
+}